@@ -0,0 +1,278 @@
+// Package broker holds the extensions of the embedded gMQTT broker
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+	l "github.com/crosstyan/mqtt-to-ws/logger"
+	"github.com/crosstyan/mqtt-to-ws/topic"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+var logger = l.For(l.Broker)
+
+// messageLogger logs the denied publishes, it's sampled
+var messageLogger = l.Sampled(l.Broker)
+
+// Permission lists the topic filters a client may publish and subscribe to.
+// %u is replaced by the username and %c by the client ID of the client.
+type Permission struct {
+	Publish   []string `yaml:"publish"`
+	Subscribe []string `yaml:"subscribe"`
+}
+
+// Account of a device. Password is a bcrypt hash.
+type Account struct {
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	Permission `yaml:",inline"`
+}
+
+// AuthConfig is read from the file given by --mqtt-auth
+//
+//	allow_anonymous: false
+//	default:
+//	  publish: ["sensors/%u/#"]
+//	users:
+//	  - username: sensor-01
+//	    password: $2a$10$...
+//	    subscribe: ["devices/%u/cmd"]
+type AuthConfig struct {
+	AllowAnonymous bool `yaml:"allow_anonymous"`
+	// Permission of the anonymous clients, if they are allowed
+	Anonymous Permission `yaml:"anonymous"`
+	// Granted to every user in addition to their own permission
+	Default Permission `yaml:"default"`
+	Users   []Account  `yaml:"users"`
+}
+
+// AuthStats counts the denied attempts
+type AuthStats struct {
+	AuthFailed      uint64 `json:"auth_failed"`
+	PublishDenied   uint64 `json:"publish_denied"`
+	SubscribeDenied uint64 `json:"subscribe_denied"`
+}
+
+// Auth authenticates the MQTT clients and enforces the topic ACL.
+// Its accounts and ACL can be replaced while the broker runs.
+type Auth struct {
+	// *authState, nil when any client may connect and publish to any topic
+	state atomic.Value
+	stats AuthStats
+}
+
+type authState struct {
+	config AuthConfig
+	users  map[string]*Account
+}
+
+// LoadAuth reads the accounts and the ACL from a YAML file
+func LoadAuth(path string) (*Auth, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AuthConfig
+	if err = yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	a, err := NewAuth(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+// NewAuth validates the config and indexes the accounts by username
+func NewAuth(config AuthConfig) (*Auth, error) {
+	state := &authState{config: config, users: make(map[string]*Account)}
+	perms := []Permission{config.Anonymous, config.Default}
+	for i := range config.Users {
+		u := &config.Users[i]
+		if u.Username == "" {
+			return nil, fmt.Errorf("user %d: empty username", i)
+		}
+		if _, ok := state.users[u.Username]; ok {
+			return nil, fmt.Errorf("user %s: duplicated username", u.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			return nil, fmt.Errorf("user %s: password is not a bcrypt hash: %w", u.Username, err)
+		}
+		state.users[u.Username] = u
+		perms = append(perms, u.Permission)
+	}
+	for _, p := range perms {
+		for _, filter := range append(append([]string{}, p.Publish...), p.Subscribe...) {
+			if err := topic.ValidateFilter(filter); err != nil {
+				return nil, err
+			}
+		}
+	}
+	a := &Auth{}
+	a.state.Store(state)
+	return a, nil
+}
+
+// NewOpenAuth returns an Auth letting any client connect and publish to any topic, until it's replaced
+func NewOpenAuth() *Auth {
+	a := &Auth{}
+	a.state.Store((*authState)(nil))
+	return a
+}
+
+// Replace takes the accounts and the ACL of other, or lets any client in if other is nil.
+// The connected clients are checked against the new ACL from their next publish or subscribe.
+func (a *Auth) Replace(other *Auth) {
+	if other == nil {
+		a.state.Store((*authState)(nil))
+		return
+	}
+	a.state.Store(other.load())
+}
+
+// Same reports whether other holds the same accounts and ACL as a, nil letting any client in
+func (a *Auth) Same(other *Auth) bool {
+	var state *authState
+	if other != nil {
+		state = other.load()
+	}
+	return reflect.DeepEqual(a.load(), state)
+}
+
+// Enabled reports whether the clients are authenticated
+func (a *Auth) Enabled() bool {
+	return a.load() != nil
+}
+
+func (a *Auth) load() *authState {
+	return a.state.Load().(*authState)
+}
+
+// Stats returns a snapshot of the denied attempts
+func (a *Auth) Stats() AuthStats {
+	return AuthStats{
+		AuthFailed:      atomic.LoadUint64(&a.stats.AuthFailed),
+		PublishDenied:   atomic.LoadUint64(&a.stats.PublishDenied),
+		SubscribeDenied: atomic.LoadUint64(&a.stats.SubscribeDenied),
+	}
+}
+
+// OnBasicAuth checks the username and the password of the CONNECT packet
+func (a *Auth) OnBasicAuth(ctx context.Context, client server.Client, req *server.ConnectRequest) error {
+	username := string(req.Connect.Username)
+	// ClientOptions are not filled before the client is authenticated
+	clientID := string(req.Connect.ClientID)
+	state := a.load()
+	if state == nil || username == "" && state.config.AllowAnonymous {
+		return nil
+	}
+	u, ok := state.users[username]
+	if ok && bcrypt.CompareHashAndPassword([]byte(u.Password), req.Connect.Password) == nil {
+		return nil
+	}
+	atomic.AddUint64(&a.stats.AuthFailed, 1)
+	logger.Warnf("MQTT client %s (user %q) from %s failed to authenticate",
+		clientID, username, client.Connection().RemoteAddr())
+	if packets.IsVersion3X(client.Version()) {
+		return codes.NewError(codes.V3BadUsernameorPassword)
+	}
+	return codes.NewError(codes.BadUserNameOrPassword)
+}
+
+// OnSubscribe rejects the topic filters not covered by the permission of the client
+func (a *Auth) OnSubscribe(ctx context.Context, client server.Client, req *server.SubscribeRequest) error {
+	state := a.load()
+	if state == nil {
+		return nil
+	}
+	opts := identity(client)
+	perm := state.permission(opts)
+	for name, sub := range req.Subscriptions {
+		if allowed(perm.Subscribe, opts, sub.Sub.TopicFilter, topic.Covers) {
+			continue
+		}
+		atomic.AddUint64(&a.stats.SubscribeDenied, 1)
+		logger.Warnf("MQTT client %s (user %q) is not allowed to subscribe to %s",
+			opts.ClientID, opts.Username, sub.Sub.TopicFilter)
+		req.Reject(name, codes.NewError(codes.NotAuthorized))
+	}
+	return nil
+}
+
+// CanPublish reports whether the client may publish to the topic
+func (a *Auth) CanPublish(client server.Client, name string) bool {
+	state := a.load()
+	if state == nil {
+		return true
+	}
+	opts := identity(client)
+	if allowed(state.permission(opts).Publish, opts, name, topic.Match) {
+		return true
+	}
+	atomic.AddUint64(&a.stats.PublishDenied, 1)
+	messageLogger.Warnw("MQTT client is not allowed to publish",
+		"client_id", opts.ClientID, "username", opts.Username, "topic", name)
+	return false
+}
+
+// identity returns the options of the client with the CN of its certificate as username, if it has one,
+// CertAuthWrapper making sure it didn't send another username
+func identity(client server.Client) *server.ClientOptions {
+	opts := client.ClientOptions()
+	if cn, ok := peerCommonName(client.Connection()); ok && opts.Username != cn {
+		withCN := *opts
+		withCN.Username = cn
+		return &withCN
+	}
+	return opts
+}
+
+// permission returns the merged permission of the user of a client
+func (a *authState) permission(opts *server.ClientOptions) Permission {
+	username := opts.Username
+	if username == "" {
+		return a.config.Anonymous
+	}
+	p := a.config.Default
+	if u, ok := a.users[username]; ok {
+		p.Publish = append(append([]string{}, p.Publish...), u.Publish...)
+		p.Subscribe = append(append([]string{}, p.Subscribe...), u.Subscribe...)
+	}
+	return p
+}
+
+// allowed expands the placeholders of the filters and checks them against the topic
+func allowed(filters []string, opts *server.ClientOptions, name string, match func(filter, name string) bool) bool {
+	for _, filter := range filters {
+		expanded, ok := expand(filter, opts)
+		if ok && match(expanded, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand replaces %u and %c. It fails if the substitution would add levels or wildcards to the filter.
+func expand(filter string, opts *server.ClientOptions) (string, bool) {
+	if strings.Contains(filter, "%u") && !isLevel(opts.Username) {
+		return "", false
+	}
+	if strings.Contains(filter, "%c") && !isLevel(opts.ClientID) {
+		return "", false
+	}
+	return strings.NewReplacer("%u", opts.Username, "%c", opts.ClientID).Replace(filter), true
+}
+
+// isLevel reports whether s can be used as a single topic level
+func isLevel(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/+#")
+}
@@ -0,0 +1,23 @@
+package broker
+
+import "testing"
+
+func TestAuthSame(t *testing.T) {
+	config := func(publish string) AuthConfig {
+		return AuthConfig{Default: Permission{Publish: []string{publish}}}
+	}
+	a, err := NewAuth(config("a/#"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, _ := NewAuth(config("a/#"))
+	other, _ := NewAuth(config("b/#"))
+	live := NewOpenAuth()
+	if !live.Same(nil) || live.Same(a) {
+		t.Error("an open Auth is only the same as nil")
+	}
+	live.Replace(a)
+	if !live.Same(same) || live.Same(other) || live.Same(nil) {
+		t.Error("Same doesn't compare the accounts and the ACL")
+	}
+}
@@ -0,0 +1,27 @@
+package broker
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	authFailed = prometheus.NewDesc("mqttws_mqtt_auth_failed_total",
+		"MQTT connections rejected for a bad username or password", nil, nil)
+	publishDenied = prometheus.NewDesc("mqttws_mqtt_publish_denied_total",
+		"MQTT publishes dropped by the ACL", nil, nil)
+	subscribeDenied = prometheus.NewDesc("mqttws_mqtt_subscribe_denied_total",
+		"MQTT subscriptions rejected by the ACL", nil, nil)
+)
+
+// Describe implements prometheus.Collector
+func (a *Auth) Describe(ch chan<- *prometheus.Desc) {
+	ch <- authFailed
+	ch <- publishDenied
+	ch <- subscribeDenied
+}
+
+// Collect implements prometheus.Collector with the denied attempts
+func (a *Auth) Collect(ch chan<- prometheus.Metric) {
+	stats := a.Stats()
+	ch <- prometheus.MustNewConstMetric(authFailed, prometheus.CounterValue, float64(stats.AuthFailed))
+	ch <- prometheus.MustNewConstMetric(publishDenied, prometheus.CounterValue, float64(stats.PublishDenied))
+	ch <- prometheus.MustNewConstMetric(subscribeDenied, prometheus.CounterValue, float64(stats.SubscribeDenied))
+}
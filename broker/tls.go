@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+// TLSConfig loads the certificate of the broker.
+// If caFile is set, clients may present a certificate signed by it to authenticate themselves.
+func TLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// CertAuthWrapper authenticates the clients presenting a verified certificate
+// and maps the CN of the certificate to their client ID and username.
+// Their CONNECT may omit them, but the ones it carries must be the CN.
+// The other clients are handed to the wrapped OnBasicAuth, if any.
+func CertAuthWrapper(pre server.OnBasicAuth) server.OnBasicAuth {
+	return func(ctx context.Context, client server.Client, req *server.ConnectRequest) error {
+		cn, ok := peerCommonName(client.Connection())
+		if !ok {
+			if pre == nil {
+				return nil
+			}
+			return pre(ctx, client, req)
+		}
+		// the ACL of the client is the one of its username, which can't be borrowed from another account
+		if username := string(req.Connect.Username); username != "" && username != cn {
+			logger.Warnf("MQTT client %s (user %q) from %s presented a certificate of %s",
+				req.Connect.ClientID, username, client.Connection().RemoteAddr(), cn)
+			if packets.IsVersion3X(client.Version()) {
+				return codes.NewError(codes.V3BadUsernameorPassword)
+			}
+			return codes.NewError(codes.BadUserNameOrPassword)
+		}
+		clientID := string(req.Connect.ClientID)
+		if clientID == "" {
+			req.Options.AssignedClientID = []byte(cn)
+			return nil
+		}
+		if clientID != cn {
+			logger.Warnf("MQTT client %s from %s presented a certificate of %s",
+				clientID, client.Connection().RemoteAddr(), cn)
+			if packets.IsVersion3X(client.Version()) {
+				return codes.NewError(codes.V3IdentifierRejected)
+			}
+			return codes.NewError(codes.ClientIdentifierNotValid)
+		}
+		return nil
+	}
+}
+
+// peerCommonName returns the CN of the verified client certificate of a TLS connection
+func peerCommonName(conn net.Conn) (string, bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+	cn := state.PeerCertificates[0].Subject.CommonName
+	return cn, cn != ""
+}
@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DrmagicE/gmqtt"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	"github.com/DrmagicE/gmqtt/server"
+)
+
+// testClient is a server.Client on a given connection
+type testClient struct {
+	opts server.ClientOptions
+	conn net.Conn
+}
+
+func (c *testClient) ClientOptions() *server.ClientOptions      { return &c.opts }
+func (c *testClient) SessionInfo() *gmqtt.Session               { return nil }
+func (c *testClient) Version() packets.Version                  { return packets.Version311 }
+func (c *testClient) ConnectedAt() time.Time                    { return time.Time{} }
+func (c *testClient) Connection() net.Conn                      { return c.conn }
+func (c *testClient) Close()                                    {}
+func (c *testClient) Disconnect(disconnect *packets.Disconnect) {}
+
+// certificate signs a certificate of the CN with the CA, or self-signs it if ca is nil
+func certificate(t *testing.T, cn string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := template, interface{}(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writePEM writes the certificate and its key in dir
+func writePEM(t *testing.T, dir, name string, cert tls.Certificate) (certFile, keyFile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsPeers returns the broker side of a TLS connection,
+// the client presenting the certificate of the CN signed by the CA of the broker, if cn is set
+func tlsPeers(t *testing.T, cn string) net.Conn {
+	dir := t.TempDir()
+	ca := certificate(t, "ca", nil)
+	caFile, _ := writePEM(t, dir, "ca", ca)
+	certFile, keyFile := writePEM(t, dir, "broker", certificate(t, "broker", &ca))
+	config, err := TLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+	if cn != "" {
+		clientConfig.Certificates = []tls.Certificate{certificate(t, cn, &ca)}
+	}
+	brokerSide, clientSide := net.Pipe()
+	server, client := tls.Server(brokerSide, config), tls.Client(clientSide, clientConfig)
+	// closing the TLS connections would block on the unbuffered pipe
+	t.Cleanup(func() {
+		brokerSide.Close()
+		clientSide.Close()
+	})
+	done := make(chan error)
+	go func() { done <- client.Handshake() }()
+	if err = server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestCertAuthWrapper(t *testing.T) {
+	certConn := tlsPeers(t, "sensor-01")
+	plainConn := tlsPeers(t, "")
+	tests := []struct {
+		name     string
+		conn     net.Conn
+		clientID string
+		username string
+		ok       bool
+		// the client ID assigned to the client, if any
+		assigned string
+		pre      bool
+	}{
+		{"empty client ID and username", certConn, "", "", true, "sensor-01", false},
+		{"CN as client ID and username", certConn, "sensor-01", "sensor-01", true, "", false},
+		{"another username", certConn, "sensor-01", "admin", false, "", false},
+		{"another username, empty client ID", certConn, "", "admin", false, "", false},
+		{"another client ID", certConn, "sensor-02", "", false, "", false},
+		{"no certificate", plainConn, "sensor-02", "admin", true, "", true},
+	}
+	for _, tt := range tests {
+		called := false
+		pre := func(ctx context.Context, client server.Client, req *server.ConnectRequest) error {
+			called = true
+			return nil
+		}
+		req := &server.ConnectRequest{
+			Connect: &packets.Connect{ClientID: []byte(tt.clientID), Username: []byte(tt.username)},
+			Options: &server.AuthOptions{},
+		}
+		err := CertAuthWrapper(pre)(context.Background(), &testClient{conn: tt.conn}, req)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if string(req.Options.AssignedClientID) != tt.assigned {
+			t.Errorf("%s: assigned %q, want %q", tt.name, req.Options.AssignedClientID, tt.assigned)
+		}
+		if called != tt.pre {
+			t.Errorf("%s: OnBasicAuth called: %v", tt.name, called)
+		}
+	}
+}
+
+func TestCertPermission(t *testing.T) {
+	auth, err := NewAuth(AuthConfig{
+		Anonymous: Permission{Publish: []string{"public/#"}},
+		Default:   Permission{Publish: []string{"sensors/%u/#"}},
+		Users: []Account{{
+			Username:   "sensor-01",
+			Password:   "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+			Permission: Permission{Publish: []string{"devices/%c/data"}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the username of the CONNECT packet is empty, the CN stands for it
+	cert := &testClient{opts: server.ClientOptions{ClientID: "sensor-01"}, conn: tlsPeers(t, "sensor-01")}
+	anonymous := &testClient{opts: server.ClientOptions{ClientID: "sensor-01"}, conn: tlsPeers(t, "")}
+	tests := []struct {
+		name   string
+		client *testClient
+		topic  string
+		ok     bool
+	}{
+		{"certificate", cert, "sensors/sensor-01/temp", true},
+		{"certificate", cert, "devices/sensor-01/data", true},
+		{"certificate", cert, "sensors/sensor-02/temp", false},
+		{"certificate", cert, "public/temp", false},
+		{"anonymous", anonymous, "public/temp", true},
+		{"anonymous", anonymous, "sensors/sensor-01/temp", false},
+	}
+	for _, tt := range tests {
+		if got := auth.CanPublish(tt.client, tt.topic); got != tt.ok {
+			t.Errorf("%s publishing to %s: got %v, want %v", tt.name, tt.topic, got, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package config gathers the settings of the bridge from the command line,
+// the MQTTWS_* environment variables and a YAML or TOML file
+package config
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	gmqttconfig "github.com/DrmagicE/gmqtt/config"
+	"github.com/crosstyan/mqtt-to-ws/broker"
+	"github.com/crosstyan/mqtt-to-ws/ingest"
+	"github.com/crosstyan/mqtt-to-ws/logger"
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/crosstyan/mqtt-to-ws/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the whole configuration of the bridge.
+// Every field can be set in the config file by its YAML key
+// and by the environment variable MQTTWS_<SECTION>_<KEY>, e.g. MQTTWS_STORE_MONGO_URL.
+type Config struct {
+	HTTP      HTTP          `yaml:"http"`
+	MQTT      MQTT          `yaml:"mqtt"`
+	Store     Store         `yaml:"store"`
+	Ingest    Ingest        `yaml:"ingest"`
+	Websocket Websocket     `yaml:"websocket"`
+	Log       logger.Config `yaml:"log"`
+	// Routes is used when RoutesFile is empty, the default routes when both are empty
+	Routes     model.Routes `yaml:"routes,omitempty"`
+	RoutesFile string       `yaml:"routes_file"`
+}
+
+type HTTP struct {
+	Addr string `yaml:"addr"`
+	// Swagger BaseURL
+	SwaggerAddr string `yaml:"swagger_addr"`
+	// Longest time to stop the servers and write the pending records
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Bearer token of the /admin and import endpoints, which are disabled when it's empty
+	AdminToken string `yaml:"admin_token"`
+}
+
+type MQTT struct {
+	Addr string `yaml:"addr"`
+	// The optional listeners are disabled when their address is empty
+	TLSAddr string `yaml:"tls_addr"`
+	WsAddr  string `yaml:"ws_addr"`
+	WssAddr string `yaml:"wss_addr"`
+	WsPath  string `yaml:"ws_path"`
+	TLS     TLS    `yaml:"tls"`
+	// Auth is used when AuthFile is empty, any client may connect when both are empty
+	Auth     *broker.AuthConfig `yaml:"auth,omitempty"`
+	AuthFile string             `yaml:"auth_file"`
+	// Settings of the gMQTT broker
+	Broker gmqttconfig.MQTT `yaml:"broker"`
+}
+
+type TLS struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// CA of the client certificates
+	CA string `yaml:"ca"`
+}
+
+type Store struct {
+	// 'mongo', 'memory' or 'sqlite:/path/to/file.db'
+	Backend  string            `yaml:"backend"`
+	MongoURL string            `yaml:"mongo_url"`
+	Database string            `yaml:"database"`
+	Batch    model.BatchConfig `yaml:"batch"`
+	// Empty to give up the records the database can't take
+	SpoolDir string `yaml:"spool_dir"`
+	// Size cap of the spool in MiB
+	SpoolMax int64 `yaml:"spool_max"`
+	// How often the records older than the retention of their route are deleted
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+type Ingest struct {
+	QueueSize  int    `yaml:"queue_size"`
+	WsOverflow string `yaml:"ws_overflow"`
+	DBOverflow string `yaml:"db_overflow"`
+	SpillDir   string `yaml:"spill_dir"`
+	// Size cap of each spill file in MiB
+	SpillMax int64 `yaml:"spill_max"`
+}
+
+type Websocket struct {
+	Path string `yaml:"path"`
+	// ACL is used when ACLFile is empty, publishing is disabled when both are empty
+	ACL     *utils.WsACL `yaml:"acl,omitempty"`
+	ACLFile string       `yaml:"acl_file"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		HTTP: HTTP{
+			Addr:            "0.0.0.0:8080",
+			SwaggerAddr:     "localhost:8080",
+			ShutdownTimeout: 10 * time.Second,
+		},
+		MQTT: MQTT{
+			Addr:   "0.0.0.0:1883",
+			WsPath: "/mqtt",
+			Broker: gmqttconfig.DefaultMQTTConfig,
+		},
+		Store: Store{
+			Backend:       "mongo",
+			MongoURL:      "mongodb://127.0.0.1:27017/",
+			Database:      "mqtt",
+			Batch:         model.DefaultBatchConfig,
+			SpoolDir:      "spool",
+			SpoolMax:      1024,
+			PurgeInterval: model.DefaultPurgeInterval,
+		},
+		Ingest: Ingest{
+			QueueSize:  1024,
+			WsOverflow: string(ingest.PolicyDropOldest),
+			DBOverflow: string(ingest.PolicyBlock),
+			SpillDir:   "spill",
+			SpillMax:   1024,
+		},
+		Websocket: Websocket{
+			Path: "/ws",
+		},
+		Log: logger.DefaultConfig,
+	}
+}
+
+// Validate checks every setting and the files they refer to, and reports all the problems at once
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, key+": "+fmt.Sprintf(format, args...))
+		}
+	}
+	check(c.HTTP.Addr != "", "http.addr", "must not be empty")
+	check(c.HTTP.ShutdownTimeout > 0, "http.shutdown_timeout", "must be positive")
+	check(c.MQTT.Addr != "", "mqtt.addr", "must not be empty")
+	check(strings.HasPrefix(c.MQTT.WsPath, "/"), "mqtt.ws_path", "must start with '/'")
+	if c.MQTT.TLSAddr != "" || c.MQTT.WssAddr != "" {
+		check(c.MQTT.TLS.Cert != "" && c.MQTT.TLS.Key != "", "mqtt.tls",
+			"cert and key are required by mqtt.tls_addr and mqtt.wss_addr")
+	}
+	if err := c.MQTT.Broker.Validate(); err != nil {
+		errs = append(errs, "mqtt.broker: "+err.Error())
+	}
+	if _, err := c.LoadAuth(); err != nil {
+		errs = append(errs, "mqtt.auth: "+err.Error())
+	}
+	check(c.Store.Backend != "", "store.backend", "must not be empty")
+	check(c.Store.Batch.Size > 0, "store.batch.size", "must be positive")
+	check(c.Store.Batch.Interval > 0, "store.batch.interval", "must be positive")
+	check(c.Store.Batch.Retries >= 0, "store.batch.retries", "can't be negative")
+	check(c.Store.SpoolMax > 0, "store.spool_max", "must be positive")
+	check(c.Store.PurgeInterval > 0, "store.purge_interval", "must be positive")
+	check(c.Ingest.QueueSize > 0, "ingest.queue_size", "must be positive")
+	check(c.Ingest.SpillMax > 0, "ingest.spill_max", "must be positive")
+	if _, err := ingest.ParsePolicy(c.Ingest.WsOverflow); err != nil {
+		errs = append(errs, "ingest.ws_overflow: "+err.Error())
+	}
+	if _, err := ingest.ParsePolicy(c.Ingest.DBOverflow); err != nil {
+		errs = append(errs, "ingest.db_overflow: "+err.Error())
+	}
+	check(strings.HasPrefix(c.Websocket.Path, "/"), "websocket.path", "must start with '/'")
+	if _, err := c.LoadWsACL(); err != nil {
+		errs = append(errs, "websocket.acl: "+err.Error())
+	}
+	if routes, err := c.LoadRoutes(); err != nil {
+		errs = append(errs, "routes: "+err.Error())
+	} else {
+		for _, collection := range routes.Collections() {
+			check("/"+collection != c.Websocket.Path, "websocket.path", "clashes with GET /%s of the routes", collection)
+		}
+	}
+	if err := c.Log.Validate(); err != nil {
+		errs = append(errs, "log."+err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// LoadRoutes returns the routes of the routes file, the inline ones or the default ones
+func (c *Config) LoadRoutes() (model.Routes, error) {
+	if c.RoutesFile != "" {
+		return model.LoadRoutes(c.RoutesFile)
+	}
+	if len(c.Routes) == 0 {
+		return model.DefaultRoutes, nil
+	}
+	routes := append(model.Routes{}, c.Routes...)
+	return routes, routes.Validate()
+}
+
+// LoadAuth returns the MQTT accounts of the auth file or the inline ones, nil if there is none
+func (c *Config) LoadAuth() (*broker.Auth, error) {
+	if c.MQTT.AuthFile != "" {
+		return broker.LoadAuth(c.MQTT.AuthFile)
+	}
+	if c.MQTT.Auth == nil {
+		return nil, nil
+	}
+	return broker.NewAuth(*c.MQTT.Auth)
+}
+
+// LoadWsACL returns the websocket ACL of the ACL file or the inline one, nil if there is none
+func (c *Config) LoadWsACL() (*utils.WsACL, error) {
+	if c.Websocket.ACLFile != "" {
+		return utils.LoadWsACL(c.Websocket.ACLFile)
+	}
+	if c.Websocket.ACL == nil {
+		return nil, nil
+	}
+	acl := *c.Websocket.ACL
+	return &acl, acl.Validate()
+}
+
+// redacted replaces the secrets in the printed configuration
+const redacted = "xxxxx"
+
+// Print writes the configuration as YAML, without the password of the MongoDB URL,
+// the admin token and the websocket tokens
+func (c *Config) Print(w io.Writer) error {
+	printed := *c
+	if u, err := url.Parse(c.Store.MongoURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			printed.Store.MongoURL = u.String()
+		}
+	}
+	if c.HTTP.AdminToken != "" {
+		printed.HTTP.AdminToken = redacted
+	}
+	if c.Websocket.ACL != nil {
+		acl := *c.Websocket.ACL
+		acl.Tokens = append([]utils.WsToken{}, acl.Tokens...)
+		for i := range acl.Tokens {
+			acl.Tokens[i].Token = redacted
+		}
+		printed.Websocket.ACL = &acl
+	}
+	content, err := yaml.Marshal(&printed)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
@@ -0,0 +1,215 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pborman/getopt"
+)
+
+const testYAML = `
+http:
+  addr: "file:8080"
+  shutdown_timeout: 5s
+ingest:
+  queue_size: 16
+log:
+  level: warn
+routes:
+  - filter: "site/+/temperature"
+    collection: temperature
+    retention: 720h
+`
+
+const testTOML = `
+[http]
+addr = "file:8080"
+shutdown_timeout = "5s"
+
+[ingest]
+queue_size = 16
+
+[log]
+level = "warn"
+
+[[routes]]
+filter = "site/+/temperature"
+collection = "temperature"
+retention = "720h"
+`
+
+// writeConfig writes the config file and returns its path
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// load parses the flags and loads the configuration with the environment and the file given
+func load(t *testing.T, path string, env map[string]string, flags ...string) (*Config, error) {
+	t.Helper()
+	t.Setenv(EnvConfig, path)
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	return Parse(getopt.New(), append([]string{"mqtt-to-ws"}, flags...)).Load()
+}
+
+func TestLoadLayers(t *testing.T) {
+	yamlFile := writeConfig(t, "config.yaml", testYAML)
+	tests := []struct {
+		name  string
+		path  string
+		env   map[string]string
+		flags []string
+		// HTTP.Addr, Ingest.QueueSize and Log.Level
+		addr  string
+		size  int
+		level string
+	}{
+		{"default", "", nil, nil, "0.0.0.0:8080", 1024, "debug"},
+		{"file", yamlFile, nil, nil, "file:8080", 16, "warn"},
+		{"environment", "", map[string]string{"MQTTWS_HTTP_ADDR": "env:8080"}, nil, "env:8080", 1024, "debug"},
+		{"environment over file", yamlFile,
+			map[string]string{"MQTTWS_HTTP_ADDR": "env:8080", "MQTTWS_INGEST_QUEUE_SIZE": "32"}, nil,
+			"env:8080", 32, "warn"},
+		{"flag", "", nil, []string{"-a", "flag:8080"}, "flag:8080", 1024, "debug"},
+		{"flag over environment", yamlFile,
+			map[string]string{"MQTTWS_HTTP_ADDR": "env:8080", "MQTTWS_INGEST_QUEUE_SIZE": "32"},
+			[]string{"--addr-http", "flag:8080", "--log-level=error"},
+			"flag:8080", 32, "error"},
+		// a flag set to the default still wins
+		{"flag set to the default", yamlFile, map[string]string{"MQTTWS_HTTP_ADDR": "env:8080"},
+			[]string{"-a", "0.0.0.0:8080", "-q", "1024"},
+			"0.0.0.0:8080", 1024, "warn"},
+		{"config flag", "", nil, []string{"-c", yamlFile}, "file:8080", 16, "warn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := load(t, tt.path, tt.env, tt.flags...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.HTTP.Addr != tt.addr || c.Ingest.QueueSize != tt.size || c.Log.Level != tt.level {
+				t.Errorf("got %q, %d, %q, want %q, %d, %q",
+					c.HTTP.Addr, c.Ingest.QueueSize, c.Log.Level, tt.addr, tt.size, tt.level)
+			}
+			// the settings no layer sets keep their default
+			if c.MQTT.Addr != Default().MQTT.Addr {
+				t.Errorf("got the MQTT address %q", c.MQTT.Addr)
+			}
+		})
+	}
+}
+
+func TestLoadReadsAgain(t *testing.T) {
+	path := writeConfig(t, "config.yaml", testYAML)
+	t.Setenv(EnvConfig, path)
+	source := Parse(getopt.New(), []string{"mqtt-to-ws", "-l", "error"})
+	if err := ioutil.WriteFile(path, []byte("http:\n  addr: \"edited:8080\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MQTTWS_INGEST_QUEUE_SIZE", "64")
+	c, err := source.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.Addr != "edited:8080" || c.Ingest.QueueSize != 64 || c.Log.Level != "error" {
+		t.Errorf("got %q, %d, %q", c.HTTP.Addr, c.Ingest.QueueSize, c.Log.Level)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	want := Default()
+	if err := want.loadFile(writeConfig(t, "config.yaml", testYAML)); err != nil {
+		t.Fatal(err)
+	}
+	if want.HTTP.ShutdownTimeout != 5*time.Second || len(want.Routes) != 1 || want.Routes[0].Retention != 720*time.Hour {
+		t.Fatalf("got %+v, %+v from YAML", want.HTTP, want.Routes)
+	}
+	for _, name := range []string{"config.toml", "CONFIG.TOML"} {
+		got := Default()
+		if err := got.loadFile(writeConfig(t, name, testTOML)); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"config.json", `{}`, "unknown config format"},
+		{"config.yaml", "http:\n  port: 8080\n", "field port not found"},
+		{"config.yaml", "http: [", "config.yaml"},
+		{"config.toml", "[http\n", "config.toml"},
+		{"config.toml", "[http]\nport = 8080\n", "field port not found"},
+		{"config.toml", "[http]\nshutdown_timeout = \"soon\"\n", "config.toml"},
+	}
+	for _, tt := range tests {
+		err := Default().loadFile(writeConfig(t, tt.name, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s %q: got %v, want %q", tt.name, tt.content, err, tt.want)
+		}
+	}
+	if err := Default().loadFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: got no error")
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	c := Default()
+	err := c.loadEnv([]string{
+		"PATH=/bin",
+		"MQTTWS_CONFIG=config.yaml",
+		"MQTTWS_HTTP_SHUTDOWN_TIMEOUT=1m",
+		"MQTTWS_STORE_SPOOL_MAX=16",
+		"MQTTWS_LOG_ROTATION_COMPRESS=true",
+		"MQTTWS_HTTP_ADMIN_TOKEN=a=b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HTTP.ShutdownTimeout != time.Minute || c.Store.SpoolMax != 16 || !c.Log.Rotation.Compress || c.HTTP.AdminToken != "a=b" {
+		t.Errorf("got %+v, %+v, %+v", c.HTTP, c.Store, c.Log)
+	}
+
+	tests := []struct {
+		kv, want string
+	}{
+		{"MQTTWS_HTTP_PORT=8080", "MQTTWS_HTTP_PORT: unknown setting"},
+		// the structures are set by the file only
+		{"MQTTWS_ROUTES=a", "MQTTWS_ROUTES: unknown setting"},
+		{"MQTTWS_INGEST_QUEUE_SIZE=abc", `MQTTWS_INGEST_QUEUE_SIZE: invalid integer "abc"`},
+		{"MQTTWS_HTTP_SHUTDOWN_TIMEOUT=10", `MQTTWS_HTTP_SHUTDOWN_TIMEOUT: invalid duration "10"`},
+		{"MQTTWS_STORE_SPOOL_MAX=1.5", `MQTTWS_STORE_SPOOL_MAX: invalid integer "1.5"`},
+		{"MQTTWS_LOG_ROTATION_COMPRESS=maybe", `MQTTWS_LOG_ROTATION_COMPRESS: invalid boolean "maybe"`},
+	}
+	for _, tt := range tests {
+		if err := Default().loadEnv([]string{tt.kv}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.kv, err, tt.want)
+		}
+	}
+
+	// every invalid variable is reported at once
+	err = Default().loadEnv([]string{"MQTTWS_HTTP_PORT=8080", "MQTTWS_INGEST_QUEUE_SIZE=abc"})
+	if err == nil || !strings.Contains(err.Error(), "MQTTWS_HTTP_PORT") || !strings.Contains(err.Error(), "MQTTWS_INGEST_QUEUE_SIZE") {
+		t.Errorf("got %v, want both variables", err)
+	}
+
+	// Load fails on the environment too
+	if _, err = load(t, "", map[string]string{"MQTTWS_INGEST_QUEUE_SIZE": "abc"}); err == nil {
+		t.Error("Load: got no error")
+	}
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/pborman/getopt"
+)
+
+// flag binds a command line option to a field of the configuration
+type flag struct {
+	long  string
+	short rune
+	help  string
+	param string
+	field func(c *Config) interface{}
+}
+
+var flags = []flag{
+	{"addr-http", 'a', "HTTP API address", "addr:port",
+		func(c *Config) interface{} { return &c.HTTP.Addr }},
+	{"addr-mqtt", 'A', "MQTT broker address", "addr:port",
+		func(c *Config) interface{} { return &c.MQTT.Addr }},
+	{"addr-swagger", 's', "Swagger BaseURL -- change this if swagger is not working correctly", "addr:port",
+		func(c *Config) interface{} { return &c.HTTP.SwaggerAddr }},
+	{"mongo-url", 'M',
+		"MongoDB connection URL\nmongodb://[username:password@]host1[:port1][,...hostN[:portN]][/[defaultauthdb][?options]]",
+		"url",
+		func(c *Config) interface{} { return &c.Store.MongoURL }},
+	{"database", 'D', "Database name", "database",
+		func(c *Config) interface{} { return &c.Store.Database }},
+	{"store", 'S', "Storage backend -- 'mongo', 'memory' or 'sqlite:/path/to/file.db'", "store",
+		func(c *Config) interface{} { return &c.Store.Backend }},
+	{"websocket", 'w', "Websocket listening path -- default '/ws'", "path",
+		func(c *Config) interface{} { return &c.Websocket.Path }},
+	{"routes", 'r',
+		"YAML file mapping MQTT topic filters to collections -- default routes 'temperature' and 'humidity'",
+		"file",
+		func(c *Config) interface{} { return &c.RoutesFile }},
+	{"ws-acl", 'W',
+		"YAML file of the websocket tokens and the topics they may publish to -- publishing is disabled by default",
+		"file",
+		func(c *Config) interface{} { return &c.Websocket.ACLFile }},
+	{"mqtt-auth", 'u',
+		"YAML file of the MQTT accounts and their topic ACL -- any client may connect by default",
+		"file",
+		func(c *Config) interface{} { return &c.MQTT.AuthFile }},
+	{"addr-mqtts", 0, "MQTT over TLS address -- disabled by default", "addr:port",
+		func(c *Config) interface{} { return &c.MQTT.TLSAddr }},
+	{"addr-mqtt-ws", 0, "MQTT over websocket address -- disabled by default", "addr:port",
+		func(c *Config) interface{} { return &c.MQTT.WsAddr }},
+	{"addr-mqtt-wss", 0, "MQTT over secure websocket address -- disabled by default", "addr:port",
+		func(c *Config) interface{} { return &c.MQTT.WssAddr }},
+	{"mqtt-ws-path", 0, "MQTT over websocket path -- default '/mqtt'", "path",
+		func(c *Config) interface{} { return &c.MQTT.WsPath }},
+	{"tls-cert", 0, "PEM certificate of the MQTT TLS listeners", "file",
+		func(c *Config) interface{} { return &c.MQTT.TLS.Cert }},
+	{"tls-key", 0, "PEM private key of the MQTT TLS listeners", "file",
+		func(c *Config) interface{} { return &c.MQTT.TLS.Key }},
+	{"tls-ca", 0,
+		"PEM CA of the MQTT client certificates -- clients with a certificate signed by it are authenticated by it and their client ID is the CN",
+		"file",
+		func(c *Config) interface{} { return &c.MQTT.TLS.CA }},
+	{"queue-size", 'q', "Number of messages queued for the websocket hub and for the database", "size",
+		func(c *Config) interface{} { return &c.Ingest.QueueSize }},
+	{"ws-overflow", 0,
+		"What to do when the websocket queue is full -- 'block', 'drop-oldest', 'drop-newest' or 'spill'", "policy",
+		func(c *Config) interface{} { return &c.Ingest.WsOverflow }},
+	{"db-overflow", 0,
+		"What to do when the database queue is full -- 'block', 'drop-oldest', 'drop-newest' or 'spill'", "policy",
+		func(c *Config) interface{} { return &c.Ingest.DBOverflow }},
+	{"spill-dir", 0, "Directory of the files of the 'spill' policy", "dir",
+		func(c *Config) interface{} { return &c.Ingest.SpillDir }},
+	{"spill-max", 0, "Size cap of each spill file in MiB", "MiB",
+		func(c *Config) interface{} { return &c.Ingest.SpillMax }},
+	{"batch-size", 'b', "Number of pending records of a collection written at once", "size",
+		func(c *Config) interface{} { return &c.Store.Batch.Size }},
+	{"batch-interval", 0, "Longest time a record waits before being written", "duration",
+		func(c *Config) interface{} { return &c.Store.Batch.Interval }},
+	{"batch-retries", 0, "Retries of a failed write before its records are spooled", "count",
+		func(c *Config) interface{} { return &c.Store.Batch.Retries }},
+	{"spool-dir", 0,
+		"Directory of the records waiting for the database to be reachable again -- empty to give them up", "dir",
+		func(c *Config) interface{} { return &c.Store.SpoolDir }},
+	{"spool-max", 0, "Size cap of the spool in MiB", "MiB",
+		func(c *Config) interface{} { return &c.Store.SpoolMax }},
+	{"purge-interval", 0, "How often the records older than the retention of their route are deleted", "duration",
+		func(c *Config) interface{} { return &c.Store.PurgeInterval }},
+	{"shutdown-timeout", 0, "Longest time to stop the servers and write the pending records", "duration",
+		func(c *Config) interface{} { return &c.HTTP.ShutdownTimeout }},
+	{"log-level", 'l', "Log level -- 'debug', 'info', 'warn' or 'error'", "level",
+		func(c *Config) interface{} { return &c.Log.Level }},
+	{"log-format", 0, "Log format -- 'console' or 'json'", "format",
+		func(c *Config) interface{} { return &c.Log.Format }},
+	{"log-output", 0, "Where the logs are written -- 'stderr', 'stdout' or a file, which is rotated", "file",
+		func(c *Config) interface{} { return &c.Log.Output }},
+}
+
+// boundFlag is a flag registered in a getopt set
+type boundFlag struct {
+	flag
+	option getopt.Option
+}
+
+// registerFlags adds the flags to set, parsed into c
+func registerFlags(set *getopt.Set, c *Config) []boundFlag {
+	bound := make([]boundFlag, 0, len(flags))
+	for _, f := range flags {
+		var option getopt.Option
+		switch p := f.field(c).(type) {
+		case *string:
+			option = set.StringVarLong(p, f.long, f.short, f.help, f.param)
+		case *int:
+			option = set.IntVarLong(p, f.long, f.short, f.help, f.param)
+		case *int64:
+			option = set.Int64VarLong(p, f.long, f.short, f.help, f.param)
+		case *time.Duration:
+			option = set.DurationVarLong(p, f.long, f.short, f.help, f.param)
+		default:
+			panic("config: unsupported flag type " + reflect.TypeOf(p).String())
+		}
+		bound = append(bound, boundFlag{f, option})
+	}
+	return bound
+}
+
+// applyFlags copies the flags given on the command line from parsed to c
+func applyFlags(bound []boundFlag, parsed, c *Config) {
+	for _, f := range bound {
+		if f.option.Seen() {
+			reflect.ValueOf(f.field(c)).Elem().Set(reflect.ValueOf(f.field(parsed)).Elem())
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pborman/getopt"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix of the environment variables overriding the config file
+const EnvPrefix = "MQTTWS_"
+
+// EnvConfig is the environment variable giving the config file when --config is not set
+const EnvConfig = EnvPrefix + "CONFIG"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Source is where the configuration comes from: the flags, the environment and the config file
+type Source struct {
+	path   string
+	bound  []boundFlag
+	parsed *Config
+}
+
+// Parse parses the command line args into set
+func Parse(set *getopt.Set, args []string) *Source {
+	s := &Source{parsed: Default(), path: os.Getenv(EnvConfig)}
+	s.bound = registerFlags(set, s.parsed)
+	set.StringVarLong(&s.path, "config", 'c',
+		"YAML or TOML config file, overridden by the MQTTWS_* environment variables and by the flags", "file")
+	set.Parse(args)
+	return s
+}
+
+// Load builds the configuration, reading the config file and the environment again.
+// A flag wins over its environment variable, which wins over the config file,
+// which wins over the default.
+// The returned configuration is not validated yet.
+func (s *Source) Load() (*Config, error) {
+	c := Default()
+	if s.path != "" {
+		if err := c.loadFile(s.path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.loadEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	applyFlags(s.bound, s.parsed, c)
+	return c, nil
+}
+
+// loadFile reads the config file, its format is given by its extension
+func (c *Config) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		// converted to YAML so the config only needs the YAML tags
+		var doc map[string]interface{}
+		if _, err = toml.Decode(string(content), &doc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if content, err = yaml.Marshal(doc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: unknown config format, expected .yaml, .yml or .toml", path)
+	}
+	if err = yaml.UnmarshalStrict(content, c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// loadEnv applies the MQTTWS_* variables of environ.
+// Only the scalar settings can be set from the environment.
+func (c *Config) loadEnv(environ []string) error {
+	fields := make(map[string]reflect.Value)
+	envFields(reflect.ValueOf(c).Elem(), EnvPrefix, fields)
+	var errs []string
+	for _, kv := range environ {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || !strings.HasPrefix(kv[:i], EnvPrefix) || kv[:i] == EnvConfig {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		field, ok := fields[name]
+		if !ok {
+			errs = append(errs, name+": unknown setting")
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// envFields maps the environment variable of each scalar field of v to the field
+func envFields(v reflect.Value, prefix string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + strings.ToUpper(key)
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			envFields(field, name+"_", fields)
+		case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			fields[name] = field
+		}
+	}
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Int64:
+		if field.Type() == durationType {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", value)
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+		fallthrough
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", value)
+		}
+		field.SetUint(n)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Reloadable lists the settings applied by a reload, the others need a restart.
+// The files they refer to are read again on every reload.
+var Reloadable = []string{
+	"routes",
+	"routes_file",
+	"mqtt.auth",
+	"mqtt.auth_file",
+	"websocket.acl",
+	"websocket.acl_file",
+	"log.level",
+	"log.levels",
+}
+
+// ReloadReport tells what a reload did
+type ReloadReport struct {
+	// Settings applied while the bridge runs which changed since the previous reload,
+	// including the content of their files
+	Reloaded []string `json:"reloaded"`
+	// Changed settings which only take effect after a restart
+	RestartRequired []string `json:"restart_required"`
+}
+
+// IsReloadable reports whether the setting at key is applied by a reload
+func IsReloadable(key string) bool {
+	for _, r := range Reloadable {
+		if key == r || strings.HasPrefix(key, r+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes lists the keys of the settings which differ between a and b, sorted
+func Changes(a, b *Config) ([]string, error) {
+	ma, err := toMap(a)
+	if err != nil {
+		return nil, err
+	}
+	mb, err := toMap(b)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	diff(ma, mb, "", &keys)
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func toMap(c *Config) (map[interface{}]interface{}, error) {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[interface{}]interface{})
+	return m, yaml.Unmarshal(content, &m)
+}
+
+// diff appends the paths of the leaves which differ between a and b to keys
+func diff(a, b map[interface{}]interface{}, prefix string, keys *[]string) {
+	seen := make(map[interface{}]bool)
+	for _, m := range []map[interface{}]interface{}{a, b} {
+		for k := range m {
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			key := prefix + fmt.Sprint(k)
+			va, vb := a[k], b[k]
+			ma, okA := va.(map[interface{}]interface{})
+			mb, okB := vb.(map[interface{}]interface{})
+			if okA && okB {
+				diff(ma, mb, key+".", keys)
+			} else if !reflect.DeepEqual(va, vb) {
+				*keys = append(*keys, key)
+			}
+		}
+	}
+}
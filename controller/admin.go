@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/crosstyan/mqtt-to-ws/config"
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/crosstyan/mqtt-to-ws/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth rejects the requests without the admin token as "Authorization: Bearer" header.
+// Every request is forbidden if token is empty, the admin endpoints being open to the network otherwise.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden,
+				gin.H{"error": "the admin endpoints are disabled, set http.admin_token to enable them"})
+			return
+		}
+		given := utils.BearerToken(c.GetHeader("Authorization"))
+		if given == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+	}
+}
+
+// HandleReload
+// @Summary      Reload the configuration
+// @Description  read the config file and the environment again and apply the routes, the MQTT accounts and ACL, the websocket tokens and the log level. Nothing is applied if the configuration is invalid. Same as sending SIGHUP.
+// @Tags         Admin
+// @Produce      json
+// @Security     AdminToken
+// @Success      200  {object}  config.ReloadReport
+// @Failure      401  {object}  ErrorMsg
+// @Failure      403  {object}  ErrorMsg
+// @Failure      500  {object}  ErrorMsg
+// @Router       /admin/reload [post]
+func HandleReload(c *gin.Context, reload func() (*config.ReloadReport, error)) {
+	report, err := reload()
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// RetentionRule is the retention of a route
+type RetentionRule struct {
+	Filter string `json:"filter" example:"site1/+/temperature"`
+	// Duration like 720h0m0s, the records are kept forever if omitted
+	Retention string `json:"retention,omitempty" example:"720h0m0s"`
+}
+
+// CollectionInfo tells how much a collection holds and how long its records are kept
+type CollectionInfo struct {
+	model.CollectionStats
+	Retention []RetentionRule `json:"retention"`
+	// The records are expired by a MongoDB TTL index rather than by the purge
+	TTL bool `json:"ttl" example:"false"`
+}
+
+type CollectionsMsg struct {
+	Collections []CollectionInfo `json:"collections"`
+}
+
+// HandleCollections
+// @Summary      List the collections
+// @Description  list every collection of the routing table with its record count, its size in bytes, the timestamp of its oldest record and the retention of its routes. The size is estimated by the SQLite and memory stores.
+// @Tags         Admin
+// @Produce      json
+// @Security     AdminToken
+// @Success      200  {object}  CollectionsMsg
+// @Failure      401  {object}  ErrorMsg
+// @Failure      403  {object}  ErrorMsg
+// @Failure      500  {object}  ErrorMsg
+// @Router       /admin/collections [get]
+func HandleCollections(c *gin.Context, store model.Store, routes model.Routes) {
+	collections := make([]CollectionInfo, 0)
+	for _, collection := range routes.Collections() {
+		stats, err := store.Stats(collection)
+		if err != nil {
+			logger.Error(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		info := CollectionInfo{
+			CollectionStats: stats,
+			Retention:       make([]RetentionRule, 0),
+			TTL:             model.UsesTTL(store, routes, collection),
+		}
+		for _, r := range routes {
+			if r.Collection != collection {
+				continue
+			}
+			rule := RetentionRule{Filter: r.Filter}
+			if r.Retention > 0 {
+				rule.Retention = r.Retention.String()
+			}
+			info.Retention = append(info.Retention, rule)
+		}
+		collections = append(collections, info)
+	}
+	c.JSON(http.StatusOK, CollectionsMsg{Collections: collections})
+}
@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{"no token configured", "", "", http.StatusForbidden},
+		{"no token configured, any header", "", "Bearer ", http.StatusForbidden},
+		{"missing header", "s3cr3t", "", http.StatusUnauthorized},
+		{"wrong token", "s3cr3t", "Bearer guess", http.StatusUnauthorized},
+		{"bearer token", "s3cr3t", "Bearer s3cr3t", http.StatusOK},
+		{"lowercase scheme", "s3cr3t", "bearer s3cr3t", http.StatusOK},
+		{"uppercase scheme", "s3cr3t", "BEARER s3cr3t", http.StatusOK},
+		{"token without scheme", "s3cr3t", "s3cr3t", http.StatusUnauthorized},
+		{"basic scheme", "s3cr3t", "Basic s3cr3t", http.StatusUnauthorized},
+		{"empty bearer", "s3cr3t", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := gin.New()
+		r.POST("/admin/reload", AdminAuth(tt.token), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		req := httptest.NewRequest("POST", "/admin/reload", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
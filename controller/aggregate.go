@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/gin-gonic/gin"
+)
+
+// AggregateRequest holds the query string of the aggregation route
+type AggregateRequest struct {
+	// Time RFC3339
+	Start string `form:"start" binding:"required" example:"2020-01-01T00:00:00Z"`
+	// Time RFC3339, default now
+	End string `form:"end" example:"2020-01-02T00:00:00Z"`
+	// Duration of a bucket, e.g. 1m, 1h or 1d
+	Bucket string `form:"bucket" binding:"required" example:"1h"`
+	// Comma separated functions, default avg
+	Functions string `form:"functions" example:"min,max,avg"`
+	// Aggregate this field of the records instead of their payload
+	Field    string `form:"field" example:"t"`
+	ClientID string `form:"client_id" example:"sensor-01"`
+	Username string `form:"username" example:"sensor"`
+	QoS      *uint8 `form:"qos" example:"1"`
+	// Timestamp to filter and bucket on, received_at (default) or measured_at
+	Time string `form:"time" example:"measured_at"`
+}
+
+// Query converts the request to a validated model.AggregateQuery
+func (r *AggregateRequest) Query() (model.AggregateQuery, error) {
+	var err error
+	q := model.AggregateQuery{
+		End:   time.Now(),
+		Field: r.Field,
+		Filter: model.RecordFilter{
+			ClientID: r.ClientID,
+			Username: r.Username,
+			QoS:      r.QoS,
+		},
+	}
+	if q.Time, err = model.ParseTimeField(r.Time); err != nil {
+		return q, err
+	}
+	if q.Start, err = time.Parse(time.RFC3339, r.Start); err != nil {
+		return q, err
+	}
+	if r.End != "" {
+		if q.End, err = time.Parse(time.RFC3339, r.End); err != nil {
+			return q, err
+		}
+	}
+	if q.Bucket, err = model.ParseBucket(r.Bucket); err != nil {
+		return q, err
+	}
+	functions := r.Functions
+	if functions == "" {
+		functions = model.AggAvg
+	}
+	if q.Funcs, err = model.ParseAggregateFuncs(functions); err != nil {
+		return q, err
+	}
+	return q, q.Validate()
+}
+
+type AggregateMsg struct {
+	Buckets []model.Bucket `json:"buckets"`
+}
+
+// HandleTopicAggregate
+// @Summary      Aggregate Records of a Topic
+// @Description  aggregate the records of a persisted topic over time buckets, one row per bucket holding records.
+// @Description  The buckets are aligned on the Unix epoch, e.g. 1d buckets start at midnight UTC, and a range spans at most 10000 buckets.
+// @Description  stddev is the population standard deviation.
+// @Tags         Topics
+// @Produce      json
+// @Param        topic path string true "Topic name"
+// @Param        start query string true "Time RFC3339"
+// @Param        end query string false "Time RFC3339, default now"
+// @Param        bucket query string true "Duration of a bucket, e.g. 1m, 1h or 1d"
+// @Param        functions query string false "Comma separated min, max, avg, sum, count, first, last or stddev, default avg"
+// @Param        field query string false "Aggregate this field of the records instead of their payload"
+// @Param        client_id query string false "Only aggregate records published by this client"
+// @Param        username query string false "Only aggregate records published by this user"
+// @Param        qos query int false "Only aggregate records published with this QoS"
+// @Param        time query string false "Timestamp to filter and bucket on, received_at (default) or measured_at"
+// @Success      200  {object}  AggregateMsg
+// @Failure      400  {object}  ErrorMsg
+// @Failure      404  {object}  ErrorMsg
+// @Failure      500  {object}  ErrorMsg
+// @Router       /topics/{topic}/aggregate [get]
+func HandleTopicAggregate(c *gin.Context, store model.Store, routes model.Routes) {
+	name, collection, ok := topicCollection(c, routes, "/aggregate")
+	if !ok {
+		return
+	}
+	var request AggregateRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q, err := request.Query()
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Filter.Topic = name
+	buckets, err := store.Aggregate(collection, q)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"buckets": buckets})
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -9,10 +10,9 @@ import (
 	l "github.com/crosstyan/mqtt-to-ws/logger"
 	"github.com/crosstyan/mqtt-to-ws/model"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var logger = l.Lsugar
+var logger = l.For(l.HTTP)
 
 // Chain33Info
 // Optional
@@ -21,15 +21,119 @@ type Chain33Info struct {
 	Url     string `json:"url" example:"http://127.0.0.1:8801"`
 }
 
+// DateRangeRequest is the body of the POST query routes.
+// The form tags are used by the GET routes which take the same parameters from the query string.
 type DateRangeRequest struct {
 	// Page is from 1 to infinity
-	Page *int64 `json:"page,omitempty" example:"1"`
+	Page *int64 `json:"page,omitempty" form:"page" example:"1"`
 	// Time RFC3339
-	Start *string `json:"start" example:"2020-01-01T00:00:00Z" validate:"required"`
+	Start *string `json:"start" form:"start" example:"2020-01-01T00:00:00Z" validate:"required"`
 	// Time RFC3339
-	End       *string      `json:"end,omitempty" example:"2022-01-01T00:00:00Z"`
-	Info      *Chain33Info `json:"chain,omitempty"`
-	IsDescend *bool        `json:"descend,omitempty" example:"true"`
+	End       *string      `json:"end,omitempty" form:"end" example:"2022-01-01T00:00:00Z"`
+	Info      *Chain33Info `json:"chain,omitempty" form:"-"`
+	IsDescend *bool        `json:"descend,omitempty" form:"descend" example:"true"`
+	// Only return records published by this client
+	ClientID *string `json:"client_id,omitempty" form:"client_id" example:"sensor-01"`
+	// Only return records published by this user
+	Username *string `json:"username,omitempty" form:"username" example:"sensor"`
+	// Only return records published with this QoS
+	QoS *uint8 `json:"qos,omitempty" form:"qos" example:"1"`
+	// Records per page, from 1 to 1000, default 10
+	Limit *int64 `json:"limit,omitempty" form:"limit" example:"100"`
+	// next_cursor of the previous page, can't be used with page
+	Cursor *string `json:"cursor,omitempty" form:"cursor" example:"FsfV2Ju3AABh0KPI5LDyobLD1OU"`
+	// Timestamp to filter and sort on, received_at (default) or measured_at
+	Time *string `json:"time,omitempty" form:"time" example:"measured_at"`
+}
+
+// Filter extracts the device related conditions of the request
+func (r *DateRangeRequest) Filter() model.RecordFilter {
+	f := model.RecordFilter{QoS: r.QoS}
+	if r.ClientID != nil {
+		f.ClientID = *r.ClientID
+	}
+	if r.Username != nil {
+		f.Username = *r.Username
+	}
+	return f
+}
+
+// Query converts the request to a model.Query.
+// Missing Page defaults to 1 and missing IsDescend defaults to true.
+func (r *DateRangeRequest) Query() (model.Query, error) {
+	var err error
+	q := model.Query{
+		Page: 1,
+		// default descending
+		IsDescend: true,
+		Filter:    r.Filter(),
+	}
+	if r.Page != nil && *r.Page > 0 {
+		q.Page = *r.Page
+	}
+	if err = paginate(&q, r.Limit, r.Cursor, r.Page != nil); err != nil {
+		return q, err
+	}
+	if r.IsDescend != nil {
+		q.IsDescend = *r.IsDescend
+	}
+	if r.Time != nil {
+		if q.Time, err = model.ParseTimeField(*r.Time); err != nil {
+			return q, err
+		}
+	}
+	if r.Start != nil {
+		q.Start, err = time.Parse(time.RFC3339, *r.Start)
+		if err != nil {
+			return q, err
+		}
+	}
+	if r.End != nil {
+		q.End, err = time.Parse(time.RFC3339, *r.End)
+		if err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// paginate sets the limit and the cursor of the query.
+// The cursor replaces the page, so they can't be both given.
+func paginate(q *model.Query, limit *int64, cursor *string, hasPage bool) error {
+	if limit != nil {
+		if *limit < 1 || *limit > model.MaxLimit {
+			return fmt.Errorf("limit must be from 1 to %d", model.MaxLimit)
+		}
+		q.Limit = *limit
+	}
+	if cursor != nil && *cursor != "" {
+		if hasPage {
+			return fmt.Errorf("page and cursor can't be used together")
+		}
+		after, err := model.ParseCursor(*cursor)
+		if err != nil {
+			return err
+		}
+		q.After = after
+	}
+	return nil
+}
+
+// respondRecords responds with the records of the query on the collection and the cursor of the next page
+func respondRecords(c *gin.Context, store model.Store, collection string, records []model.MQTTRecord, q model.Query) {
+	next, err := model.NextCursor(store, collection, records, q)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if records == nil {
+		// a trick to return empty array
+		// https://stackoverflow.com/questions/56200925/return-an-empty-array-instead-of-null-with-golang-for-json-return-with-gin
+		records = make([]model.MQTTRecord, 0)
+	}
+	// RFC3339 is the format of "timestamp"
+	c.JSON(http.StatusOK, ResponseMsg{Records: records, NextCursor: next})
 }
 
 type ErrorMsg struct {
@@ -39,11 +143,13 @@ type ErrorMsg struct {
 
 type ResponseMsg struct {
 	Records []model.MQTTRecord `json:"records"`
+	// Cursor of the next page, omitted on the last page
+	NextCursor string `json:"next_cursor,omitempty" example:"FsfV2Ju3AABh0KPI5LDyobLD1OU"`
 }
 
 // HandleQuery
 // @Summary      Get Temperature/Humidity Records by Date
-// @Description  get Temperature/Humidity by date
+// @Description  get records by date. Every collection in the routing table has such a route.
 // @Tags         MQTTRecords
 // @Produce      json
 // @Param        data body DateRangeRequest true "Request Body"
@@ -52,7 +158,7 @@ type ResponseMsg struct {
 // @Failure      500  {object}  ErrorMsg
 // @Router       /temperature [post]
 // @Router       /humidity [post]
-func HandleQuery(c *gin.Context, collection string, db *mongo.Database) {
+func HandleQuery(c *gin.Context, collection string, store model.Store) {
 	var dateRequest DateRangeRequest
 	var records []model.MQTTRecord
 	err := c.BindJSON(&dateRequest)
@@ -61,46 +167,21 @@ func HandleQuery(c *gin.Context, collection string, db *mongo.Database) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	var page int64
-	if dateRequest.Page == nil || *dateRequest.Page <= 0 {
-		page = 1
-	} else {
-		page = *dateRequest.Page
-	}
-	var tEnd time.Time
-	var tStart time.Time
-	// default descending
-	var isDescend bool = true
-	if dateRequest.IsDescend != nil {
-		isDescend = *dateRequest.IsDescend
+	if dateRequest.Start == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "start is required"})
+		return
 	}
-	tStart, err = time.Parse(time.RFC3339, *dateRequest.Start)
+	q, err := dateRequest.Query()
 	if err != nil {
 		logger.Error(err)
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// TODO: Refactor this part
-	if dateRequest.End != nil {
-		tEnd, err = time.Parse(time.RFC3339, *dateRequest.End)
-		if err != nil {
-			logger.Error(err)
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		records, err = model.GetRecordsBetween(db, collection, tStart, tEnd, page, isDescend)
-		if err != nil {
-			logger.Error(err)
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-	} else {
-		records, err = model.GetRecordsFrom(db, collection, tStart, page, isDescend)
-		if err != nil {
-			logger.Error(err)
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
+	records, err = store.GetRecords(collection, q)
+	if err != nil {
+		logger.Error(err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 	if dateRequest.Info != nil && records != nil {
 		content, err := json.Marshal(records)
@@ -114,26 +195,27 @@ func HandleQuery(c *gin.Context, collection string, db *mongo.Database) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		}
 	}
-	if records == nil {
-		var empty = make([]string, 0)
-		c.JSON(http.StatusOK, gin.H{"records": empty})
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"records": records})
+	respondRecords(c, store, collection, records, q)
 }
 
 // HandleQueryByPage
 // @Summary      Get Temperature/Humidity Records by Page
-// @Description  get Temperature/Humidity by page
+// @Description  get records by page. Every collection in the routing table has such a route.
 // @Tags         MQTTRecords
 // @Produce      json
 // @Param        page query int false "From 1 to infinity"
+// @Param        limit query int false "Records per page, from 1 to 1000, default 10"
+// @Param        cursor query string false "next_cursor of the previous page, can't be used with page"
+// @Param        client_id query string false "Only return records published by this client"
+// @Param        username query string false "Only return records published by this user"
+// @Param        qos query int false "Only return records published with this QoS"
+// @Param        time query string false "Timestamp to sort on, received_at (default) or measured_at"
 // @Success      200  {object}  ResponseMsg
 // @Failure      400  {object}  ErrorMsg
 // @Failure      500  {object}  ErrorMsg
 // @Router       /temperature [get]
 // @Router       /humidity [get]
-func HandleQueryByPage(c *gin.Context, collection string, db *mongo.Database) {
+func HandleQueryByPage(c *gin.Context, collection string, store model.Store) {
 	pageUnparsed := c.DefaultQuery("page", "1")
 	page, err := strconv.Atoi(pageUnparsed)
 	if err != nil {
@@ -141,19 +223,48 @@ func HandleQueryByPage(c *gin.Context, collection string, db *mongo.Database) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	records, err := model.GetRecordsByPage(db, collection, int64(page))
-	if err != nil {
+	f := model.RecordFilter{
+		ClientID: c.Query("client_id"),
+		Username: c.Query("username"),
+	}
+	if qosUnparsed, ok := c.GetQuery("qos"); ok {
+		qos, err := strconv.ParseUint(qosUnparsed, 10, 8)
+		if err != nil {
+			logger.Error(err.Error())
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		q := uint8(qos)
+		f.QoS = &q
+	}
+	q := model.PageQuery(int64(page), f)
+	if q.Time, err = model.ParseTimeField(c.Query("time")); err != nil {
 		logger.Error(err.Error())
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if records == nil {
-		// a trick to return empty array
-		// https://stackoverflow.com/questions/56200925/return-an-empty-array-instead-of-null-with-golang-for-json-return-with-gin
-		var empty = make([]string, 0)
-		c.JSON(http.StatusOK, gin.H{"records": empty})
+	var limit *int64
+	if limitUnparsed, ok := c.GetQuery("limit"); ok {
+		n, err := strconv.ParseInt(limitUnparsed, 10, 64)
+		if err != nil {
+			logger.Error(err.Error())
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		limit = &n
+	}
+	cursor := c.Query("cursor")
+	_, hasPage := c.GetQuery("page")
+	if err = paginate(&q, limit, &cursor, hasPage); err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// RFC3339 is the format of "timestamp"
-	c.JSON(http.StatusOK, gin.H{"records": records})
+	records, err := store.GetRecords(collection, q)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondRecords(c, store, collection, records, q)
 }
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/crosstyan/mqtt-to-ws/export"
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/gin-gonic/gin"
+)
+
+// exportErrorTrailer tells the client the export failed after the response started
+const exportErrorTrailer = "X-Export-Error"
+
+// ExportRequest holds the query string of the export route
+type ExportRequest struct {
+	// Time RFC3339
+	Start string `form:"start" binding:"required" example:"2022-01-01T00:00:00Z"`
+	// Time RFC3339, default now
+	End string `form:"end" example:"2022-02-01T00:00:00Z"`
+	// csv, ndjson or parquet, chosen by the Accept header if omitted, default csv
+	Format string `form:"format" example:"csv"`
+	// Compress the file with gzip
+	Gzip     bool   `form:"gzip" example:"true"`
+	ClientID string `form:"client_id" example:"sensor-01"`
+	Username string `form:"username" example:"sensor"`
+	QoS      *uint8 `form:"qos" example:"1"`
+	// Timestamp to filter and sort on, received_at (default) or measured_at
+	Time string `form:"time" example:"measured_at"`
+}
+
+// Query converts the request to a model.Query
+func (r *ExportRequest) Query() (model.Query, error) {
+	var err error
+	q := model.Query{
+		End: time.Now(),
+		Filter: model.RecordFilter{
+			ClientID: r.ClientID,
+			Username: r.Username,
+			QoS:      r.QoS,
+		},
+	}
+	if q.Time, err = model.ParseTimeField(r.Time); err != nil {
+		return q, err
+	}
+	if q.Start, err = time.Parse(time.RFC3339, r.Start); err != nil {
+		return q, err
+	}
+	if r.End != "" {
+		if q.End, err = time.Parse(time.RFC3339, r.End); err != nil {
+			return q, err
+		}
+	}
+	return q, nil
+}
+
+// HandleTopicExport
+// @Summary      Export Records of a Topic
+// @Description  stream every record of a persisted topic in a time range, by ascending timestamp (received_at, or measured_at if chosen), as a CSV, NDJSON or Parquet file.
+// @Description  The format is given by the format parameter, else by the Accept header (text/csv, application/x-ndjson or application/vnd.apache.parquet), else it's CSV.
+// @Description  If the export fails once the file has started, the response is cut short and its X-Export-Error trailer holds the error.
+// @Tags         Topics
+// @Produce      text/csv
+// @Produce      application/x-ndjson
+// @Produce      application/vnd.apache.parquet
+// @Produce      application/gzip
+// @Param        topic path string true "Topic name"
+// @Param        start query string true "Time RFC3339"
+// @Param        end query string false "Time RFC3339, default now"
+// @Param        format query string false "csv, ndjson or parquet"
+// @Param        gzip query bool false "Compress the file with gzip"
+// @Param        client_id query string false "Only export records published by this client"
+// @Param        username query string false "Only export records published by this user"
+// @Param        qos query int false "Only export records published with this QoS"
+// @Param        time query string false "Timestamp to filter and sort on, received_at (default) or measured_at"
+// @Success      200  {file}    file
+// @Failure      400  {object}  ErrorMsg
+// @Failure      404  {object}  ErrorMsg
+// @Failure      406  {object}  ErrorMsg
+// @Router       /topics/{topic}/export [get]
+func HandleTopicExport(c *gin.Context, store model.Store, routes model.Routes) {
+	name, collection, ok := topicCollection(c, routes, "/export")
+	if !ok {
+		return
+	}
+	var request ExportRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q, err := request.Query()
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Filter.Topic = name
+	format := export.CSV
+	if request.Format != "" {
+		if format, err = export.ParseFormat(request.Format); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else if accept := c.GetHeader("Accept"); accept != "" && !strings.Contains(accept, "*/*") {
+		if format, ok = export.FromAccept(accept); !ok {
+			c.AbortWithStatusJSON(http.StatusNotAcceptable,
+				gin.H{"error": "expect text/csv, application/x-ndjson or application/vnd.apache.parquet"})
+			return
+		}
+	}
+
+	filename := strings.ReplaceAll(name, "/", "_") + export.Extension(format)
+	contentType := export.ContentType(format)
+	if request.Gzip {
+		filename += ".gz"
+		contentType = "application/gzip"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Trailer", exportErrorTrailer)
+	c.Status(http.StatusOK)
+	w, err := export.NewWriter(format, c.Writer, request.Gzip)
+	if err == nil {
+		err = store.StreamRecords(c.Request.Context(), collection, q, w.Write)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.Errorf("export of %s: %v", name, err)
+		c.Writer.Header().Set(exportErrorTrailer, err.Error())
+	}
+}
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/crosstyan/mqtt-to-ws/health"
+	"github.com/gin-gonic/gin"
+)
+
+type HealthMsg struct {
+	Status string `json:"status" example:"ok"`
+	// Seconds since the bridge started
+	Uptime float64 `json:"uptime_s" example:"3600"`
+}
+
+// HandleHealthz
+// @Summary      Liveness probe
+// @Description  answers as long as the process serves HTTP requests
+// @Tags         Health
+// @Produce      json
+// @Success      200  {object}  HealthMsg
+// @Router       /healthz [get]
+func HandleHealthz(c *gin.Context, started time.Time) {
+	c.JSON(http.StatusOK, HealthMsg{Status: health.StatusOK, Uptime: time.Since(started).Seconds()})
+}
+
+// HandleReadyz
+// @Summary      Readiness probe
+// @Description  checks the MQTT listener, the store, the websocket hub and the ingest queues. The status is 503 if any of them fails.
+// @Tags         Health
+// @Produce      json
+// @Success      200  {object}  health.Report
+// @Failure      503  {object}  health.Report
+// @Router       /readyz [get]
+func HandleReadyz(c *gin.Context, checker *health.Checker) {
+	report := checker.Run(c.Request.Context())
+	if report.Status != health.StatusOK {
+		logger.Warnf("not ready: %+v", report.Components)
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/gin-gonic/gin"
+)
+
+// ImportRequest holds the query string of the import route
+type ImportRequest struct {
+	// csv or ndjson, chosen by the Content-Type header if omitted
+	Format string `form:"format" example:"csv"`
+	// The body is compressed with gzip, default when the Content-Encoding header is gzip
+	Gzip bool `form:"gzip" example:"true"`
+}
+
+// importFormats are the formats of the imported bodies by content type
+var importFormats = map[string]string{
+	"text/csv":             model.ImportCSV,
+	"application/x-ndjson": model.ImportNDJSON,
+	"application/jsonl":    model.ImportNDJSON,
+}
+
+// HandleTopicImport
+// @Summary      Import Records of a Topic
+// @Description  write the rows of a CSV or NDJSON file to the collection of a persisted topic, with their own timestamps.
+// @Description  The CSV file has a header naming its columns: timestamp (required), payload, fields, client_id (or device), username, qos, retain, packet_id, measured_at, topic and id, as written by the export. The NDJSON rows have the same keys.
+// @Description  timestamp and measured_at are RFC3339 times, Unix seconds or milliseconds, measured_at is optional. The payload may be omitted if the row has fields. The topic, if given, must be the imported topic, and the id is ignored.
+// @Description  A row is stored once by (topic, timestamp, client_id), so importing a file again changes nothing. The invalid rows are skipped and reported.
+// @Tags         Topics
+// @Accept       text/csv
+// @Accept       application/x-ndjson
+// @Produce      json
+// @Security     AdminToken
+// @Param        topic path string true "Topic name"
+// @Param        format query string false "csv or ndjson"
+// @Param        gzip query bool false "The body is compressed with gzip"
+// @Success      200  {object}  model.ImportReport
+// @Failure      400  {object}  ErrorMsg
+// @Failure      401  {object}  ErrorMsg
+// @Failure      403  {object}  ErrorMsg
+// @Failure      404  {object}  ErrorMsg
+// @Failure      415  {object}  ErrorMsg
+// @Failure      500  {object}  ErrorMsg
+// @Router       /topics/{topic}/import [post]
+func HandleTopicImport(c *gin.Context, store model.Store, routes model.Routes) {
+	name, collection, ok := topicCollection(c, routes, "/import")
+	if !ok {
+		return
+	}
+	var request ImportRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var format string
+	var err error
+	if request.Format != "" {
+		if format, err = model.ParseImportFormat(request.Format); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if format, ok = importFormats[contentType]; !ok {
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType,
+				gin.H{"error": "expect text/csv or application/x-ndjson, or the format parameter"})
+			return
+		}
+	}
+
+	var body io.Reader = c.Request.Body
+	if request.Gzip || strings.EqualFold(c.GetHeader("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "gzip: " + err.Error()})
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	report, err := model.Import(store, collection, name, format, body)
+	var fileErr *model.FileError
+	if errors.As(err, &fileErr) {
+		logger.Errorf("import of %s: %v", name, err)
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		logger.Errorf("import of %s: %v", name, err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Infof("imported %d records of %s, %d rejected", report.Accepted, name, report.Rejected)
+	c.JSON(http.StatusOK, report)
+}
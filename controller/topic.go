@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/gin-gonic/gin"
+)
+
+type TopicsMsg struct {
+	Topics []model.TopicInfo `json:"topics"`
+}
+
+// HandleTopics
+// @Summary      List persisted topics
+// @Description  list every persisted topic with its record count and the timestamps of its first and last record
+// @Tags         Topics
+// @Produce      json
+// @Success      200  {object}  TopicsMsg
+// @Failure      500  {object}  ErrorMsg
+// @Router       /topics [get]
+func HandleTopics(c *gin.Context, store model.Store, routes model.Routes) {
+	topics := make([]model.TopicInfo, 0)
+	for _, collection := range routes.Collections() {
+		infos, err := store.GetTopics(collection)
+		if err != nil {
+			logger.Error(err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		topics = append(topics, infos...)
+	}
+	c.JSON(http.StatusOK, gin.H{"topics": topics})
+}
+
+// HandleTopicRecords
+// @Summary      Get Records of a Topic
+// @Description  get records of any persisted topic. The topic may span several levels, e.g. /topics/site1/room3/temp/records
+// @Tags         Topics
+// @Produce      json
+// @Param        topic path string true "Topic name"
+// @Param        page query int false "From 1 to infinity"
+// @Param        limit query int false "Records per page, from 1 to 1000, default 10"
+// @Param        cursor query string false "next_cursor of the previous page, can't be used with page"
+// @Param        start query string false "Time RFC3339"
+// @Param        end query string false "Time RFC3339"
+// @Param        descend query bool false "Sort by descending timestamp, default true"
+// @Param        client_id query string false "Only return records published by this client"
+// @Param        username query string false "Only return records published by this user"
+// @Param        qos query int false "Only return records published with this QoS"
+// @Param        time query string false "Timestamp to filter and sort on, received_at (default) or measured_at"
+// @Success      200  {object}  ResponseMsg
+// @Failure      400  {object}  ErrorMsg
+// @Failure      404  {object}  ErrorMsg
+// @Failure      500  {object}  ErrorMsg
+// @Router       /topics/{topic}/records [get]
+func HandleTopicRecords(c *gin.Context, store model.Store, routes model.Routes) {
+	name, collection, ok := topicCollection(c, routes, "/records")
+	if !ok {
+		return
+	}
+	var dateRequest DateRangeRequest
+	if err := c.ShouldBindQuery(&dateRequest); err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q, err := dateRequest.Query()
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	q.Filter.Topic = name
+	records, err := store.GetRecords(collection, q)
+	if err != nil {
+		logger.Error(err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondRecords(c, store, collection, records, q)
+}
+
+// topicCollection returns the topic of a /topics/{topic}/<suffix> path and its collection.
+// It aborts with 404 if the path doesn't end with suffix or the topic is not persisted.
+func topicCollection(c *gin.Context, routes model.Routes, suffix string) (string, string, bool) {
+	// gin can't match a wildcard in the middle of a path
+	// so the route is /topics/*path and the suffix is stripped here
+	path := strings.TrimPrefix(c.Param("path"), "/")
+	name := strings.TrimSuffix(path, suffix)
+	if name == path || name == "" {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "expect /topics/{topic}" + suffix})
+		return "", "", false
+	}
+	collection, ok := routes.Collection(name)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "topic " + name + " is not persisted"})
+		return "", "", false
+	}
+	return name, collection, true
+}
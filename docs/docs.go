@@ -32,9 +32,115 @@ var doc = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/collections": {
+            "get": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "list every collection of the routing table with its record count, its size in bytes, the timestamp of its oldest record and the retention of its routes. The size is estimated by the SQLite and memory stores.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "List the collections",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/controller.CollectionsMsg"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/reload": {
+            "post": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "read the config file and the environment again and apply the routes, the MQTT accounts and ACL, the websocket tokens and the log level. Nothing is applied if the configuration is invalid. Same as sending SIGHUP.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Admin"
+                ],
+                "summary": "Reload the configuration",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/config.ReloadReport"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "answers as long as the process serves HTTP requests",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Health"
+                ],
+                "summary": "Liveness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/controller.HealthMsg"
+                        }
+                    }
+                }
+            }
+        },
         "/humidity": {
             "get": {
-                "description": "get Temperature/Humidity by page",
+                "description": "get records by page. Every collection in the routing table has such a route.",
                 "produces": [
                     "application/json"
                 ],
@@ -48,6 +154,42 @@ var doc = `{
                         "description": "From 1 to infinity",
                         "name": "page",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Records per page, from 1 to 1000, default 10",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor of the previous page, can't be used with page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only return records published by this client",
+                        "name": "client_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only return records published by this user",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only return records published with this QoS",
+                        "name": "qos",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Timestamp to sort on, received_at (default) or measured_at",
+                        "name": "time",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -72,7 +214,7 @@ var doc = `{
                 }
             },
             "post": {
-                "description": "get Temperature/Humidity by date",
+                "description": "get records by date. Every collection in the routing table has such a route.",
                 "produces": [
                     "application/json"
                 ],
@@ -113,9 +255,35 @@ var doc = `{
                 }
             }
         },
+        "/readyz": {
+            "get": {
+                "description": "checks the MQTT listener, the store, the websocket hub and the ingest queues. The status is 503 if any of them fails.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Health"
+                ],
+                "summary": "Readiness probe",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/health.Report"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/health.Report"
+                        }
+                    }
+                }
+            }
+        },
         "/temperature": {
             "get": {
-                "description": "get Temperature/Humidity by page",
+                "description": "get records by page. Every collection in the routing table has such a route.",
                 "produces": [
                     "application/json"
                 ],
@@ -129,6 +297,42 @@ var doc = `{
                         "description": "From 1 to infinity",
                         "name": "page",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Records per page, from 1 to 1000, default 10",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor of the previous page, can't be used with page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only return records published by this client",
+                        "name": "client_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only return records published by this user",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only return records published with this QoS",
+                        "name": "qos",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Timestamp to sort on, received_at (default) or measured_at",
+                        "name": "time",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -153,7 +357,7 @@ var doc = `{
                 }
             },
             "post": {
-                "description": "get Temperature/Humidity by date",
+                "description": "get records by date. Every collection in the routing table has such a route.",
                 "produces": [
                     "application/json"
                 ],
@@ -193,54 +397,580 @@ var doc = `{
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "controller.Chain33Info": {
-            "type": "object",
-            "properties": {
-                "priv_key": {
-                    "type": "string",
-                    "example": "cc38546e9e659d15e6b4893f0ab32a06d103931a8230b0bde71459d2b27d6944"
-                },
-                "url": {
-                    "type": "string",
-                    "example": "http://127.0.0.1:8801"
+        },
+        "/topics": {
+            "get": {
+                "description": "list every persisted topic with its record count and the timestamps of its first and last record",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Topics"
+                ],
+                "summary": "List persisted topics",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/controller.TopicsMsg"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
                 }
             }
         },
-        "controller.DateRangeRequest": {
-            "type": "object",
-            "required": [
-                "start"
-            ],
-            "properties": {
-                "chain": {
-                    "$ref": "#/definitions/controller.Chain33Info"
-                },
-                "descend": {
-                    "type": "boolean",
-                    "example": true
-                },
-                "end": {
-                    "description": "Time RFC3339",
-                    "type": "string",
-                    "example": "2022-01-01T00:00:00Z"
-                },
-                "page": {
-                    "description": "Page is from 1 to infinity",
-                    "type": "integer",
-                    "example": 1
-                },
-                "start": {
-                    "description": "Time RFC3339",
-                    "type": "string",
-                    "example": "2020-01-01T00:00:00Z"
+        "/topics/{topic}/aggregate": {
+            "get": {
+                "description": "aggregate the records of a persisted topic over time buckets, one row per bucket holding records.\nThe buckets are aligned on the Unix epoch, e.g. 1d buckets start at midnight UTC, and a range spans at most 10000 buckets.\nstddev is the population standard deviation.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Topics"
+                ],
+                "summary": "Aggregate Records of a Topic",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Topic name",
+                        "name": "topic",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time RFC3339",
+                        "name": "start",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time RFC3339, default now",
+                        "name": "end",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Duration of a bucket, e.g. 1m, 1h or 1d",
+                        "name": "bucket",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Comma separated min, max, avg, sum, count, first, last or stddev, default avg",
+                        "name": "functions",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Aggregate this field of the records instead of their payload",
+                        "name": "field",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only aggregate records published by this client",
+                        "name": "client_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only aggregate records published by this user",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only aggregate records published with this QoS",
+                        "name": "qos",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Timestamp to filter and bucket on, received_at (default) or measured_at",
+                        "name": "time",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/controller.AggregateMsg"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
                 }
             }
         },
-        "controller.ErrorMsg": {
-            "type": "object",
+        "/topics/{topic}/export": {
+            "get": {
+                "description": "stream every record of a persisted topic in a time range, by ascending timestamp (received_at, or measured_at if chosen), as a CSV, NDJSON or Parquet file.\nThe format is given by the format parameter, else by the Accept header (text/csv, application/x-ndjson or application/vnd.apache.parquet), else it's CSV.\nIf the export fails once the file has started, the response is cut short and its X-Export-Error trailer holds the error.",
+                "produces": [
+                    "text/csv",
+                    "application/x-ndjson",
+                    "application/vnd.apache.parquet",
+                    "application/gzip"
+                ],
+                "tags": [
+                    "Topics"
+                ],
+                "summary": "Export Records of a Topic",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Topic name",
+                        "name": "topic",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time RFC3339",
+                        "name": "start",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time RFC3339, default now",
+                        "name": "end",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "csv, ndjson or parquet",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Compress the file with gzip",
+                        "name": "gzip",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only export records published by this client",
+                        "name": "client_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only export records published by this user",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only export records published with this QoS",
+                        "name": "qos",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Timestamp to filter and sort on, received_at (default) or measured_at",
+                        "name": "time",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "406": {
+                        "description": "Not Acceptable",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
+                }
+            }
+        },
+        "/topics/{topic}/import": {
+            "post": {
+                "security": [
+                    {
+                        "AdminToken": []
+                    }
+                ],
+                "description": "write the rows of a CSV or NDJSON file to the collection of a persisted topic, with their own timestamps.\nThe CSV file has a header naming its columns: timestamp (required), payload, fields, client_id (or device), username, qos, retain, packet_id, measured_at, topic and id, as written by the export. The NDJSON rows have the same keys.\ntimestamp and measured_at are RFC3339 times, Unix seconds or milliseconds, measured_at is optional. The payload may be omitted if the row has fields. The topic, if given, must be the imported topic, and the id is ignored.\nA row is stored once by (topic, timestamp, client_id), so importing a file again changes nothing. The invalid rows are skipped and reported.",
+                "consumes": [
+                    "text/csv",
+                    "application/x-ndjson"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Topics"
+                ],
+                "summary": "Import Records of a Topic",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Topic name",
+                        "name": "topic",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "csv or ndjson",
+                        "name": "format",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "The body is compressed with gzip",
+                        "name": "gzip",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/model.ImportReport"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "415": {
+                        "description": "Unsupported Media Type",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
+                }
+            }
+        },
+        "/topics/{topic}/records": {
+            "get": {
+                "description": "get records of any persisted topic. The topic may span several levels, e.g. /topics/site1/room3/temp/records",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "Topics"
+                ],
+                "summary": "Get Records of a Topic",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Topic name",
+                        "name": "topic",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "From 1 to infinity",
+                        "name": "page",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Records per page, from 1 to 1000, default 10",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor of the previous page, can't be used with page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time RFC3339",
+                        "name": "start",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Time RFC3339",
+                        "name": "end",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "Sort by descending timestamp, default true",
+                        "name": "descend",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only return records published by this client",
+                        "name": "client_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only return records published by this user",
+                        "name": "username",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Only return records published with this QoS",
+                        "name": "qos",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Timestamp to filter and sort on, received_at (default) or measured_at",
+                        "name": "time",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ResponseMsg"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/controller.ErrorMsg"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "config.ReloadReport": {
+            "type": "object",
+            "properties": {
+                "reloaded": {
+                    "description": "Settings applied while the bridge runs which changed since the previous reload,\nincluding the content of their files",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "restart_required": {
+                    "description": "Changed settings which only take effect after a restart",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "controller.AggregateMsg": {
+            "type": "object",
+            "properties": {
+                "buckets": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/model.Bucket"
+                    }
+                }
+            }
+        },
+        "controller.Chain33Info": {
+            "type": "object",
+            "properties": {
+                "priv_key": {
+                    "type": "string",
+                    "example": "cc38546e9e659d15e6b4893f0ab32a06d103931a8230b0bde71459d2b27d6944"
+                },
+                "url": {
+                    "type": "string",
+                    "example": "http://127.0.0.1:8801"
+                }
+            }
+        },
+        "controller.CollectionInfo": {
+            "type": "object",
+            "properties": {
+                "collection": {
+                    "type": "string",
+                    "example": "temperature"
+                },
+                "count": {
+                    "type": "integer",
+                    "example": 86400
+                },
+                "oldest": {
+                    "description": "Timestamp of the oldest record, omitted if there is none. Time RFC3339",
+                    "type": "string",
+                    "example": "2020-01-01T00:00:00Z"
+                },
+                "retention": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/controller.RetentionRule"
+                    }
+                },
+                "size": {
+                    "description": "Size of the records in bytes, estimated by the SQLite and memory stores",
+                    "type": "integer",
+                    "example": 10368000
+                },
+                "ttl": {
+                    "description": "The records are expired by a MongoDB TTL index rather than by the purge",
+                    "type": "boolean",
+                    "example": false
+                }
+            }
+        },
+        "controller.CollectionsMsg": {
+            "type": "object",
+            "properties": {
+                "collections": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/controller.CollectionInfo"
+                    }
+                }
+            }
+        },
+        "controller.DateRangeRequest": {
+            "type": "object",
+            "required": [
+                "start"
+            ],
+            "properties": {
+                "chain": {
+                    "$ref": "#/definitions/controller.Chain33Info"
+                },
+                "client_id": {
+                    "description": "Only return records published by this client",
+                    "type": "string",
+                    "example": "sensor-01"
+                },
+                "cursor": {
+                    "description": "next_cursor of the previous page, can't be used with page",
+                    "type": "string",
+                    "example": "FsfV2Ju3AABh0KPI5LDyobLD1OU"
+                },
+                "descend": {
+                    "type": "boolean",
+                    "example": true
+                },
+                "end": {
+                    "description": "Time RFC3339",
+                    "type": "string",
+                    "example": "2022-01-01T00:00:00Z"
+                },
+                "limit": {
+                    "description": "Records per page, from 1 to 1000, default 10",
+                    "type": "integer",
+                    "example": 100
+                },
+                "page": {
+                    "description": "Page is from 1 to infinity",
+                    "type": "integer",
+                    "example": 1
+                },
+                "qos": {
+                    "description": "Only return records published with this QoS",
+                    "type": "integer",
+                    "example": 1
+                },
+                "start": {
+                    "description": "Time RFC3339",
+                    "type": "string",
+                    "example": "2020-01-01T00:00:00Z"
+                },
+                "time": {
+                    "description": "Timestamp to filter and sort on, received_at (default) or measured_at",
+                    "type": "string",
+                    "example": "measured_at"
+                },
+                "username": {
+                    "description": "Only return records published by this user",
+                    "type": "string",
+                    "example": "sensor"
+                }
+            }
+        },
+        "controller.ErrorMsg": {
+            "type": "object",
             "properties": {
                 "error": {
                     "description": "Error message",
@@ -249,9 +979,28 @@ var doc = `{
                 }
             }
         },
+        "controller.HealthMsg": {
+            "type": "object",
+            "properties": {
+                "status": {
+                    "type": "string",
+                    "example": "ok"
+                },
+                "uptime_s": {
+                    "description": "Seconds since the bridge started",
+                    "type": "number",
+                    "example": 3600
+                }
+            }
+        },
         "controller.ResponseMsg": {
             "type": "object",
             "properties": {
+                "next_cursor": {
+                    "description": "Cursor of the next page, omitted on the last page",
+                    "type": "string",
+                    "example": "FsfV2Ju3AABh0KPI5LDyobLD1OU"
+                },
                 "records": {
                     "type": "array",
                     "items": {
@@ -260,20 +1009,230 @@ var doc = `{
                 }
             }
         },
+        "controller.RetentionRule": {
+            "type": "object",
+            "properties": {
+                "filter": {
+                    "type": "string",
+                    "example": "site1/+/temperature"
+                },
+                "retention": {
+                    "description": "Duration like 720h0m0s, the records are kept forever if omitted",
+                    "type": "string",
+                    "example": "720h0m0s"
+                }
+            }
+        },
+        "controller.TopicsMsg": {
+            "type": "object",
+            "properties": {
+                "topics": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/model.TopicInfo"
+                    }
+                }
+            }
+        },
+        "health.Component": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                },
+                "latency_ms": {
+                    "description": "Duration of the check in milliseconds",
+                    "type": "number",
+                    "example": 0.42
+                },
+                "status": {
+                    "type": "string",
+                    "example": "ok"
+                }
+            }
+        },
+        "health.Report": {
+            "type": "object",
+            "properties": {
+                "components": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "$ref": "#/definitions/health.Component"
+                    }
+                },
+                "status": {
+                    "type": "string",
+                    "example": "ok"
+                }
+            }
+        },
+        "model.Bucket": {
+            "type": "object",
+            "properties": {
+                "avg": {
+                    "type": "number",
+                    "example": 22.8
+                },
+                "count": {
+                    "type": "integer",
+                    "example": 60
+                },
+                "first": {
+                    "type": "number",
+                    "example": 21.5
+                },
+                "last": {
+                    "type": "number",
+                    "example": 24.23
+                },
+                "max": {
+                    "type": "number",
+                    "example": 24.23
+                },
+                "min": {
+                    "type": "number",
+                    "example": 21.5
+                },
+                "start": {
+                    "description": "Start of the bucket. Time RFC3339",
+                    "type": "string",
+                    "example": "2020-01-01T00:00:00Z"
+                },
+                "stddev": {
+                    "type": "number",
+                    "example": 0.7
+                },
+                "sum": {
+                    "type": "number",
+                    "example": 1368
+                }
+            }
+        },
+        "model.ImportReport": {
+            "type": "object",
+            "properties": {
+                "accepted": {
+                    "description": "Valid rows, stored once even if they were imported before",
+                    "type": "integer",
+                    "example": 8759
+                },
+                "errors": {
+                    "description": "The first 100 row errors",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/model.RowError"
+                    }
+                },
+                "rejected": {
+                    "type": "integer",
+                    "example": 1
+                }
+            }
+        },
         "model.MQTTRecord": {
             "type": "object",
             "properties": {
+                "client_id": {
+                    "type": "string",
+                    "example": "sensor-01"
+                },
+                "fields": {
+                    "description": "Named values of structured payloads, see PayloadConfig",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "number"
+                    }
+                },
+                "id": {
+                    "description": "ID identifies the record, writing a record twice doesn't duplicate it",
+                    "type": "string",
+                    "example": "61d0a3c8e4b0f2a1b2c3d4e5"
+                },
+                "measured_at": {
+                    "description": "Time the device measured the reading, if its route tells where to find it. Time RFC3339",
+                    "type": "string",
+                    "example": "2019-12-31T23:59:58Z"
+                },
+                "packet_id": {
+                    "type": "integer",
+                    "example": 1
+                },
                 "payload": {
                     "type": "number",
                     "example": 24.23
                 },
+                "qos": {
+                    "type": "integer",
+                    "example": 1
+                },
+                "retain": {
+                    "type": "boolean",
+                    "example": false
+                },
                 "timestamp": {
-                    "description": "Time RFC3339",
+                    "description": "Time the bridge received the message (received_at). Time RFC3339",
+                    "type": "string",
+                    "example": "2020-01-01T00:00:00Z"
+                },
+                "topic": {
+                    "description": "Topic is empty for records persisted before topic routing,\nthey were always stored in the collection named after their topic",
+                    "type": "string",
+                    "example": "site1/room3/temperature"
+                },
+                "username": {
+                    "type": "string",
+                    "example": "sensor"
+                }
+            }
+        },
+        "model.RowError": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string",
+                    "example": "timestamp: missing"
+                },
+                "line": {
+                    "description": "Line of the row in the file, from 1",
+                    "type": "integer",
+                    "example": 42
+                }
+            }
+        },
+        "model.TopicInfo": {
+            "type": "object",
+            "properties": {
+                "collection": {
+                    "type": "string",
+                    "example": "temperature"
+                },
+                "count": {
+                    "type": "integer",
+                    "example": 42
+                },
+                "first": {
+                    "description": "Timestamp of the oldest record. Time RFC3339",
                     "type": "string",
                     "example": "2020-01-01T00:00:00Z"
+                },
+                "last": {
+                    "description": "Timestamp of the latest record. Time RFC3339",
+                    "type": "string",
+                    "example": "2022-01-01T00:00:00Z"
+                },
+                "topic": {
+                    "type": "string",
+                    "example": "site1/room3/temperature"
                 }
             }
         }
+    },
+    "securityDefinitions": {
+        "AdminToken": {
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
+        }
     }
 }`
 
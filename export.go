@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/crosstyan/mqtt-to-ws/config"
+	ctrl "github.com/crosstyan/mqtt-to-ws/controller"
+	"github.com/crosstyan/mqtt-to-ws/export"
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/pborman/getopt"
+)
+
+// runExport writes the records of a topic to a file, args are the ones following the global options:
+// export [options] topic file
+func runExport(cfg *config.Config, args []string) error {
+	set := getopt.New()
+	set.SetProgram(filepath.Base(os.Args[0]) + " [options] export")
+	set.SetParameters("topic file")
+	var request ctrl.ExportRequest
+	var qos string
+	set.StringVarLong(&request.Start, "start", 0, "Time RFC3339 of the first record -- required", "time")
+	set.StringVarLong(&request.End, "end", 0, "Time RFC3339 of the last record -- default now", "time")
+	set.StringVarLong(&request.Format, "format", 'f',
+		"'csv', 'ndjson' or 'parquet' -- default from the extension of the file, 'csv' for '-'", "format")
+	set.BoolVarLong(&request.Gzip, "gzip", 'z', "Compress the file with gzip -- default when the file ends with .gz")
+	set.StringVarLong(&request.ClientID, "client-id", 0, "Only export records published by this client", "id")
+	set.StringVarLong(&request.Username, "username", 0, "Only export records published by this user", "user")
+	set.StringVarLong(&qos, "qos", 0, "Only export records published with this QoS", "qos")
+	set.StringVarLong(&request.Time, "time", 0,
+		"Timestamp to filter and sort on, 'received_at' or 'measured_at' -- default received_at", "time")
+	set.Parse(args)
+	if set.NArgs() != 2 || request.Start == "" {
+		set.PrintUsage(os.Stderr)
+		return fmt.Errorf("export needs --start, a topic and a file, '-' for stdout")
+	}
+	name, path := set.Arg(0), set.Arg(1)
+	if qos != "" {
+		n, err := strconv.ParseUint(qos, 10, 8)
+		if err != nil {
+			return fmt.Errorf("--qos: %w", err)
+		}
+		q := uint8(n)
+		request.QoS = &q
+	}
+	q, err := request.Query()
+	if err != nil {
+		return err
+	}
+	q.Filter.Topic = name
+	format, compress := export.CSV, request.Gzip
+	if path != "-" {
+		fileFormat, gzipped, err := export.FromFile(path)
+		if err != nil && request.Format == "" {
+			return err
+		}
+		format, compress = fileFormat, compress || gzipped
+	}
+	if request.Format != "" {
+		if format, err = export.ParseFormat(request.Format); err != nil {
+			return err
+		}
+	}
+
+	routes, err := cfg.LoadRoutes()
+	if err != nil {
+		return err
+	}
+	collection, ok := routes.Collection(name)
+	if !ok {
+		return fmt.Errorf("topic %s is not persisted", name)
+	}
+	store, err := model.OpenStore(cfg.Store.Backend, cfg.Store.MongoURL, cfg.Store.Database)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	count := 0
+	w, err := export.NewWriter(format, out, compress)
+	if err == nil {
+		err = store.StreamRecords(context.Background(), collection, q, func(r *model.MQTTRecord) error {
+			count++
+			return w.Write(r)
+		})
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if path != "-" {
+			// don't leave a file looking complete
+			os.Remove(path)
+		}
+		return err
+	}
+	logger.Infof("exported %d records of %s to %s", count, name, path)
+	return nil
+}
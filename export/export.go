@@ -0,0 +1,201 @@
+// Package export writes records as CSV, NDJSON or Parquet
+package export
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+)
+
+// Formats
+const (
+	CSV     = "csv"
+	NDJSON  = "ndjson"
+	Parquet = "parquet"
+)
+
+// Formats lists the export formats
+var Formats = []string{CSV, NDJSON, Parquet}
+
+var contentTypes = map[string]string{
+	CSV:     "text/csv",
+	NDJSON:  "application/x-ndjson",
+	Parquet: "application/vnd.apache.parquet",
+}
+
+// acceptedTypes maps the media types of an Accept header to their format
+var acceptedTypes = map[string]string{
+	"text/csv":                       CSV,
+	"application/x-ndjson":           NDJSON,
+	"application/ndjson":             NDJSON,
+	"application/jsonl":              NDJSON,
+	"application/vnd.apache.parquet": Parquet,
+	"application/x-parquet":          Parquet,
+}
+
+// extensions maps the file extensions to their format
+var extensions = map[string]string{
+	".csv":     CSV,
+	".ndjson":  NDJSON,
+	".jsonl":   NDJSON,
+	".parquet": Parquet,
+}
+
+// CSVHeader names the CSV columns, fields holds the fields of the record as a JSON object
+// and measured_at is empty for the records without a measured time
+var CSVHeader = []string{"id", "topic", "timestamp", "payload", "client_id", "username", "qos", "retain", "packet_id", "fields",
+	"measured_at"}
+
+// ContentType returns the media type of a format
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+// Extension returns the file extension of a format
+func Extension(format string) string {
+	return "." + format
+}
+
+// ParseFormat checks the name of a format
+func ParseFormat(name string) (string, error) {
+	name = strings.ToLower(name)
+	if _, ok := contentTypes[name]; !ok {
+		return "", fmt.Errorf("unknown format %q, expect %s", name, strings.Join(Formats, ", "))
+	}
+	return name, nil
+}
+
+// FromAccept returns the first format of an Accept header, false if it accepts none of them
+func FromAccept(accept string) (string, bool) {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if format, ok := acceptedTypes[mediaType]; ok {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// FromFile returns the format of a file by its extension, and whether it's gzipped (.gz)
+func FromFile(name string) (string, bool, error) {
+	compressed := strings.EqualFold(filepath.Ext(name), ".gz")
+	if compressed {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	format, ok := extensions[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		return "", false, fmt.Errorf("%s: unknown format, expect .csv, .ndjson, .jsonl or .parquet, optionally followed by .gz", name)
+	}
+	return format, compressed, nil
+}
+
+// Writer writes records in a format
+type Writer interface {
+	Write(r *model.MQTTRecord) error
+	// Close flushes the records, the underlying writer is not closed
+	Close() error
+}
+
+// NewWriter returns a Writer of the format to w, gzipped if compress is set
+func NewWriter(format string, w io.Writer, compress bool) (Writer, error) {
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	var writer Writer
+	var err error
+	switch format {
+	case CSV:
+		writer, err = newCSVWriter(w)
+	case NDJSON:
+		writer = &ndjsonWriter{encoder: json.NewEncoder(w)}
+	case Parquet:
+		writer, err = newParquetWriter(w)
+	default:
+		err = fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil || zw == nil {
+		return writer, err
+	}
+	return &gzipWriter{Writer: writer, zw: zw}, nil
+}
+
+type gzipWriter struct {
+	Writer
+	zw *gzip.Writer
+}
+
+func (w *gzipWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	return w.zw.Close()
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	cw := csv.NewWriter(w)
+	return &csvWriter{w: cw}, cw.Write(CSVHeader)
+}
+
+func (w *csvWriter) Write(r *model.MQTTRecord) error {
+	fields := ""
+	if len(r.Fields) > 0 {
+		content, err := json.Marshal(r.Fields)
+		if err != nil {
+			return err
+		}
+		fields = string(content)
+	}
+	measuredAt := ""
+	if r.MeasuredAt != nil {
+		measuredAt = r.MeasuredAt.UTC().Format(time.RFC3339Nano)
+	}
+	return w.w.Write([]string{
+		r.ID.Hex(),
+		r.Topic,
+		r.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.FormatFloat(r.Payload, 'g', -1, 64),
+		r.ClientID,
+		r.Username,
+		strconv.Itoa(int(r.QoS)),
+		strconv.FormatBool(r.Retain),
+		strconv.Itoa(int(r.PacketID)),
+		fields,
+		measuredAt,
+	})
+}
+
+func (w *csvWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// ndjsonWriter writes a record per line, as returned by the API
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonWriter) Write(r *model.MQTTRecord) error {
+	return w.encoder.Encode(r)
+}
+
+func (w *ndjsonWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,67 @@
+package export
+
+import (
+	"io"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetRowGroupSize bounds the records held in memory before a row group is written
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+// parquetRecord is the schema of the Parquet files
+type parquetRecord struct {
+	ID        string             `parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Topic     string             `parquet:"name=topic, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Timestamp int64              `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	Payload   float64            `parquet:"name=payload, type=DOUBLE"`
+	ClientID  string             `parquet:"name=client_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Username  string             `parquet:"name=username, type=BYTE_ARRAY, convertedtype=UTF8"`
+	QoS       int32              `parquet:"name=qos, type=INT32"`
+	Retain    bool               `parquet:"name=retain, type=BOOLEAN"`
+	PacketID  int32              `parquet:"name=packet_id, type=INT32"`
+	Fields    map[string]float64 `parquet:"name=fields, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=DOUBLE"`
+	// nil for the records without a measured time
+	MeasuredAt *int64 `parquet:"name=measured_at, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"`
+}
+
+type parquetWriter struct {
+	w *writer.ParquetWriter
+}
+
+func newParquetWriter(w io.Writer) (*parquetWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetRecord), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetWriter{w: pw}, nil
+}
+
+func (w *parquetWriter) Write(r *model.MQTTRecord) error {
+	var measuredAt *int64
+	if r.MeasuredAt != nil {
+		micros := r.MeasuredAt.UnixNano() / 1000
+		measuredAt = &micros
+	}
+	return w.w.Write(parquetRecord{
+		ID:         r.ID.Hex(),
+		Topic:      r.Topic,
+		Timestamp:  r.Timestamp.UnixNano() / 1000,
+		Payload:    r.Payload,
+		ClientID:   r.ClientID,
+		Username:   r.Username,
+		QoS:        int32(r.QoS),
+		Retain:     r.Retain,
+		PacketID:   int32(r.PacketID),
+		Fields:     r.Fields,
+		MeasuredAt: measuredAt,
+	})
+}
+
+func (w *parquetWriter) Close() error {
+	return w.w.WriteStop()
+}
@@ -0,0 +1,84 @@
+// Package health runs the readiness checks of the components of the bridge
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check returns an error if the component is not ready
+type Check func(ctx context.Context) error
+
+// Component is the result of the check of a component
+type Component struct {
+	Status string `json:"status" example:"ok"`
+	// Duration of the check in milliseconds
+	Latency float64 `json:"latency_ms" example:"0.42"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Report is the result of every check, Status is ok if they all passed
+type Report struct {
+	Status     string               `json:"status" example:"ok"`
+	Components map[string]Component `json:"components"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker runs the checks of the components concurrently
+type Checker struct {
+	checks  []namedCheck
+	timeout time.Duration
+}
+
+// NewChecker creates a checker whose checks fail after timeout
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers the check of a component
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Run runs every check
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	report := Report{Status: StatusOK, Components: make(map[string]Component, len(c.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := nc.check(ctx)
+			component := Component{
+				Status:  StatusOK,
+				Latency: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				component.Status = StatusFail
+				component.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[nc.name] = component
+			if err != nil {
+				report.Status = StatusFail
+			}
+		}(nc)
+	}
+	wg.Wait()
+	return report
+}
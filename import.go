@@ -0,0 +1,96 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crosstyan/mqtt-to-ws/config"
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/pborman/getopt"
+)
+
+// runImport writes the rows of a file to the collection of a topic and prints the report,
+// args are the ones following the global options: import [options] topic file
+func runImport(cfg *config.Config, args []string) error {
+	set := getopt.New()
+	set.SetProgram(filepath.Base(os.Args[0]) + " [options] import")
+	set.SetParameters("topic file")
+	var format string
+	var compressed bool
+	set.StringVarLong(&format, "format", 'f',
+		"'csv' or 'ndjson' -- default from the extension of the file, 'csv' for '-'", "format")
+	set.BoolVarLong(&compressed, "gzip", 'z', "The file is compressed with gzip -- default when the file ends with .gz")
+	set.Parse(args)
+	if set.NArgs() != 2 {
+		set.PrintUsage(os.Stderr)
+		return fmt.Errorf("import needs a topic and a file, '-' for stdin")
+	}
+	name, path := set.Arg(0), set.Arg(1)
+	var err error
+	if format == "" {
+		format = model.ImportCSV
+		if path != "-" {
+			ext := strings.TrimSuffix(path, ".gz")
+			compressed = compressed || ext != path
+			switch strings.ToLower(filepath.Ext(ext)) {
+			case ".ndjson", ".jsonl":
+				format = model.ImportNDJSON
+			case ".csv":
+			default:
+				return fmt.Errorf("can't tell the format of %s, use --format", path)
+			}
+		}
+	} else if format, err = model.ParseImportFormat(format); err != nil {
+		return err
+	}
+
+	routes, err := cfg.LoadRoutes()
+	if err != nil {
+		return err
+	}
+	collection, ok := routes.Collection(name)
+	if !ok {
+		return fmt.Errorf("topic %s is not persisted", name)
+	}
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	if compressed {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+	store, err := model.OpenStore(cfg.Store.Backend, cfg.Store.MongoURL, cfg.Store.Database)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := model.Import(store, collection, name, format, in)
+	if report != nil {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(report); err == nil {
+			err = encodeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	logger.Infof("imported %d records of %s from %s, %d rejected", report.Accepted, name, path, report.Rejected)
+	return nil
+}
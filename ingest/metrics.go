@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topics counted with their own label, the next ones are counted as otherTopic
+// so a client publishing to random topics can't blow up the number of series
+const maxTopicLabels = 1000
+
+const otherTopic = "other"
+
+var messagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "mqttws",
+	Subsystem: "ingest",
+	Name:      "messages_total",
+	Help:      "Messages received from the MQTT broker and the websocket clients, by topic",
+}, []string{"topic"})
+
+var (
+	queueLength = prometheus.NewDesc("mqttws_ingest_queue_length",
+		"Messages waiting in the queue of a sink", []string{"queue"}, nil)
+	queueCapacity = prometheus.NewDesc("mqttws_ingest_queue_capacity",
+		"Size of the queue of a sink", []string{"queue"}, nil)
+	queueEnqueued = prometheus.NewDesc("mqttws_ingest_queue_enqueued_total",
+		"Messages queued for a sink", []string{"queue"}, nil)
+	queueDropped = prometheus.NewDesc("mqttws_ingest_queue_dropped_total",
+		"Messages dropped because the queue of a sink was full", []string{"queue"}, nil)
+	queueSpilled = prometheus.NewDesc("mqttws_ingest_queue_spilled_total",
+		"Messages spilled to disk because the queue of a sink was full", []string{"queue"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(messagesReceived)
+}
+
+// topicLabels limits the distinct topic labels
+type topicLabels struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+var topics = topicLabels{seen: make(map[string]bool)}
+
+func (t *topicLabels) label(topic string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen[topic] {
+		return topic
+	}
+	if len(t.seen) >= maxTopicLabels {
+		return otherTopic
+	}
+	t.seen[topic] = true
+	return topic
+}
+
+// Describe implements prometheus.Collector
+func (p *Pipeline) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLength
+	ch <- queueCapacity
+	ch <- queueEnqueued
+	ch <- queueDropped
+	ch <- queueSpilled
+}
+
+// Collect implements prometheus.Collector with the stats of the queues
+func (p *Pipeline) Collect(ch chan<- prometheus.Metric) {
+	for _, q := range p.queues {
+		stats := q.Stats()
+		ch <- prometheus.MustNewConstMetric(queueLength, prometheus.GaugeValue, float64(q.Len()), q.name)
+		ch <- prometheus.MustNewConstMetric(queueCapacity, prometheus.GaugeValue, float64(q.Cap()), q.name)
+		ch <- prometheus.MustNewConstMetric(queueEnqueued, prometheus.CounterValue, float64(stats.Enqueued), q.name)
+		ch <- prometheus.MustNewConstMetric(queueDropped, prometheus.CounterValue, float64(stats.Dropped), q.name)
+		ch <- prometheus.MustNewConstMetric(queueSpilled, prometheus.CounterValue, float64(stats.Spilled), q.name)
+	}
+}
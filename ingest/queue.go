@@ -0,0 +1,233 @@
+// Package ingest fans the MQTT messages out to the sinks (websocket hub, database)
+// through bounded queues, so a slow sink never blocks the broker
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	l "github.com/crosstyan/mqtt-to-ws/logger"
+	"github.com/crosstyan/mqtt-to-ws/model"
+)
+
+var logger = l.For(l.Ingest)
+
+// Policy tells what a queue does with a message when it is full
+type Policy string
+
+// Overflow policies
+const (
+	// Block the publisher until there is room, the previous unbuffered behavior
+	PolicyBlock Policy = "block"
+	// Drop the oldest queued message to make room
+	PolicyDropOldest Policy = "drop-oldest"
+	// Drop the incoming message
+	PolicyDropNewest Policy = "drop-newest"
+	// Append the message to a file on disk, it is queued again once there is room
+	PolicySpill Policy = "spill"
+)
+
+// ParsePolicy validates the name of a policy
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest, PolicySpill:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q, expect block, drop-oldest, drop-newest or spill", name)
+}
+
+// QueueStats counts the messages of a queue
+type QueueStats struct {
+	Enqueued uint64 `json:"enqueued"`
+	Dropped  uint64 `json:"dropped"`
+	Spilled  uint64 `json:"spilled"`
+}
+
+// Queue is a bounded queue of messages in front of a sink
+type Queue struct {
+	name   string
+	ch     chan model.MQTTMsg
+	policy Policy
+	spill  *spill
+	stats  QueueStats
+	// set while the queue overflows, to log once per overflow instead of once per message
+	overflowing int32
+	// held by Push while it sends to ch, so Close can't close ch under its feet
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// NewQueue creates a queue holding up to size messages.
+// spillPath is the file used by PolicySpill, holding up to spillMax bytes,
+// the messages left in it by a previous run are queued again.
+func NewQueue(name string, size int, policy Policy, spillPath string, spillMax int64) (*Queue, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("queue %s: size must be positive", name)
+	}
+	q := &Queue{
+		name:   name,
+		ch:     make(chan model.MQTTMsg, size),
+		policy: policy,
+	}
+	if policy == PolicySpill {
+		if spillPath == "" {
+			return nil, fmt.Errorf("queue %s: spill policy needs a spill file", name)
+		}
+		var err error
+		if q.spill, err = openSpill(spillPath, spillMax); err != nil {
+			return nil, fmt.Errorf("queue %s: %w", name, err)
+		}
+		go q.spill.drain(q.ch)
+	}
+	return q, nil
+}
+
+// C is read by the sink
+func (q *Queue) C() <-chan model.MQTTMsg {
+	return q.ch
+}
+
+// Name of the sink
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// Len is the number of messages waiting in memory
+func (q *Queue) Len() int {
+	return len(q.ch)
+}
+
+// Cap is the size of the queue
+func (q *Queue) Cap() int {
+	return cap(q.ch)
+}
+
+// Saturated reports whether the queue is overflowing or at least 90% full
+func (q *Queue) Saturated() bool {
+	return atomic.LoadInt32(&q.overflowing) == 1 || q.Len() >= q.Cap()*9/10
+}
+
+// Stats returns a snapshot of the counters
+func (q *Queue) Stats() QueueStats {
+	return QueueStats{
+		Enqueued: atomic.LoadUint64(&q.stats.Enqueued),
+		Dropped:  atomic.LoadUint64(&q.stats.Dropped),
+		Spilled:  atomic.LoadUint64(&q.stats.Spilled),
+	}
+}
+
+// Push queues a message according to the overflow policy of the queue.
+// It only blocks with PolicyBlock.
+func (q *Queue) Push(msg model.MQTTMsg) {
+	q.closeMu.RLock()
+	defer q.closeMu.RUnlock()
+	if q.closed {
+		q.drop()
+		return
+	}
+	overflowed := false
+	switch q.policy {
+	case PolicyBlock:
+		q.ch <- msg
+	case PolicyDropNewest:
+		select {
+		case q.ch <- msg:
+		default:
+			q.drop()
+			return
+		}
+	case PolicyDropOldest:
+		for sent := false; !sent; {
+			select {
+			case q.ch <- msg:
+				sent = true
+			default:
+				select {
+				case <-q.ch:
+					q.drop()
+					overflowed = true
+				default:
+				}
+			}
+		}
+	case PolicySpill:
+		// the message is written to the file as long as it is not empty to keep the order
+		spilled, err := q.spill.push(q.ch, msg)
+		if err != nil {
+			// a full spill file is logged once per overflow
+			if !errors.Is(err, errSpillFull) {
+				logger.Errorf("queue %s: %v", q.name, err)
+			}
+			q.drop()
+			return
+		}
+		if spilled {
+			atomic.AddUint64(&q.stats.Spilled, 1)
+			q.overflow()
+			overflowed = true
+		}
+	}
+	atomic.AddUint64(&q.stats.Enqueued, 1)
+	if !overflowed {
+		atomic.StoreInt32(&q.overflowing, 0)
+	}
+}
+
+// Close closes the channel of the sink once the pending pushes are done.
+// The messages pushed afterwards are dropped, the spilled ones stay on disk for the next run.
+func (q *Queue) Close() {
+	q.closeMu.Lock()
+	defer q.closeMu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	if q.spill != nil {
+		q.spill.close()
+	}
+	close(q.ch)
+}
+
+func (q *Queue) drop() {
+	atomic.AddUint64(&q.stats.Dropped, 1)
+	q.overflow()
+}
+
+// overflow logs the beginning of an overflow
+func (q *Queue) overflow() {
+	if atomic.CompareAndSwapInt32(&q.overflowing, 0, 1) {
+		logger.Warnf("queue %s is full (%d messages), applying policy %s", q.name, cap(q.ch), q.policy)
+	}
+}
+
+// Pipeline pushes every message to the queue of each sink
+type Pipeline struct {
+	queues []*Queue
+}
+
+// NewPipeline creates a pipeline feeding the queues
+func NewPipeline(queues ...*Queue) *Pipeline {
+	return &Pipeline{queues: queues}
+}
+
+// Push queues the message for every sink
+func (p *Pipeline) Push(msg model.MQTTMsg) {
+	messagesReceived.WithLabelValues(topics.label(msg.Topic)).Inc()
+	for _, q := range p.queues {
+		q.Push(msg)
+	}
+}
+
+// Close closes every queue
+func (p *Pipeline) Close() {
+	for _, q := range p.queues {
+		q.Close()
+	}
+}
+
+// Queues returns the queues of the sinks
+func (p *Pipeline) Queues() []*Queue {
+	return p.queues
+}
@@ -0,0 +1,328 @@
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+)
+
+// errSpillFull is returned by push when the message doesn't fit in the size cap of the file
+var errSpillFull = errors.New("spill file is full")
+
+const (
+	// the offset is saved every spillSaveEvery delivered messages,
+	// so a crash delivers at most that many messages twice
+	spillSaveEvery = 100
+	// the delivered messages are removed from the file once they take that many bytes and half the file
+	spillCompactMin = 1 << 20
+)
+
+// spill is a FIFO of messages in a file, one JSON document per line.
+// The offset of the first message not delivered yet is saved next to it, in <path>.offset,
+// so a restart only replays the messages which were not delivered.
+// The file is truncated whenever it has been read to the end, and compacted
+// while it's read under sustained overload.
+type spill struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	// the writes always go to the end of the file, the reads need their own offset
+	file   *os.File
+	input  *os.File
+	reader *bufio.Reader
+	// size of the file and offset of the first message not delivered
+	size, offset int64
+	// number of messages written but not read yet
+	pending int
+	// messages delivered since the offset was saved
+	unsaved int
+	// set while the file is full, to log once per overflow
+	full bool
+	// signals the drain loop that pending became positive
+	notify chan struct{}
+	// stops the drain loop
+	stop chan struct{}
+	done chan struct{}
+}
+
+func openSpill(path string, maxSize int64) (*spill, error) {
+	s := &spill{
+		path:    path,
+		maxSize: maxSize,
+		notify:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := s.openFiles(); err != nil {
+		return nil, err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	s.size = info.Size()
+	if content, err := ioutil.ReadFile(path + ".offset"); err == nil {
+		if s.offset, err = strconv.ParseInt(string(bytes.TrimSpace(content)), 10, 64); err != nil {
+			s.closeFiles()
+			return nil, fmt.Errorf("%s.offset: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		s.closeFiles()
+		return nil, err
+	}
+	if s.offset > s.size {
+		s.offset = 0
+	}
+	// count the messages left by a previous run
+	if _, err = s.input.Seek(s.offset, io.SeekStart); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	s.reader.Reset(s.input)
+	end := s.offset
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		end += int64(len(line))
+		s.pending++
+	}
+	// drop the line cut by a crash
+	if end != s.size {
+		if err = s.file.Truncate(end); err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.size = end
+	}
+	if _, err = s.input.Seek(s.offset, io.SeekStart); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	s.reader.Reset(s.input)
+	if s.pending > 0 {
+		logger.Infof("replaying %d messages spilled to %s", s.pending, path)
+		s.notify <- struct{}{}
+	}
+	return s, nil
+}
+
+func (s *spill) openFiles() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	input, err := os.Open(s.path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.input = file, input
+	if s.reader == nil {
+		s.reader = bufio.NewReader(input)
+	} else {
+		s.reader.Reset(input)
+	}
+	return nil
+}
+
+// push sends the message to ch if the file is empty and ch has room,
+// otherwise it appends the message to the file, or fails with errSpillFull
+func (s *spill) push(ch chan<- model.MQTTMsg, msg model.MQTTMsg) (spilled bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		select {
+		case ch <- msg:
+			return false, nil
+		default:
+		}
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	if s.size+int64(len(line)+1) > s.maxSize {
+		if !s.full {
+			logger.Errorf("spill %s is full (%d bytes), dropping messages", s.path, s.maxSize)
+			s.full = true
+		}
+		return false, errSpillFull
+	}
+	if _, err = s.file.Write(append(line, '\n')); err != nil {
+		return false, err
+	}
+	s.size += int64(len(line) + 1)
+	s.pending++
+	if s.pending == 1 {
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+	return true, nil
+}
+
+// drain moves the spilled messages back to ch, in order, until stop is closed
+func (s *spill) drain(ch chan<- model.MQTTMsg) {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.notify:
+		case <-s.stop:
+			return
+		}
+		for {
+			s.mu.Lock()
+			if s.pending == 0 {
+				s.truncate()
+				s.mu.Unlock()
+				break
+			}
+			line, err := s.reader.ReadBytes('\n')
+			s.mu.Unlock()
+			if err != nil {
+				logger.Errorf("spill %s: %v", s.path, err)
+				s.reset()
+				break
+			}
+			var msg model.MQTTMsg
+			if err := json.Unmarshal(line, &msg); err != nil {
+				logger.Errorf("spill %s: %v", s.path, err)
+			} else {
+				// the message must be in ch before pending is decremented,
+				// or push could overtake it
+				select {
+				case ch <- msg:
+				case <-s.stop:
+					// the offset is before the message, it is replayed by the next run
+					return
+				}
+			}
+			s.mu.Lock()
+			s.pending--
+			s.offset += int64(len(line))
+			s.unsaved++
+			if s.offset >= spillCompactMin && s.offset >= s.size/2 {
+				s.compact()
+			} else if s.unsaved >= spillSaveEvery {
+				s.saveOffset()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// truncate empties the file once every message has been read, the lock must be held
+func (s *spill) truncate() {
+	if s.size == 0 {
+		return
+	}
+	if err := s.file.Truncate(0); err != nil {
+		logger.Errorf("spill %s: %v", s.path, err)
+		return
+	}
+	if _, err := s.input.Seek(0, io.SeekStart); err != nil {
+		logger.Errorf("spill %s: %v", s.path, err)
+	}
+	s.reader.Reset(s.input)
+	s.size, s.offset, s.full = 0, 0, false
+	s.saveOffset()
+}
+
+// compact moves the messages not delivered yet to the beginning of the file, the lock must be held
+func (s *spill) compact() {
+	tmp := s.path + ".tmp"
+	if err := copyTail(tmp, s.input, s.offset, s.size); err != nil {
+		logger.Errorf("spill %s: %v", s.path, err)
+		os.Remove(tmp)
+		s.saveOffset()
+		return
+	}
+	// a crash from here on delivers the messages before the offset again, rather than losing the next ones
+	offset := s.offset
+	s.offset = 0
+	s.saveOffset()
+	if err := os.Rename(tmp, s.path); err != nil {
+		logger.Errorf("spill %s: %v", s.path, err)
+		os.Remove(tmp)
+		s.offset = offset
+		s.saveOffset()
+		return
+	}
+	s.closeFiles()
+	if err := s.openFiles(); err != nil {
+		// the next messages can't be spilled nor replayed, they are dropped
+		logger.Errorf("spill %s: %v", s.path, err)
+	}
+	s.size -= offset
+	s.full = false
+}
+
+// copyTail copies the bytes of file from offset to size to a new file at path
+func copyTail(path string, file *os.File, offset, size int64) error {
+	tail, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tail, io.NewSectionReader(file, offset, size-offset))
+	if err == nil {
+		err = tail.Sync()
+	}
+	if closeErr := tail.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// saveOffset replaces the offset file atomically, the lock must be held
+func (s *spill) saveOffset() {
+	s.unsaved = 0
+	path := s.path + ".offset"
+	err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatInt(s.offset, 10)), 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logger.Errorf("spill %s: %v", s.path, err)
+	}
+}
+
+// reset gives up the unreadable messages
+func (s *spill) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logger.Errorf("spill %s: dropping %d unreadable messages", s.path, s.pending)
+	s.pending = 0
+	s.truncate()
+}
+
+// close stops the drain loop, saves the offset and closes the file
+func (s *spill) close() {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saveOffset()
+	s.closeFiles()
+}
+
+func (s *spill) closeFiles() {
+	s.file.Close()
+	s.input.Close()
+}
@@ -0,0 +1,155 @@
+package ingest
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crosstyan/mqtt-to-ws/model"
+)
+
+func testMsg(i int) model.MQTTMsg {
+	return model.MQTTMsg{Topic: "a", Payload: strconv.Itoa(i)}
+}
+
+// receive reads n messages of the queue and returns their payloads
+func receive(t *testing.T, q *Queue, n int) []string {
+	t.Helper()
+	var payloads []string
+	for len(payloads) < n {
+		select {
+		case msg := <-q.C():
+			payloads = append(payloads, msg.Payload)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v, want %d messages", payloads, n)
+		}
+	}
+	return payloads
+}
+
+// closeQueue closes the queue and returns the payloads left in its channel
+func closeQueue(q *Queue) []string {
+	q.Close()
+	var payloads []string
+	for msg := range q.C() {
+		payloads = append(payloads, msg.Payload)
+	}
+	return payloads
+}
+
+func sequence(from, to int) []string {
+	var s []string
+	for i := from; i <= to; i++ {
+		s = append(s, strconv.Itoa(i))
+	}
+	return s
+}
+
+func TestSpillReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.spill")
+	q, err := NewQueue("db", 1, PolicySpill, path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		q.Push(testMsg(i))
+	}
+	got := receive(t, q, 2)
+	got = append(got, closeQueue(q)...)
+
+	// only the messages which were not delivered are queued again
+	q, err = NewQueue("db", 1, PolicySpill, path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, receive(t, q, 5-len(got))...)
+	q.Push(testMsg(6))
+	got = append(got, receive(t, q, 1)...)
+	if left := closeQueue(q); len(left) != 0 {
+		t.Errorf("%v left in the queue", left)
+	}
+	if want := sequence(1, 6); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	q, err = NewQueue("db", 1, PolicySpill, path, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-q.C():
+		t.Errorf("message %s replayed", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	closeQueue(q)
+}
+
+func TestSpillFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.spill")
+	// room for a few messages only
+	q, err := NewQueue("db", 1, PolicySpill, path, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first message is in the channel, which isn't read yet
+	for i := 1; i <= 20; i++ {
+		q.Push(testMsg(i))
+	}
+	stats := q.Stats()
+	if stats.Dropped == 0 || stats.Enqueued+stats.Dropped != 20 {
+		t.Fatalf("got %+v, want messages dropped", stats)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 300 {
+		t.Fatalf("spill file: %v, %v", info.Size(), err)
+	}
+	// the queued messages come first, in order
+	got := receive(t, q, int(stats.Enqueued))
+	if want := sequence(1, int(stats.Enqueued)); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// there is room again once the file is read
+	q.Push(testMsg(21))
+	if got = receive(t, q, 1); got[0] != "21" {
+		t.Errorf("got %v, want 21", got)
+	}
+	closeQueue(q)
+}
+
+func TestSpillCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.spill")
+	q, err := NewQueue("db", 1, PolicySpill, path, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// about 3 MiB of messages
+	padding := strings.Repeat("x", 1024)
+	const n = 3000
+	for i := 1; i <= n; i++ {
+		msg := testMsg(i)
+		msg.Topic = padding
+		q.Push(msg)
+	}
+	written, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := receive(t, q, 2000)
+	// the delivered messages are removed from the file while it's read
+	if info, err := os.Stat(path); err != nil || info.Size() >= written.Size() {
+		t.Errorf("spill file of %d bytes after reading 2/3 of it, was %d: %v", info.Size(), written.Size(), err)
+	}
+	got = append(got, closeQueue(q)...)
+
+	q, err = NewQueue("db", 1, PolicySpill, path, 16<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, receive(t, q, n-len(got))...)
+	closeQueue(q)
+	if want := sequence(1, n); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %d messages out of order or duplicated, want %d", len(got), n)
+	}
+}
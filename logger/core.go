@@ -0,0 +1,125 @@
+package logger
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// swapCore writes to a core which can be replaced, e.g. once the config is loaded
+type swapCore struct {
+	core atomic.Value
+}
+
+func newSwapCore(core zapcore.Core) *swapCore {
+	s := &swapCore{}
+	s.swap(core)
+	return s
+}
+
+func (s *swapCore) swap(core zapcore.Core) {
+	s.core.Store(&core)
+}
+
+func (s *swapCore) load() zapcore.Core {
+	return *s.core.Load().(*zapcore.Core)
+}
+
+func (s *swapCore) Sync() error {
+	return s.load().Sync()
+}
+
+// componentLevel is the level of a component, it follows Level until it's set
+type componentLevel struct {
+	// *zap.AtomicLevel, nil while following Level
+	level atomic.Value
+}
+
+func (c *componentLevel) set(level zapcore.Level) {
+	l := zap.NewAtomicLevelAt(level)
+	c.level.Store(&l)
+}
+
+func (c *componentLevel) follow() {
+	c.level.Store((*zap.AtomicLevel)(nil))
+}
+
+func (c *componentLevel) Enabled(level zapcore.Level) bool {
+	if l, _ := c.level.Load().(*zap.AtomicLevel); l != nil {
+		return l.Enabled(level)
+	}
+	return Level.Enabled(level)
+}
+
+// levelCore filters the entries by level and writes them to the current core of the swapCore
+type levelCore struct {
+	*swapCore
+	level  zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{
+		swapCore: c.swapCore,
+		level:    c.level,
+		fields:   append(append([]zapcore.Field{}, c.fields...), fields...),
+	}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return ce.AddCore(entry, c)
+	}
+	return ce
+}
+
+func (c *levelCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	core := c.load()
+	if len(c.fields) > 0 {
+		core = core.With(c.fields)
+	}
+	return core.Write(entry, fields)
+}
+
+// sampledCore samples the entries of base, its sampling can be replaced
+type sampledCore struct {
+	base zapcore.Core
+	// *zapcore.Core
+	sampler atomic.Value
+}
+
+func (s *sampledCore) resample(sampling Sampling) {
+	core := zapcore.NewSamplerWithOptions(s.base, time.Second, sampling.Initial, sampling.Thereafter)
+	s.sampler.Store(&core)
+}
+
+func (s *sampledCore) load() zapcore.Core {
+	return *s.sampler.Load().(*zapcore.Core)
+}
+
+func (s *sampledCore) Enabled(level zapcore.Level) bool {
+	return s.base.Enabled(level)
+}
+
+// With returns a core keeping the current sampling
+func (s *sampledCore) With(fields []zapcore.Field) zapcore.Core {
+	return s.load().With(fields)
+}
+
+func (s *sampledCore) Check(entry zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return s.load().Check(entry, ce)
+}
+
+func (s *sampledCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	return s.load().Write(entry, fields)
+}
+
+func (s *sampledCore) Sync() error {
+	return s.base.Sync()
+}
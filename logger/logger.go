@@ -1,6 +1,239 @@
 package logger
 
-import "go.uber.org/zap"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 
-var L, _ = zap.NewDevelopment()
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Components with their own level, the others use Level
+const (
+	Broker = "broker"
+	Hub    = "hub"
+	Ingest = "ingest"
+	Store  = "store"
+	HTTP   = "http"
+)
+
+// Config of the logs
+type Config struct {
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// console or json
+	Format string `yaml:"format"`
+	// stderr, stdout or the path of a file, which is rotated
+	Output   string   `yaml:"output"`
+	Rotation Rotation `yaml:"rotation"`
+	// Levels of the components, they use Level when empty
+	Levels   Levels   `yaml:"levels"`
+	Sampling Sampling `yaml:"sampling"`
+}
+
+// Rotation of the log file
+type Rotation struct {
+	// Size in MiB of the file before it's rotated
+	MaxSize int `yaml:"max_size"`
+	// Rotated files kept, 0 keeps them all
+	MaxBackups int `yaml:"max_backups"`
+	// Days a rotated file is kept, 0 keeps them forever
+	MaxAge   int  `yaml:"max_age"`
+	Compress bool `yaml:"compress"`
+}
+
+// Levels of the components
+type Levels struct {
+	Broker string `yaml:"broker"`
+	Hub    string `yaml:"hub"`
+	Ingest string `yaml:"ingest"`
+	Store  string `yaml:"store"`
+	HTTP   string `yaml:"http"`
+}
+
+// Sampling of the logs written for every message, e.g. by the hub.
+// Each second, the first Initial entries with the same message are written,
+// then one out of Thereafter.
+type Sampling struct {
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"`
+}
+
+var DefaultConfig = Config{
+	Level:  "debug",
+	Format: "console",
+	Output: "stderr",
+	Rotation: Rotation{
+		MaxSize:    100,
+		MaxBackups: 5,
+		MaxAge:     30,
+	},
+	Sampling: Sampling{
+		Initial:    10,
+		Thereafter: 100,
+	},
+}
+
+// Level of the components without their own level, which can be changed while the bridge runs
+var Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+
+// levels of the components, nil while they follow Level
+var levels = map[string]*componentLevel{
+	Broker: {},
+	Hub:    {},
+	Ingest: {},
+	Store:  {},
+	HTTP:   {},
+}
+
+// output is shared by every logger, so Configure applies to the loggers created before
+var output = newSwapCore(newConsoleCore(os.Stderr))
+
+var sampling = DefaultConfig.Sampling
+
+// sampled cores, rebuilt by Configure with the new sampling
+var (
+	sampledMu sync.Mutex
+	sampled   []*sampledCore
+)
+
+var L = zap.New(&levelCore{swapCore: output, level: Level}, zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel))
 var Lsugar = L.Sugar()
+
+// For returns the logger of a component
+func For(component string) *zap.SugaredLogger {
+	return Component(component).Sugar()
+}
+
+// Component returns the logger of a component, e.g. for the libraries taking a *zap.Logger
+func Component(component string) *zap.Logger {
+	level, ok := levels[component]
+	if !ok {
+		panic("logger: unknown component " + component)
+	}
+	return L.WithOptions(zap.WrapCore(func(zapcore.Core) zapcore.Core {
+		return &levelCore{swapCore: output, level: level}
+	})).Named(component)
+}
+
+// Sampled returns the logger of a component for the entries written for every message
+func Sampled(component string) *zap.SugaredLogger {
+	return Component(component).WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		sampledMu.Lock()
+		defer sampledMu.Unlock()
+		s := &sampledCore{base: core}
+		s.resample(sampling)
+		sampled = append(sampled, s)
+		return s
+	})).Sugar()
+}
+
+// ParseLevel parses a level name
+func ParseLevel(name string) (zapcore.Level, error) {
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(name))
+	return level, err
+}
+
+// Validate checks the levels, the format and the sampling
+func (c *Config) Validate() error {
+	if _, err := ParseLevel(c.Level); err != nil {
+		return fmt.Errorf("level: %w", err)
+	}
+	for component, name := range c.Levels.byComponent() {
+		if name == "" {
+			continue
+		}
+		if _, err := ParseLevel(name); err != nil {
+			return fmt.Errorf("levels.%s: %w", component, err)
+		}
+	}
+	if c.Format != "console" && c.Format != "json" {
+		return fmt.Errorf("format: unknown format %q, expect console or json", c.Format)
+	}
+	if c.Output == "" {
+		return fmt.Errorf("output: must not be empty")
+	}
+	if c.Sampling.Initial < 1 || c.Sampling.Thereafter < 0 {
+		return fmt.Errorf("sampling: initial must be positive and thereafter can't be negative")
+	}
+	return nil
+}
+
+func (l *Levels) byComponent() map[string]string {
+	return map[string]string{
+		Broker: l.Broker,
+		Hub:    l.Hub,
+		Ingest: l.Ingest,
+		Store:  l.Store,
+		HTTP:   l.HTTP,
+	}
+}
+
+// Configure sets the output, the sampling and the levels of every logger
+func Configure(c Config) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	var ws zapcore.WriteSyncer
+	switch c.Output {
+	case "stderr":
+		ws = os.Stderr
+	case "stdout":
+		ws = os.Stdout
+	default:
+		ws = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   c.Output,
+			MaxSize:    c.Rotation.MaxSize,
+			MaxBackups: c.Rotation.MaxBackups,
+			MaxAge:     c.Rotation.MaxAge,
+			Compress:   c.Rotation.Compress,
+		})
+	}
+	if c.Format == "json" {
+		output.swap(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), ws, zap.DebugLevel))
+	} else {
+		output.swap(newConsoleCore(ws))
+	}
+	sampledMu.Lock()
+	sampling = c.Sampling
+	for _, s := range sampled {
+		s.resample(sampling)
+	}
+	sampledMu.Unlock()
+	SetLevels(c)
+	return nil
+}
+
+// SetLevels applies the level and the levels of the components of a validated config
+func SetLevels(c Config) {
+	level, _ := ParseLevel(c.Level)
+	Level.SetLevel(level)
+	for component, name := range c.Levels.byComponent() {
+		if name == "" {
+			levels[component].follow()
+			continue
+		}
+		level, _ := ParseLevel(name)
+		levels[component].set(level)
+	}
+}
+
+func newConsoleCore(ws zapcore.WriteSyncer) zapcore.Core {
+	encoder := zap.NewDevelopmentEncoderConfig()
+	encoder.EncodeTime = zapcore.ISO8601TimeEncoder
+	return zapcore.NewCore(zapcore.NewConsoleEncoder(encoder), ws, zap.DebugLevel)
+}
+
+// Sync flushes the logs
+func Sync() error {
+	err := output.Sync()
+	// syncing a terminal fails on some systems
+	if err != nil && strings.Contains(err.Error(), "/dev/std") {
+		return nil
+	}
+	return err
+}
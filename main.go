@@ -2,24 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/DrmagicE/gmqtt/config"
+	"github.com/DrmagicE/gmqtt"
+	gmqttconfig "github.com/DrmagicE/gmqtt/config"
 	_ "github.com/DrmagicE/gmqtt/persistence"
+	"github.com/DrmagicE/gmqtt/pkg/codes"
+	"github.com/DrmagicE/gmqtt/pkg/packets"
+	gmqttprom "github.com/DrmagicE/gmqtt/plugin/prometheus"
 	"github.com/DrmagicE/gmqtt/server"
 	_ "github.com/DrmagicE/gmqtt/topicalias/fifo"
+	"github.com/crosstyan/mqtt-to-ws/broker"
+	"github.com/crosstyan/mqtt-to-ws/config"
 	ctrl "github.com/crosstyan/mqtt-to-ws/controller"
 	docs "github.com/crosstyan/mqtt-to-ws/docs"
+	"github.com/crosstyan/mqtt-to-ws/health"
+	"github.com/crosstyan/mqtt-to-ws/ingest"
 	l "github.com/crosstyan/mqtt-to-ws/logger"
 	"github.com/crosstyan/mqtt-to-ws/model"
 	"github.com/crosstyan/mqtt-to-ws/utils"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
 	"github.com/pborman/getopt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	cors "github.com/rs/cors/wrapper/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -28,22 +43,160 @@ import (
 // https://stackoverflow.com/questions/1714236/getopt-like-behavior-in-go
 var logger = l.Lsugar
 
-var (
-	mqttToWs = make(chan model.MQTTMsg)
-	mqttToDB = make(chan model.MQTTMsg)
-)
+// queues the MQTT messages for the websocket hub and the database
+var pipeline *ingest.Pipeline
+
+// set by --mqtt-auth or mqtt.auth, any client may connect and publish to any topic without them
+var mqttAuth = broker.NewOpenAuth()
 
 // TODO: Maybe I should use a standalone subscription by MQTT client instead of using hooks
 // gMQTT hooks for incoming MQTT Message
 var onMsgArrived server.OnMsgArrived = func(ctx context.Context, client server.Client, req *server.MsgArrivedRequest) error {
 	// spew.Dump(req)
-	// TODO: Add client ID to identify which device is sending the message
+	if !mqttAuth.CanPublish(client, string(req.Publish.TopicName)) {
+		req.Drop()
+		// v3 has no way to tell the client, the message is just dropped
+		if packets.IsVersion5(client.Version()) {
+			return codes.NewError(codes.NotAuthorized)
+		}
+		return nil
+	}
+	opts := client.ClientOptions()
 	mqttMsg := model.MQTTMsg{
-		Topic:   string(req.Publish.TopicName),
-		Payload: string(req.Publish.Payload),
+		Topic:      string(req.Publish.TopicName),
+		Payload:    string(req.Publish.Payload),
+		ClientID:   opts.ClientID,
+		Username:   opts.Username,
+		QoS:        req.Publish.Qos,
+		Retain:     req.Publish.Retain,
+		PacketID:   uint16(req.Publish.PacketID),
+		ReceivedAt: time.Now(),
+		Properties: userProperties(req.Publish.Properties),
+	}
+	dispatch(mqttMsg)
+	return nil
+}
+
+// userProperties returns the first value of each MQTT v5 user property, nil if there is none
+func userProperties(props *packets.Properties) map[string]string {
+	if props == nil || len(props.User) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(props.User))
+	for _, p := range props.User {
+		if _, ok := m[string(p.K)]; !ok {
+			m[string(p.K)] = string(p.V)
+		}
+	}
+	return m
+}
+
+// dispatch forwards an MQTT message to the websocket hub and the database
+func dispatch(msg model.MQTTMsg) {
+	pipeline.Push(msg)
+}
+
+// newPublisher injects the messages published by the websocket clients into the broker.
+// The Publisher of gMQTT doesn't trigger OnMsgArrived nor store the retained messages,
+// so both are done here.
+func newPublisher(s server.Server) utils.PublishFunc {
+	return func(msg model.MQTTMsg) error {
+		m := &gmqtt.Message{
+			QoS:      msg.QoS,
+			Retained: msg.Retain,
+			Topic:    msg.Topic,
+			Payload:  []byte(msg.Payload),
+		}
+		if msg.Retain {
+			if len(m.Payload) == 0 {
+				s.RetainedService().Remove(m.Topic)
+			} else {
+				s.RetainedService().AddOrReplace(m.Copy())
+			}
+		}
+		s.Publisher().Publish(m)
+		if msg.ReceivedAt.IsZero() {
+			msg.ReceivedAt = time.Now()
+		}
+		dispatch(msg)
+		return nil
+	}
+}
+
+// ensureIndexes creates the indexes of the collections if the store needs them,
+// a failure only slows the queries down
+func ensureIndexes(store model.Store, collections []string) {
+	indexed, ok := store.(model.IndexedStore)
+	if !ok {
+		return
+	}
+	for _, collection := range collections {
+		if err := indexed.EnsureIndexes(collection); err != nil {
+			logger.Errorf("indexes of %s: %v", collection, err)
+		}
+	}
+}
+
+// newQueue creates the queue of a sink, spilling to <spillDir>/<name>.spill if needed
+func newQueue(name string, size int, overflow string, spillDir string, spillMax int64) (*ingest.Queue, error) {
+	policy, err := ingest.ParsePolicy(overflow)
+	if err != nil {
+		return nil, err
+	}
+	var spillPath string
+	if policy == ingest.PolicySpill {
+		if err = os.MkdirAll(spillDir, 0755); err != nil {
+			return nil, err
+		}
+		spillPath = filepath.Join(spillDir, name+".spill")
+	}
+	return ingest.NewQueue(name, size, policy, spillPath, spillMax)
+}
+
+// shutdown stops the sinks once the MQTT server is stopped:
+// the HTTP server stops accepting requests, the queued messages are sent
+// to the websocket clients before they are disconnected and written to the database.
+func shutdown(ctx context.Context, httpServer *http.Server, hub *utils.Hub, dbDone <-chan struct{}) {
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Errorf("HTTP server shutdown: %v", err)
+	}
+	pipeline.Close()
+	if err := hub.Wait(ctx); err != nil {
+		logger.Errorf("websocket hub shutdown: %v", err)
+	}
+	select {
+	case <-dbDone:
+	case <-ctx.Done():
+		logger.Errorf("database writer shutdown: %v, the pending records are lost", ctx.Err())
+	}
+}
+
+// longest time /readyz waits for the checks
+const readyTimeout = 2 * time.Second
+
+// dialCheck checks that a TCP listener accepts connections
+func dialCheck(addr string) health.Check {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// queuesCheck fails if a queue is saturated
+func queuesCheck(ctx context.Context) error {
+	for _, q := range pipeline.Queues() {
+		if q.Saturated() {
+			return fmt.Errorf("queue %s is saturated (%d/%d)", q.Name(), q.Len(), q.Cap())
+		}
 	}
-	mqttToWs <- mqttMsg
-	mqttToDB <- mqttMsg
 	return nil
 }
 
@@ -67,86 +220,298 @@ var hooks = server.Hooks{
 
 // @host      localhost:8080
 // @BasePath  /
+
+// @securityDefinitions.apikey  AdminToken
+// @in                          header
+// @name                        Authorization
 func main() {
+	started := time.Now()
 	// addrLocal, _ := net.InterfaceAddrs()
 	// logger.Infof("Local IP: %v", addrLocal)
-	var addrHTTP = getopt.StringLong("addr-http", 'a', "0.0.0.0:8080", "HTTP API address", "addr:port")
-	var addrMQTT = getopt.StringLong("addr-mqtt", 'A', "0.0.0.0:1883", "MQTT broker address", "addr:port")
-	var addrSwagger = getopt.StringLong("addr-swagger", 's', "localhost:8080",
-		"Swagger BaseURL -- change this if swagger is not working correctly",
-		"addr:port")
-	var mongoDBURL = getopt.StringLong("mongo-url", 'M', "mongodb://127.0.0.1:27017/",
-		"MongoDB connection URL\nmongodb://[username:password@]host1[:port1][,...hostN[:portN]][/[defaultauthdb][?options]]",
-		"url")
-	var databaseName = getopt.StringLong("database", 'D', "mqtt", "Database name", "database")
-	var websocketPath = getopt.StringLong("websocket", 'w', "/ws", "Websocket listening path -- default '/ws'", "path")
-	getopt.Parse()
-	ln, err := net.Listen("tcp", *addrMQTT)
+	getopt.SetParameters("[config print | export [options] topic file | import [options] topic file]")
+	source := config.Parse(getopt.CommandLine, os.Args)
+	cfg, err := source.Load()
+	if err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	if err = cfg.Validate(); err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	switch args := getopt.Args(); {
+	case len(args) == 0:
+	case len(args) == 2 && args[0] == "config" && args[1] == "print":
+		if err = cfg.Print(os.Stdout); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	case args[0] == "export":
+		if err = l.Configure(cfg.Log); err != nil {
+			logger.Fatal(err.Error())
+		}
+		if err = runExport(cfg, args); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	case args[0] == "import":
+		if err = l.Configure(cfg.Log); err != nil {
+			logger.Fatal(err.Error())
+		}
+		if err = runImport(cfg, args); err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	default:
+		getopt.Usage()
+		os.Exit(1)
+	}
+	if err = l.Configure(cfg.Log); err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	defer l.Sync()
+	routes, err := cfg.LoadRoutes()
+	if err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	routeTable := model.NewRouteTable(routes)
+	ln, err := net.Listen("tcp", cfg.MQTT.Addr)
+	if err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	auth, err := cfg.LoadAuth()
+	if err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	// installed even without accounts, so they can be added by a reload
+	mqttAuth.Replace(auth)
+	hooks.OnBasicAuth = mqttAuth.OnBasicAuth
+	hooks.OnSubscribe = mqttAuth.OnSubscribe
+	listeners := []net.Listener{ln}
+	var wsServers []*server.WsServer
+	if cfg.MQTT.WsAddr != "" {
+		wsServers = append(wsServers, &server.WsServer{
+			Server: &http.Server{Addr: cfg.MQTT.WsAddr},
+			Path:   cfg.MQTT.WsPath,
+		})
+	}
+	if cfg.MQTT.TLSAddr != "" || cfg.MQTT.WssAddr != "" {
+		tlsConfig, err := broker.TLSConfig(cfg.MQTT.TLS.Cert, cfg.MQTT.TLS.Key, cfg.MQTT.TLS.CA)
+		if err != nil {
+			logger.Fatal(err.Error())
+			return
+		}
+		if cfg.MQTT.TLSAddr != "" {
+			tlsLn, err := tls.Listen("tcp", cfg.MQTT.TLSAddr, tlsConfig)
+			if err != nil {
+				logger.Fatal(err.Error())
+				return
+			}
+			listeners = append(listeners, tlsLn)
+		}
+		if cfg.MQTT.WssAddr != "" {
+			// gMQTT loads the certificate again, the config only brings the client CA
+			wsServers = append(wsServers, &server.WsServer{
+				Server:   &http.Server{Addr: cfg.MQTT.WssAddr, TLSConfig: tlsConfig.Clone()},
+				Path:     cfg.MQTT.WsPath,
+				CertFile: cfg.MQTT.TLS.Cert,
+				KeyFile:  cfg.MQTT.TLS.Key,
+			})
+		}
+		if cfg.MQTT.TLS.CA != "" {
+			hooks.OnBasicAuth = broker.CertAuthWrapper(hooks.OnBasicAuth)
+		}
+	}
+	wsACL, err := cfg.LoadWsACL()
+	if err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	wsQueue, err := newQueue("ws", cfg.Ingest.QueueSize, cfg.Ingest.WsOverflow, cfg.Ingest.SpillDir, cfg.Ingest.SpillMax<<20)
+	if err != nil {
+		logger.Fatal(err.Error())
+		return
+	}
+	dbQueue, err := newQueue("db", cfg.Ingest.QueueSize, cfg.Ingest.DBOverflow, cfg.Ingest.SpillDir, cfg.Ingest.SpillMax<<20)
 	if err != nil {
 		logger.Fatal(err.Error())
 		return
 	}
-	docs.SwaggerInfo.Host = *addrSwagger
-	db, err := model.GetDB(*mongoDBURL, *databaseName)
+	pipeline = ingest.NewPipeline(wsQueue, dbQueue)
+	prometheus.MustRegister(pipeline, mqttAuth)
+	var spool *model.Spool
+	if cfg.Store.SpoolDir != "" {
+		spool, err = model.OpenSpool(cfg.Store.SpoolDir, cfg.Store.SpoolMax<<20)
+		if err != nil {
+			logger.Fatal(err.Error())
+			return
+		}
+		prometheus.MustRegister(spool)
+	}
+	docs.SwaggerInfo.Host = cfg.HTTP.SwaggerAddr
+	store, err := model.OpenStore(cfg.Store.Backend, cfg.Store.MongoURL, cfg.Store.Database)
 	// https://stackoverflow.com/questions/42770022/should-err-error-be-used-in-string-formatting
 	if err != nil {
 		logger.Fatal(err.Error())
 		return
 	}
+	ensureIndexes(store, routes.Collections())
 
 	// gMQTT server
+	brokerConfig := gmqttconfig.DefaultConfig()
+	brokerConfig.MQTT = cfg.MQTT.Broker
+	// the plugin registers the broker metrics, served by /metrics along with ours.
+	// It also serves them on its own listener, which is kept out of the way.
+	brokerConfig.Plugins[gmqttprom.Name] = &gmqttprom.Config{ListenAddress: "127.0.0.1:0", Path: "/metrics"}
+	brokerConfig.PluginOrder = []string{gmqttprom.Name}
 	s := server.New(
-		server.WithTCPListener(ln),
+		server.WithTCPListener(listeners...),
+		server.WithWebsocketServer(wsServers...),
 		server.WithHook(hooks),
-		server.WithLogger(l.L),
-		server.WithConfig(config.DefaultConfig()),
+		server.WithLogger(l.Component(l.Broker)),
+		server.WithConfig(brokerConfig),
 	)
 
-	// handle MongoDB message
-	go model.HandleMQTTtoDB(mqttToDB, db)
-
-	// start gin server
+	// handle database message
+	dbDone := make(chan struct{})
 	go func() {
-		hub := utils.NewWsHub(mqttToWs)
-		go hub.Run()
-		r := gin.New()
-		// Config zap logger for gin
-		r.Use(ginzap.Ginzap(l.L, time.RFC3339, true))
-		r.Use(ginzap.RecoveryWithZap(l.L, true))
-		r.Use(cors.Default())
-		// WebSocket Path
-		r.GET(*websocketPath, func(c *gin.Context) {
-			utils.ServeWs(hub, c.Writer, c.Request)
-		})
+		model.HandleMQTTtoDB(dbQueue.C(), store, routeTable, cfg.Store.Batch, spool)
+		close(dbDone)
+	}()
+	// delete the records older than the retention of their route, stopped before the store is closed
+	purger := model.NewPurger(store, routeTable, cfg.Store.PurgeInterval)
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	purgeDone := make(chan struct{})
+	go func() {
+		purger.Run(purgeCtx)
+		close(purgeDone)
+	}()
 
-		r.GET("/temperature",
-			func(c *gin.Context) {
-				ctrl.HandleQueryByPage(c, "temperature", db)
-			})
-		r.GET("/humidity", func(c *gin.Context) {
-			ctrl.HandleQueryByPage(c, "humidity", db)
-		})
-		r.POST("/temperature", func(c *gin.Context) {
-			ctrl.HandleQuery(c, "temperature", db)
+	// publishing is only allowed by the ACL, which may be replaced by a reload
+	hub := utils.NewWsHub(wsQueue.C(), newPublisher(s), wsACL)
+	go hub.Run()
+	reloader := newReloader(source, cfg, store, routeTable, mqttAuth, hub, purger)
+	checker := health.NewChecker(readyTimeout)
+	checker.Add("mqtt", dialCheck(cfg.MQTT.Addr))
+	if cfg.MQTT.TLSAddr != "" {
+		checker.Add("mqtts", dialCheck(cfg.MQTT.TLSAddr))
+	}
+	checker.Add("store", store.Ping)
+	checker.Add("hub", hub.Ping)
+	checker.Add("ingest", queuesCheck)
+	r := gin.New()
+	// Config zap logger for gin
+	r.Use(ginzap.Ginzap(l.Component(l.HTTP), time.RFC3339, true))
+	r.Use(ginzap.RecoveryWithZap(l.Component(l.HTTP), true))
+	r.Use(cors.Default())
+	// WebSocket Path
+	r.GET(cfg.Websocket.Path, func(c *gin.Context) {
+		utils.ServeWs(hub, c.Writer, c.Request)
+	})
+
+	// One pair of query routes for each collection in the routing table at startup
+	for _, collection := range routes.Collections() {
+		collection := collection
+		r.GET("/"+collection, func(c *gin.Context) {
+			ctrl.HandleQueryByPage(c, collection, store)
 		})
-		r.POST("/humidity", func(c *gin.Context) {
-			ctrl.HandleQuery(c, "humidity", db)
+		r.POST("/"+collection, func(c *gin.Context) {
+			ctrl.HandleQuery(c, collection, store)
 		})
-		// Swagger in Gin
-		// hostname:port/swagger/index.html
-		r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-		r.Run(*addrHTTP)
+	}
+	r.GET("/topics", func(c *gin.Context) {
+		ctrl.HandleTopics(c, store, routeTable.Load())
+	})
+	r.GET("/topics/*path", func(c *gin.Context) {
+		switch path := c.Param("path"); {
+		case strings.HasSuffix(path, "/aggregate"):
+			ctrl.HandleTopicAggregate(c, store, routeTable.Load())
+		case strings.HasSuffix(path, "/export"):
+			ctrl.HandleTopicExport(c, store, routeTable.Load())
+		default:
+			ctrl.HandleTopicRecords(c, store, routeTable.Load())
+		}
+	})
+	// the import writes any record to the routed collections, it's forbidden without the admin token
+	r.POST("/topics/*path", ctrl.AdminAuth(cfg.HTTP.AdminToken), func(c *gin.Context) {
+		ctrl.HandleTopicImport(c, store, routeTable.Load())
+	})
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/healthz", func(c *gin.Context) {
+		ctrl.HandleHealthz(c, started)
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		ctrl.HandleReadyz(c, checker)
+	})
+	if cfg.HTTP.AdminToken == "" {
+		logger.Warn("http.admin_token is not set, the /admin and import endpoints are disabled")
+	}
+	admin := r.Group("/admin", ctrl.AdminAuth(cfg.HTTP.AdminToken))
+	admin.POST("/reload", func(c *gin.Context) {
+		ctrl.HandleReload(c, reloader.reload)
+	})
+	admin.GET("/collections", func(c *gin.Context) {
+		ctrl.HandleCollections(c, store, routeTable.Load())
+	})
+	// Swagger in Gin
+	// hostname:port/swagger/index.html
+	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+
+	// start gin server
+	httpServer := &http.Server{Addr: cfg.HTTP.Addr, Handler: r}
+	go func() {
+		logger.Infof("HTTP server listening on %s", cfg.HTTP.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal(err.Error())
+		}
+	}()
+
+	go func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		for range hangup {
+			logger.Info("received SIGHUP, reloading the configuration")
+			if _, err := reloader.reload(); err != nil {
+				logger.Errorf("configuration not reloaded: %v", err)
+			}
+		}
 	}()
 
 	// Waiting for stop signal from OS
+	// the deadline covers the whole shutdown, not only the MQTT server
+	stopping := make(chan time.Time, 1)
 	go func() {
 		signalCh := make(chan os.Signal, 1)
 		signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
-		<-signalCh
-		s.Stop(context.Background())
+		sig := <-signalCh
+		logger.Infof("received %v, shutting down within %v", sig, cfg.HTTP.ShutdownTimeout)
+		deadline := time.Now().Add(cfg.HTTP.ShutdownTimeout)
+		stopping <- deadline
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		s.Stop(ctx)
 	}()
 	// start gMQTT server in main goroutine
 	err = s.Run()
+	var deadline time.Time
+	select {
+	case deadline = <-stopping:
+	default:
+		deadline = time.Now().Add(cfg.HTTP.ShutdownTimeout)
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	shutdown(ctx, httpServer, hub, dbDone)
+	cancel()
+	stopPurge()
+	<-purgeDone
+	if spool != nil {
+		spool.Close()
+	}
+	store.Close()
 	if err != nil {
 		panic(err)
 	}
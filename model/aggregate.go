@@ -0,0 +1,273 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Aggregation functions
+const (
+	AggMin    = "min"
+	AggMax    = "max"
+	AggAvg    = "avg"
+	AggSum    = "sum"
+	AggCount  = "count"
+	AggFirst  = "first"
+	AggLast   = "last"
+	AggStdDev = "stddev"
+)
+
+// AggregateFuncs lists the aggregation functions
+var AggregateFuncs = []string{AggMin, AggMax, AggAvg, AggSum, AggCount, AggFirst, AggLast, AggStdDev}
+
+// MaxBuckets is the largest number of buckets an aggregation may span
+const MaxBuckets = 10000
+
+// AggregateQuery describes the aggregation of the records of a collection over time buckets.
+// The buckets are aligned on the Unix epoch, so 1d buckets start at midnight UTC.
+type AggregateQuery struct {
+	Start time.Time
+	End   time.Time
+	// Bucket is the duration of a bucket, at least a second
+	Bucket time.Duration
+	// Funcs are the aggregation functions to compute, see AggregateFuncs
+	Funcs []string
+	// Field aggregates a named field of the records instead of their payload,
+	// the records without this field are ignored
+	Field string
+	// Time is the timestamp the records are bucketed on, see Query
+	Time   string
+	Filter RecordFilter
+}
+
+// Bucket holds the aggregated values of the records of a time bucket.
+// Only the requested functions are set.
+type Bucket struct {
+	// Start of the bucket. Time RFC3339
+	Start  time.Time `json:"start" example:"2020-01-01T00:00:00Z"`
+	Min    *float64  `json:"min,omitempty" example:"21.5"`
+	Max    *float64  `json:"max,omitempty" example:"24.23"`
+	Avg    *float64  `json:"avg,omitempty" example:"22.8"`
+	Sum    *float64  `json:"sum,omitempty" example:"1368"`
+	Count  *int64    `json:"count,omitempty" example:"60"`
+	First  *float64  `json:"first,omitempty" example:"21.5"`
+	Last   *float64  `json:"last,omitempty" example:"24.23"`
+	StdDev *float64  `json:"stddev,omitempty" example:"0.7"`
+}
+
+// ParseBucket parses a bucket size, a Go duration like 15m or 1h, or a number of days or weeks like 1d or 1w
+func ParseBucket(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if n := len(s); n > 1 && (s[n-1] == 'd' || s[n-1] == 'w') {
+		var count int64
+		count, err = strconv.ParseInt(s[:n-1], 10, 32)
+		d = time.Duration(count) * 24 * time.Hour
+		if s[n-1] == 'w' {
+			d *= 7
+		}
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid bucket %q, expect e.g. 1m, 1h or 1d", s)
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid bucket %q, expect a whole number of seconds", s)
+	}
+	return d, nil
+}
+
+// ParseAggregateFuncs parses a comma separated list of aggregation functions
+func ParseAggregateFuncs(s string) ([]string, error) {
+	var funcs []string
+	seen := make(map[string]bool)
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" || seen[f] {
+			continue
+		}
+		if !isAggregateFunc(f) {
+			return nil, fmt.Errorf("unknown function %q, expect %s", f, strings.Join(AggregateFuncs, ", "))
+		}
+		seen[f] = true
+		funcs = append(funcs, f)
+	}
+	if len(funcs) == 0 {
+		return nil, fmt.Errorf("no function, expect some of %s", strings.Join(AggregateFuncs, ", "))
+	}
+	return funcs, nil
+}
+
+func isAggregateFunc(f string) bool {
+	for _, known := range AggregateFuncs {
+		if f == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the time range, the bucket, the functions and the field
+func (q *AggregateQuery) Validate() error {
+	if q.Start.IsZero() || q.End.IsZero() {
+		return fmt.Errorf("start and end are required")
+	}
+	if !q.End.After(q.Start) {
+		return fmt.Errorf("end must be after start")
+	}
+	if q.Bucket < time.Second {
+		return fmt.Errorf("bucket must be at least 1s")
+	}
+	if n := q.End.Sub(q.Start) / q.Bucket; n > MaxBuckets {
+		return fmt.Errorf("the range spans %d buckets, the most is %d", n, MaxBuckets)
+	}
+	if len(q.Funcs) == 0 {
+		return fmt.Errorf("no function")
+	}
+	for _, f := range q.Funcs {
+		if !isAggregateFunc(f) {
+			return fmt.Errorf("unknown function %q", f)
+		}
+	}
+	if strings.ContainsAny(q.Field, ".$\"") {
+		return fmt.Errorf("invalid field %q", q.Field)
+	}
+	return nil
+}
+
+// has reports whether the function f is requested
+func (q *AggregateQuery) has(f string) bool {
+	for _, requested := range q.Funcs {
+		if requested == f {
+			return true
+		}
+	}
+	return false
+}
+
+// records returns the query of the aggregated records
+func (q *AggregateQuery) records() Query {
+	return Query{Start: q.Start, End: q.End, Time: q.Time, Filter: q.Filter}
+}
+
+// value returns the aggregated value of the record, false if it has none
+func (q *AggregateQuery) value(r *MQTTRecord) (float64, bool) {
+	if q.Field == "" {
+		return r.Payload, true
+	}
+	v, ok := r.Fields[q.Field]
+	return v, ok
+}
+
+// bucketStart returns the start of the bucket of t
+func (q *AggregateQuery) bucketStart(t time.Time) time.Time {
+	ms := q.Bucket.Milliseconds()
+	return time.UnixMilli(t.UnixMilli() - t.UnixMilli()%ms).UTC()
+}
+
+// bucketStats accumulates the values of a bucket, they're added by ascending timestamp
+type bucketStats struct {
+	start           time.Time
+	count           int64
+	min, max        float64
+	sum, sumSquares float64
+	first, last     float64
+}
+
+func (s *bucketStats) add(v float64) {
+	if s.count == 0 {
+		s.min, s.max, s.first = v, v, v
+	}
+	s.count++
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+	s.sum += v
+	s.sumSquares += v * v
+	s.last = v
+}
+
+// bucket returns the requested functions of the stats
+func (s *bucketStats) bucket(q *AggregateQuery) Bucket {
+	avg := s.sum / float64(s.count)
+	stddev := populationStdDev(s.count, s.sum, s.sumSquares)
+	return newBucket(q, s.start, map[string]float64{
+		AggMin:    s.min,
+		AggMax:    s.max,
+		AggAvg:    avg,
+		AggSum:    s.sum,
+		AggCount:  float64(s.count),
+		AggFirst:  s.first,
+		AggLast:   s.last,
+		AggStdDev: stddev,
+	})
+}
+
+// populationStdDev computes the standard deviation of count values from their sum and the sum of their squares
+func populationStdDev(count int64, sum, sumSquares float64) float64 {
+	n := float64(count)
+	variance := sumSquares/n - (sum/n)*(sum/n)
+	// rounding errors
+	if variance < 0 {
+		variance = 0
+	}
+	return math.Sqrt(variance)
+}
+
+// newBucket keeps the requested functions of values
+func newBucket(q *AggregateQuery, start time.Time, values map[string]float64) Bucket {
+	b := Bucket{Start: start}
+	for _, f := range q.Funcs {
+		v := values[f]
+		switch f {
+		case AggMin:
+			b.Min = &v
+		case AggMax:
+			b.Max = &v
+		case AggAvg:
+			b.Avg = &v
+		case AggSum:
+			b.Sum = &v
+		case AggCount:
+			count := int64(v)
+			b.Count = &count
+		case AggFirst:
+			b.First = &v
+		case AggLast:
+			b.Last = &v
+		case AggStdDev:
+			b.StdDev = &v
+		}
+	}
+	return b
+}
+
+// aggregate computes the buckets of records, which don't need to be sorted
+func aggregate(q *AggregateQuery, records []MQTTRecord) []Bucket {
+	rq := q.records()
+	sort.SliceStable(records, func(i, j int) bool {
+		return rq.less(&records[i], &records[j])
+	})
+	var stats []*bucketStats
+	for i := range records {
+		v, ok := q.value(&records[i])
+		t, hasTime := rq.timeOf(&records[i])
+		if !ok || !hasTime {
+			continue
+		}
+		start := q.bucketStart(t)
+		if len(stats) == 0 || !stats[len(stats)-1].start.Equal(start) {
+			stats = append(stats, &bucketStats{start: start})
+		}
+		stats[len(stats)-1].add(v)
+	}
+	buckets := make([]Bucket, len(stats))
+	for i, s := range stats {
+		buckets[i] = s.bucket(q)
+	}
+	return buckets
+}
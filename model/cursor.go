@@ -0,0 +1,93 @@
+package model
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxLimit is the largest number of records a query may return at once
+const MaxLimit = 1000
+
+// Cursor is the position of a record in the (timestamp, id) order of a query,
+// the timestamp being the one the query sorts on.
+// Clients get it as an opaque string, see EncodeCursor.
+type Cursor struct {
+	Timestamp time.Time
+	ID        primitive.ObjectID
+}
+
+// cursorSize is the size of an encoded cursor: the Unix nanoseconds then the ID
+const cursorSize = 8 + 12
+
+// EncodeCursor returns the opaque string of the cursor
+func EncodeCursor(c Cursor) string {
+	var b [cursorSize]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(c.Timestamp.UnixNano()))
+	copy(b[8:], c.ID[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// ParseCursor decodes a cursor returned by EncodeCursor
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != cursorSize {
+		return nil, fmt.Errorf("invalid cursor %q", s)
+	}
+	c := &Cursor{Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))}
+	copy(c.ID[:], b[8:])
+	return c, nil
+}
+
+// NextCursor returns the cursor of the page following records, the page of the query on the collection.
+// It's empty if records is the last page: a full page only gets a cursor if a record follows it,
+// so the cursor never leads to an empty page.
+func NextCursor(store Store, collection string, records []MQTTRecord, q Query) (string, error) {
+	if len(records) == 0 || int64(len(records)) < q.limit() {
+		return "", nil
+	}
+	last := q.cursor(&records[len(records)-1])
+	probe := q
+	probe.After, probe.Page, probe.Limit = &last, 0, 1
+	following, err := store.GetRecords(collection, probe)
+	if err != nil || len(following) == 0 {
+		return "", err
+	}
+	return EncodeCursor(last), nil
+}
+
+// cursor returns the position of the record in the order of the query
+func (q *Query) cursor(r *MQTTRecord) Cursor {
+	t, _ := q.timeOf(r)
+	return Cursor{Timestamp: t, ID: r.ID}
+}
+
+// follows reports whether the record comes after the cursor in the order of the query
+func (q *Query) follows(r *MQTTRecord) bool {
+	if q.After == nil {
+		return true
+	}
+	c := q.cursor(r)
+	if q.IsDescend {
+		return c.before(q.After)
+	}
+	return q.After.before(&c)
+}
+
+// less reports whether a comes before b in the ascending (timestamp, id) order of the query
+func (q *Query) less(a, b *MQTTRecord) bool {
+	ca, cb := q.cursor(a), q.cursor(b)
+	return ca.before(&cb)
+}
+
+// before reports whether c comes before other in the ascending (timestamp, id) order
+func (c *Cursor) before(other *Cursor) bool {
+	if !c.Timestamp.Equal(other.Timestamp) {
+		return c.Timestamp.Before(other.Timestamp)
+	}
+	return bytes.Compare(c.ID[:], other.ID[:]) < 0
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursors := []Cursor{
+		{Timestamp: base, ID: primitive.NewObjectID()},
+		{Timestamp: base.Add(123456789 * time.Nanosecond), ID: primitive.NewObjectID()},
+		{Timestamp: time.Unix(0, 0), ID: primitive.NilObjectID},
+		{Timestamp: time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC), ID: primitive.NewObjectID()},
+	}
+	for _, c := range cursors {
+		s := EncodeCursor(c)
+		parsed, err := ParseCursor(s)
+		if err != nil {
+			t.Errorf("%v: %v", c, err)
+			continue
+		}
+		if !parsed.Timestamp.Equal(c.Timestamp) || parsed.ID != c.ID {
+			t.Errorf("%s: got %v, want %v", s, parsed, c)
+		}
+	}
+	valid := EncodeCursor(cursors[0])
+	for _, s := range []string{"", "not base64!", valid[:len(valid)-2], valid + "AA"} {
+		if _, err := ParseCursor(s); err == nil {
+			t.Errorf("%q: invalid cursor accepted", s)
+		}
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	low, high := primitive.NewObjectID(), primitive.NewObjectID()
+	early := &MQTTRecord{ID: high, Timestamp: base}
+	tieLow := &MQTTRecord{ID: low, Timestamp: base.Add(time.Second)}
+	tieHigh := &MQTTRecord{ID: high, Timestamp: base.Add(time.Second)}
+	measured := base.Add(-time.Hour)
+	late := &MQTTRecord{ID: low, Timestamp: base.Add(time.Minute), MeasuredAt: &measured}
+
+	received := &Query{}
+	tests := []struct {
+		name string
+		q    *Query
+		a, b *MQTTRecord
+		less bool
+	}{
+		{"earlier", received, early, tieLow, true},
+		{"later", received, tieLow, early, false},
+		{"same time, lower id", received, tieLow, tieHigh, true},
+		{"same time, higher id", received, tieHigh, tieLow, false},
+		{"same record", received, tieLow, tieLow, false},
+		{"measured time", &Query{Time: TimeMeasured}, late, late, false},
+	}
+	for _, tt := range tests {
+		if got := tt.q.less(tt.a, tt.b); got != tt.less {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.less)
+		}
+	}
+
+	after := received.cursor(tieLow)
+	follows := []struct {
+		name string
+		q    Query
+		r    *MQTTRecord
+		want bool
+	}{
+		{"no cursor", Query{}, early, true},
+		{"ascending, the cursor itself", Query{After: &after}, tieLow, false},
+		{"ascending, same time, higher id", Query{After: &after}, tieHigh, true},
+		{"ascending, earlier", Query{After: &after}, early, false},
+		{"ascending, later", Query{After: &after}, late, true},
+		{"descending, the cursor itself", Query{After: &after, IsDescend: true}, tieLow, false},
+		{"descending, same time, higher id", Query{After: &after, IsDescend: true}, tieHigh, false},
+		{"descending, earlier", Query{After: &after, IsDescend: true}, early, true},
+		{"descending, later", Query{After: &after, IsDescend: true}, late, false},
+	}
+	for _, tt := range follows {
+		if got := tt.q.follows(tt.r); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// tiedRecords are 7 records, 5 of them with the same timestamp
+func tiedRecords() []MQTTRecord {
+	records := []MQTTRecord{testRecord("a", "s1", 0)}
+	for i := 1; i <= 5; i++ {
+		r := testRecord("a", "s1", i)
+		r.Timestamp = base.Add(time.Minute)
+		records = append(records, r)
+	}
+	return append(records, testRecord("a", "s1", 6))
+}
+
+func TestCursorPaging(t *testing.T) {
+	for name, store := range testStores(t) {
+		if err := store.CreateRecords("c", tiedRecords()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, descend := range []bool{false, true} {
+			want := []float64{0, 1, 2, 3, 4, 5, 6}
+			if descend {
+				want = []float64{6, 5, 4, 3, 2, 1, 0}
+			}
+			// 7 records split by 3, 2 and 7: the last page is partial, full or the only one
+			for _, limit := range []int64{3, 2, 7} {
+				var got []float64
+				q := Query{Limit: limit, IsDescend: descend}
+				for pages := 0; ; pages++ {
+					if pages > len(want) {
+						t.Fatalf("%s: limit %d: the pages don't end", name, limit)
+					}
+					records, err := store.GetRecords("c", q)
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+					if len(records) == 0 {
+						t.Errorf("%s: descend %v, limit %d: empty page", name, descend, limit)
+					}
+					got = append(got, payloads(records)...)
+					next, err := NextCursor(store, "c", records, q)
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+					if next == "" {
+						break
+					}
+					if q.After, err = ParseCursor(next); err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+				}
+				if !equalFloats(got, want) {
+					t.Errorf("%s: descend %v, limit %d: got %v, want %v", name, descend, limit, got, want)
+				}
+			}
+		}
+	}
+}
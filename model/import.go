@@ -0,0 +1,381 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Import formats
+const (
+	ImportCSV    = "csv"
+	ImportNDJSON = "ndjson"
+)
+
+// importBatch is the number of records written at once by Import
+const importBatch = 1000
+
+// MaxImportErrors is the number of row errors an ImportReport holds, the next ones are only counted
+const MaxImportErrors = 100
+
+// ImportReport tells what Import did with the rows
+type ImportReport struct {
+	// Valid rows, stored once even if they were imported before
+	Accepted int64 `json:"accepted" example:"8759"`
+	Rejected int64 `json:"rejected" example:"1"`
+	// The first 100 row errors
+	Errors []RowError `json:"errors"`
+}
+
+// RowError tells why a row was rejected
+type RowError struct {
+	// Line of the row in the file, from 1
+	Line  int64  `json:"line" example:"42"`
+	Error string `json:"error" example:"timestamp: missing"`
+}
+
+func (r *ImportReport) reject(line int64, err error) {
+	r.Rejected++
+	if len(r.Errors) < MaxImportErrors {
+		r.Errors = append(r.Errors, RowError{Line: line, Error: err.Error()})
+	}
+}
+
+// ParseImportFormat checks the name of an import format
+func ParseImportFormat(name string) (string, error) {
+	switch name = strings.ToLower(name); name {
+	case ImportCSV, ImportNDJSON:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown import format %q, expect csv or ndjson", name)
+}
+
+// importID derives the ID of an imported record from its topic, timestamp and device,
+// so importing a row twice stores it once
+func importID(topic string, timestamp time.Time, clientID string) primitive.ObjectID {
+	var id primitive.ObjectID
+	// like a generated ObjectID, the ID starts with the time in seconds
+	binary.BigEndian.PutUint32(id[:4], uint32(timestamp.Unix()))
+	sum := sha256.Sum256([]byte(topic + "\x00" + strconv.FormatInt(timestamp.UnixNano(), 10) + "\x00" + clientID))
+	copy(id[4:], sum[:])
+	return id
+}
+
+// importRow is a row of an imported file, the missing columns are nil
+type importRow struct {
+	Topic     *string            `json:"topic"`
+	Timestamp json.RawMessage    `json:"timestamp"`
+	Payload   *float64           `json:"payload"`
+	Fields    map[string]float64 `json:"fields"`
+	ClientID  string             `json:"client_id"`
+	Username  string             `json:"username"`
+	QoS       uint8              `json:"qos"`
+	Retain    bool               `json:"retain"`
+	PacketID  uint16             `json:"packet_id"`
+	// Time the device measured the reading, optional
+	MeasuredAt json.RawMessage `json:"measured_at"`
+	// ID of the exported records, ignored
+	ID string `json:"id"`
+}
+
+// record validates the row and returns its record
+func (row *importRow) record(topic string) (MQTTRecord, error) {
+	if row.Topic != nil && *row.Topic != "" && *row.Topic != topic {
+		return MQTTRecord{}, fmt.Errorf("topic: %s is not the imported topic %s", *row.Topic, topic)
+	}
+	timestamp, err := parseRowTime(row.Timestamp)
+	if err != nil {
+		return MQTTRecord{}, fmt.Errorf("timestamp: %w", err)
+	}
+	var measuredAt *time.Time
+	if len(row.MeasuredAt) > 0 && string(row.MeasuredAt) != "null" && string(row.MeasuredAt) != `""` {
+		t, err := parseRowTime(row.MeasuredAt)
+		if err != nil {
+			return MQTTRecord{}, fmt.Errorf("measured_at: %w", err)
+		}
+		measuredAt = &t
+	}
+	if row.Payload == nil && len(row.Fields) == 0 {
+		return MQTTRecord{}, fmt.Errorf("payload: missing, and there are no fields")
+	}
+	// the stores can't hold NaN nor the infinities, JSON numbers can't be any of them
+	if row.Payload != nil && !isFinite(*row.Payload) {
+		return MQTTRecord{}, fmt.Errorf("payload: %v is not a finite number", *row.Payload)
+	}
+	if row.QoS > 2 {
+		return MQTTRecord{}, fmt.Errorf("qos: %d is not 0, 1 or 2", row.QoS)
+	}
+	r := MQTTRecord{
+		ID:         importID(topic, timestamp, row.ClientID),
+		Topic:      topic,
+		Fields:     row.Fields,
+		Timestamp:  timestamp,
+		MeasuredAt: measuredAt,
+		ClientID:   row.ClientID,
+		Username:   row.Username,
+		QoS:        row.QoS,
+		Retain:     row.Retain,
+		PacketID:   row.PacketID,
+	}
+	if row.Payload != nil {
+		r.Payload = *row.Payload
+	}
+	return r, nil
+}
+
+// parseRowTime parses a time of a row, a JSON string or number
+func parseRowTime(value json.RawMessage) (time.Time, error) {
+	var text string
+	if err := json.Unmarshal(value, &text); err != nil {
+		// a number
+		text = string(value)
+	}
+	return ParseTimestamp(text)
+}
+
+// rowReader reads the rows of a file, its errors are row errors unless they're io.EOF or a *FileError
+type rowReader interface {
+	// Read returns the next row and its line
+	Read() (*importRow, int64, error)
+}
+
+// FileError is returned by Import when the file can't be read at all, e.g. its CSV header is invalid
+type FileError struct {
+	Err error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Import validates the rows of a CSV or NDJSON file and writes them to the collection of the topic.
+// The CSV columns are the ones written by the export, timestamp being required, and device is an alias of client_id.
+// The NDJSON rows have the keys of the JSON records. The timestamps are RFC3339 times, Unix seconds or milliseconds.
+// Invalid rows are reported and skipped, the rows of a failed write are reported as rejected.
+func Import(store Store, collection, topic, format string, r io.Reader) (*ImportReport, error) {
+	var rows rowReader
+	var err error
+	switch format {
+	case ImportCSV:
+		rows, err = newCSVRows(r)
+	case ImportNDJSON:
+		rows = newNDJSONRows(r)
+	default:
+		err = fmt.Errorf("unknown import format %q", format)
+	}
+	if err != nil {
+		return nil, &FileError{Err: err}
+	}
+
+	report := &ImportReport{Errors: make([]RowError, 0)}
+	batch := make([]MQTTRecord, 0, importBatch)
+	lines := make([]int64, 0, importBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := createRecords(store, collection, batch)
+		var batchErr *BatchError
+		switch {
+		case err == nil:
+			report.Accepted += int64(len(batch))
+		case errors.As(err, &batchErr):
+			report.Accepted += int64(len(batch) - len(batchErr.Failed))
+			for _, i := range batchErr.Failed {
+				report.reject(lines[i], batchErr.Err)
+			}
+		default:
+			return err
+		}
+		batch, lines = batch[:0], lines[:0]
+		return nil
+	}
+	for {
+		row, line, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		var fileErr *FileError
+		if errors.As(err, &fileErr) {
+			return report, err
+		}
+		if err == nil {
+			var record MQTTRecord
+			if record, err = row.record(topic); err == nil {
+				batch = append(batch, record)
+				lines = append(lines, line)
+			}
+		}
+		if err != nil {
+			report.reject(line, err)
+			continue
+		}
+		if len(batch) == importBatch {
+			if err = flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, flush()
+}
+
+// csvColumns are the columns of the imported CSV files
+var csvColumns = map[string]bool{
+	"id": true, "topic": true, "timestamp": true, "payload": true, "client_id": true,
+	"username": true, "qos": true, "retain": true, "packet_id": true, "fields": true, "measured_at": true,
+}
+
+type csvRows struct {
+	r *csv.Reader
+	// index of each column
+	columns map[string]int
+}
+
+func newCSVRows(r io.Reader) (*csvRows, error) {
+	cr := csv.NewReader(r)
+	// the rows are checked by their columns
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty file, expect a CSV header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "device" {
+			name = "client_id"
+		}
+		if !csvColumns[name] {
+			return nil, fmt.Errorf("unknown column %q, expect id, topic, timestamp, payload, client_id (or device), "+
+				"username, qos, retain, packet_id, fields and measured_at", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["timestamp"]; !ok {
+		return nil, fmt.Errorf("the timestamp column is required")
+	}
+	return &csvRows{r: cr, columns: columns}, nil
+}
+
+func (c *csvRows) Read() (*importRow, int64, error) {
+	values, err := c.r.Read()
+	if err == io.EOF {
+		return nil, 0, err
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, int64(parseErr.StartLine), err
+	}
+	if err != nil {
+		return nil, 0, &FileError{Err: err}
+	}
+	// FieldPos panics unless the row was read
+	line, _ := c.r.FieldPos(0)
+	if len(values) != len(c.columns) {
+		return nil, int64(line), fmt.Errorf("%d columns instead of %d", len(values), len(c.columns))
+	}
+	row := &importRow{}
+	value := func(column string) (string, bool) {
+		i, ok := c.columns[column]
+		if !ok || values[i] == "" {
+			return "", false
+		}
+		return values[i], true
+	}
+	if topic, ok := value("topic"); ok {
+		row.Topic = &topic
+	}
+	timestamp, _ := value("timestamp")
+	row.Timestamp = json.RawMessage(strconv.Quote(timestamp))
+	if measuredAt, ok := value("measured_at"); ok {
+		row.MeasuredAt = json.RawMessage(strconv.Quote(measuredAt))
+	}
+	if s, ok := value("payload"); ok {
+		payload, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, int64(line), fmt.Errorf("payload: invalid number %q", s)
+		}
+		row.Payload = &payload
+	}
+	if s, ok := value("fields"); ok {
+		if err := json.Unmarshal([]byte(s), &row.Fields); err != nil {
+			return nil, int64(line), fmt.Errorf("fields: expect a JSON object of numbers: %v", err)
+		}
+	}
+	row.ClientID, _ = value("client_id")
+	row.Username, _ = value("username")
+	if s, ok := value("qos"); ok {
+		qos, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return nil, int64(line), fmt.Errorf("qos: invalid number %q", s)
+		}
+		row.QoS = uint8(qos)
+	}
+	if s, ok := value("retain"); ok {
+		if row.Retain, err = strconv.ParseBool(s); err != nil {
+			return nil, int64(line), fmt.Errorf("retain: invalid boolean %q", s)
+		}
+	}
+	if s, ok := value("packet_id"); ok {
+		id, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, int64(line), fmt.Errorf("packet_id: invalid number %q", s)
+		}
+		row.PacketID = uint16(id)
+	}
+	return row, int64(line), nil
+}
+
+// maxNDJSONLine is the longest line of an NDJSON file
+const maxNDJSONLine = 1024 * 1024
+
+type ndjsonRows struct {
+	s    *bufio.Scanner
+	line int64
+}
+
+func newNDJSONRows(r io.Reader) *ndjsonRows {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxNDJSONLine)
+	return &ndjsonRows{s: s}
+}
+
+func (n *ndjsonRows) Read() (*importRow, int64, error) {
+	for n.s.Scan() {
+		n.line++
+		content := bytes.TrimSpace(n.s.Bytes())
+		if len(content) == 0 {
+			continue
+		}
+		row := &importRow{}
+		d := json.NewDecoder(bytes.NewReader(content))
+		d.DisallowUnknownFields()
+		if err := d.Decode(row); err != nil {
+			return nil, n.line, err
+		}
+		return row, n.line, nil
+	}
+	if err := n.s.Err(); err != nil {
+		return nil, n.line + 1, &FileError{Err: err}
+	}
+	return nil, 0, io.EOF
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestImportMalformedRows(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		body     string
+		accepted int64
+		// lines of the rejected rows
+		rejected []int64
+	}{
+		{"unterminated quote", ImportCSV, "timestamp,payload\n\"abc,1\n", 0, []int64{2}},
+		{"unterminated quote after a row", ImportCSV,
+			"timestamp,payload\n2022-01-01T00:00:00Z,1\n\"abc,1\n2022-01-01T00:01:00Z,2\n", 1, []int64{3}},
+		{"bare quote", ImportCSV,
+			"timestamp,payload\n2022-01-01T00:00:00Z,1\"2\n2022-01-01T00:01:00Z,2\n", 1, []int64{2}},
+		{"missing column", ImportCSV,
+			"timestamp,payload\n2022-01-01T00:00:00Z\n2022-01-01T00:01:00Z,2\n", 1, []int64{2}},
+		{"extra column", ImportCSV,
+			"timestamp,payload\n2022-01-01T00:00:00Z,1,1\n2022-01-01T00:01:00Z,2\n", 1, []int64{2}},
+		{"invalid values", ImportCSV,
+			"timestamp,payload,qos\nnow,1,0\n2022-01-01T00:00:00Z,one,0\n2022-01-01T00:01:00Z,2,3\n" +
+				"2022-01-01T00:02:00Z,2,x\n,1,0\n2022-01-01T00:03:00Z,3,1\n", 1, []int64{2, 3, 4, 5, 6}},
+		{"non-finite payloads", ImportCSV,
+			"timestamp,payload\n2022-01-01T00:00:00Z,NaN\n2022-01-01T00:01:00Z,2\n2022-01-01T00:02:00Z,+Inf\n" +
+				"2022-01-01T00:03:00Z,-inf\n", 1, []int64{2, 4, 5}},
+		{"invalid json", ImportNDJSON,
+			"{\"timestamp\":1640995200,\"payload\":1}\n{\"timestamp\":\n{\"timestamp\":1640995260,\"other\":1}\n" +
+				"{\"timestamp\":1640995320,\"payload\":3}\n", 2, []int64{2, 3}},
+	}
+	for _, tt := range tests {
+		store := NewMemoryStore()
+		report, err := Import(store, "c", "a", tt.format, strings.NewReader(tt.body))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if report.Accepted != tt.accepted || report.Rejected != int64(len(tt.rejected)) {
+			t.Errorf("%s: got %+v, want %d accepted and %d rejected",
+				tt.name, report, tt.accepted, len(tt.rejected))
+			continue
+		}
+		for i, line := range tt.rejected {
+			if report.Errors[i].Line != line {
+				t.Errorf("%s: got errors %+v, want the lines %v", tt.name, report.Errors, tt.rejected)
+				break
+			}
+		}
+	}
+}
+
+func TestImportInvalidFile(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"empty", ""},
+		{"unknown column", "timestamp,payload,color\n2022-01-01T00:00:00Z,1,red\n"},
+		{"no timestamp", "payload\n1\n"},
+		{"malformed header", "\"timestamp,payload\n"},
+	}
+	for _, tt := range tests {
+		_, err := Import(NewMemoryStore(), "c", "a", ImportCSV, strings.NewReader(tt.body))
+		var fileErr *FileError
+		if !errors.As(err, &fileErr) {
+			t.Errorf("%s: got %v, want a FileError", tt.name, err)
+		}
+	}
+}
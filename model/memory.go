@@ -0,0 +1,199 @@
+package model
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore keeps every record in memory.
+// It's meant for running the bridge without a MongoDB server
+// and all records are lost on exit.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	collections map[string][]MQTTRecord
+	// IDs of the stored records
+	ids map[primitive.ObjectID]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		collections: make(map[string][]MQTTRecord),
+		ids:         make(map[primitive.ObjectID]bool),
+	}
+}
+
+func (s *MemoryStore) CreateRecord(collection string, data MQTTRecord) error {
+	return s.CreateRecords(collection, []MQTTRecord{data})
+}
+
+func (s *MemoryStore) CreateRecords(collection string, data []MQTTRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range data {
+		if !r.ID.IsZero() {
+			if s.ids[r.ID] {
+				continue
+			}
+			s.ids[r.ID] = true
+		}
+		s.collections[collection] = append(s.collections[collection], r)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetRecords(collection string, q Query) ([]MQTTRecord, error) {
+	s.mu.RLock()
+	var matched []MQTTRecord
+	for i := range s.collections[collection] {
+		r := &s.collections[collection][i]
+		if q.Match(r) {
+			matched = append(matched, *r)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.IsDescend {
+			return q.less(&matched[j], &matched[i])
+		}
+		return q.less(&matched[i], &matched[j])
+	})
+	skip := q.skip()
+	if skip >= int64(len(matched)) {
+		return nil, nil
+	}
+	matched = matched[skip:]
+	if int64(len(matched)) > q.limit() {
+		matched = matched[:q.limit()]
+	}
+	return matched, nil
+}
+
+func (s *MemoryStore) StreamRecords(ctx context.Context, collection string, q Query,
+	each func(r *MQTTRecord) error) error {
+	q.IsDescend, q.Page, q.Limit = false, 0, 0
+	s.mu.RLock()
+	var matched []MQTTRecord
+	for i := range s.collections[collection] {
+		r := &s.collections[collection][i]
+		if q.Match(r) {
+			matched = append(matched, *r)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return q.less(&matched[i], &matched[j])
+	})
+	for i := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := each(&matched[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetTopics(collection string) ([]TopicInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topics := make(map[string]*TopicInfo)
+	var results []TopicInfo
+	for _, r := range s.collections[collection] {
+		info, ok := topics[r.Topic]
+		if !ok {
+			info = &TopicInfo{Topic: r.Topic, Collection: collection, First: r.Timestamp, Last: r.Timestamp}
+			topics[r.Topic] = info
+		}
+		info.Count++
+		if r.Timestamp.Before(info.First) {
+			info.First = r.Timestamp
+		}
+		if r.Timestamp.After(info.Last) {
+			info.Last = r.Timestamp
+		}
+	}
+	for _, info := range topics {
+		results = append(results, *info)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Topic < results[j].Topic
+	})
+	return results, nil
+}
+
+func (s *MemoryStore) Aggregate(collection string, q AggregateQuery) ([]Bucket, error) {
+	s.mu.RLock()
+	var matched []MQTTRecord
+	rq := q.records()
+	for i := range s.collections[collection] {
+		r := &s.collections[collection][i]
+		if rq.Match(r) {
+			matched = append(matched, *r)
+		}
+	}
+	s.mu.RUnlock()
+	return aggregate(&q, matched), nil
+}
+
+func (s *MemoryStore) DeleteRecords(collection string, q Query) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := s.collections[collection]
+	kept := records[:0]
+	for i := range records {
+		if !q.Match(&records[i]) {
+			kept = append(kept, records[i])
+			continue
+		}
+		delete(s.ids, records[i].ID)
+	}
+	deleted := int64(len(records) - len(kept))
+	// let the deleted records be garbage collected
+	for i := len(kept); i < len(records); i++ {
+		records[i] = MQTTRecord{}
+	}
+	s.collections[collection] = kept
+	return deleted, nil
+}
+
+func (s *MemoryStore) Stats(collection string) (CollectionStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stats := CollectionStats{Collection: collection}
+	for i := range s.collections[collection] {
+		r := &s.collections[collection][i]
+		stats.Count++
+		stats.Size += recordSize(r)
+		if stats.Oldest == nil || r.Timestamp.Before(*stats.Oldest) {
+			oldest := r.Timestamp
+			stats.Oldest = &oldest
+		}
+	}
+	return stats, nil
+}
+
+// recordSize estimates the bytes taken by a record in memory
+func recordSize(r *MQTTRecord) int64 {
+	size := int64(len(r.Topic) + len(r.ClientID) + len(r.Username) + 96)
+	for name := range r.Fields {
+		size += int64(len(name) + 8)
+	}
+	if r.MeasuredAt != nil {
+		size += 24
+	}
+	return size
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
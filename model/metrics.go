@@ -0,0 +1,94 @@
+package model
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	insertDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "insert_duration_seconds",
+		Help:      "Time to write a batch of records to the store",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"collection"})
+	recordsInserted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "records_inserted_total",
+		Help:      "Records written to the store",
+	}, []string{"collection"})
+	insertFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "insert_failures_total",
+		Help:      "Batches the store failed to write, fully or partly",
+	}, []string{"collection"})
+	parseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "parse_failures_total",
+		Help:      "Messages whose payload couldn't be decoded by their route",
+	}, []string{"collection"})
+	measuredAtRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "measured_at_rejected_total",
+		Help:      "Messages whose device time was invalid or out of the tolerated clock skew, stored with their received time only",
+	}, []string{"collection"})
+	recordsPurged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "records_purged_total",
+		Help:      "Records deleted by the retention purge, the ones expired by MongoDB are not counted",
+	}, []string{"collection"})
+	unrouted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "store",
+		Name:      "unrouted_messages_total",
+		Help:      "Messages not persisted since no route matches their topic",
+	})
+)
+
+var (
+	spoolDepth = prometheus.NewDesc("mqttws_spool_records",
+		"Records waiting in the spool for the store", nil, nil)
+	spoolBytes = prometheus.NewDesc("mqttws_spool_bytes",
+		"Size of the records waiting in the spool", nil, nil)
+	spoolDropped = prometheus.NewDesc("mqttws_spool_dropped_total",
+		"Records dropped because the spool was full, they couldn't be encoded or the store rejected them", nil, nil)
+)
+
+func init() {
+	prometheus.MustRegister(insertDuration, recordsInserted, insertFailures, parseFailures, measuredAtRejected, recordsPurged, unrouted)
+}
+
+// createRecords writes the records to the store and measures it
+func createRecords(store Store, collection string, records []MQTTRecord) error {
+	start := time.Now()
+	err := store.CreateRecords(collection, records)
+	insertDuration.WithLabelValues(collection).Observe(time.Since(start).Seconds())
+	if err != nil {
+		insertFailures.WithLabelValues(collection).Inc()
+		return err
+	}
+	recordsInserted.WithLabelValues(collection).Add(float64(len(records)))
+	return nil
+}
+
+// Describe implements prometheus.Collector
+func (s *Spool) Describe(ch chan<- *prometheus.Desc) {
+	ch <- spoolDepth
+	ch <- spoolBytes
+	ch <- spoolDropped
+}
+
+// Collect implements prometheus.Collector with the stats of the spool
+func (s *Spool) Collect(ch chan<- prometheus.Metric) {
+	stats := s.Stats()
+	ch <- prometheus.MustNewConstMetric(spoolDepth, prometheus.GaugeValue, float64(stats.Depth))
+	ch <- prometheus.MustNewConstMetric(spoolBytes, prometheus.GaugeValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(spoolDropped, prometheus.CounterValue, float64(stats.Dropped))
+}
@@ -2,18 +2,17 @@ package model
 
 import (
 	"context"
-	"strconv"
 	"time"
 
 	l "github.com/crosstyan/mqtt-to-ws/logger"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
 	Ctx    = context.TODO()
-	logger = l.Lsugar
+	logger = l.For(l.Store)
+	// messageLogger logs the messages which can't be parsed, it's sampled
+	messageLogger = l.Sampled(l.Store)
 )
 
 const (
@@ -23,132 +22,123 @@ const (
 type MQTTMsg struct {
 	Topic   string `json:"topic" example:"temperature"`
 	Payload string `json:"payload" example:"23.5"`
+	// ClientID of the device which published the message
+	ClientID string `json:"client_id" example:"sensor-01"`
+	// Username used by the device when connecting to the broker
+	Username string `json:"username" example:"sensor"`
+	QoS      uint8  `json:"qos" example:"1"`
+	Retain   bool   `json:"retain" example:"false"`
+	// PacketID is always 0 for QoS 0 messages
+	PacketID uint16 `json:"packet_id" example:"1"`
+	// ReceivedAt is the time the broker received the message, RFC3339
+	ReceivedAt time.Time `json:"received_at" example:"2020-01-01T00:00:00Z"`
+	// MQTT v5 user properties, the first value of each key
+	Properties map[string]string `json:"properties,omitempty"`
 }
 
-func (m *MQTTMsg) ToRecord() (MQTTRecord, error) {
-	payload, err := strconv.ParseFloat(m.Payload, 32)
+// ToRecord decodes the payload of the message with the decoder of its route.
+// The timestamp of the record is the time the message was received, not the time it left its queue,
+// so the records of a queued or spilled message aren't shifted. It's the decoding time only if unknown.
+func (m *MQTTMsg) ToRecord(d Decoder) (MQTTRecord, error) {
+	payload, fields, err := d.Decode(m.Payload)
+	timestamp := m.ReceivedAt
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
 	return MQTTRecord{
+		ID:        primitive.NewObjectID(),
+		Topic:     m.Topic,
 		Payload:   payload,
-		Timestamp: time.Now(),
+		Fields:    fields,
+		Timestamp: timestamp,
+		ClientID:  m.ClientID,
+		Username:  m.Username,
+		QoS:       m.QoS,
+		Retain:    m.Retain,
+		PacketID:  m.PacketID,
 	}, err
 }
 
 type MQTTRecord struct {
+	// ID identifies the record, writing a record twice doesn't duplicate it
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id" swaggertype:"string" example:"61d0a3c8e4b0f2a1b2c3d4e5"`
+	// Topic is empty for records persisted before topic routing,
+	// they were always stored in the collection named after their topic
+	Topic   string  `bson:"topic" json:"topic" example:"site1/room3/temperature"`
 	Payload float64 `bson:"payload" json:"payload" example:"24.23"`
-	// Time RFC3339
+	// Named values of structured payloads, see PayloadConfig
+	Fields map[string]float64 `bson:"fields,omitempty" json:"fields,omitempty"`
+	// Time the bridge received the message (received_at). Time RFC3339
 	Timestamp time.Time `bson:"timestamp" json:"timestamp" example:"2020-01-01T00:00:00Z"`
+	// Time the device measured the reading, if its route tells where to find it. Time RFC3339
+	MeasuredAt *time.Time `bson:"measured_at,omitempty" json:"measured_at,omitempty" example:"2019-12-31T23:59:58Z"`
+	ClientID   string     `bson:"client_id" json:"client_id" example:"sensor-01"`
+	Username   string     `bson:"username" json:"username" example:"sensor"`
+	QoS        uint8      `bson:"qos" json:"qos" example:"1"`
+	Retain     bool       `bson:"retain" json:"retain" example:"false"`
+	PacketID   uint16     `bson:"packet_id" json:"packet_id" example:"1"`
 }
 
-func GetDB(uri string, db string) (*mongo.Database, error) {
-	clientOptions := options.Client().ApplyURI(uri)
-	client, err := mongo.Connect(Ctx, clientOptions)
-	if err != nil {
-		logger.Error(err)
-		return nil, err
-	}
-
-	err = client.Ping(Ctx, nil)
-	if err != nil {
-		logger.Error(err)
-		return nil, err
-	}
-
-	return client.Database(db), err
+// RecordFilter narrows the records down to the ones published by a certain device.
+// Zero values are ignored.
+type RecordFilter struct {
+	Topic    string
+	ClientID string
+	Username string
+	QoS      *uint8
 }
 
-func CreateRecord(db *mongo.Database, collection string, data MQTTRecord) error {
-	_, err := db.Collection(collection).InsertOne(Ctx, data)
-	if err != nil {
-		logger.Error(err)
+// Match reports whether the record satisfies the filter
+func (f RecordFilter) Match(r *MQTTRecord) bool {
+	if f.Topic != "" && r.Topic != f.Topic {
+		return false
 	}
-
-	return err
-}
-
-func GetRecords(db *mongo.Database, collection string, filter interface{}, opts *options.FindOptions) ([]MQTTRecord, error) {
-	cur, err := db.Collection(collection).Find(Ctx, filter, opts)
-	if err != nil {
-		logger.Error(err)
-		return nil, err
+	if f.ClientID != "" && r.ClientID != f.ClientID {
+		return false
 	}
-
-	var results []MQTTRecord
-	for cur.Next(Ctx) {
-		var result MQTTRecord
-		err := cur.Decode(&result)
-		if err != nil {
-			logger.Error(err)
-			return nil, err
-		}
-
-		results = append(results, result)
+	if f.Username != "" && r.Username != f.Username {
+		return false
 	}
-
-	return results, nil
-}
-
-func GetOptions(page int64, isDescend bool) *options.FindOptions {
-	opts := options.Find()
-	opts.SetLimit(recordPerPage)
-	opts.SetSkip(recordPerPage * (page - 1))
-	if isDescend {
-		opts.SetSort(bson.M{"timestamp": -1})
-	} else {
-		opts.SetSort(bson.M{"timestamp": 1})
-	}
-	return opts
-}
-
-func GetRecordsByPage(db *mongo.Database, collection string, page int64) ([]MQTTRecord, error) {
-	opts := GetOptions(page, true)
-	// filter should not be nil
-	return GetRecords(db, collection, bson.D{}, opts)
-}
-
-func GetRecordsFrom(db *mongo.Database, collection string, start time.Time, page int64, isDescend bool) ([]MQTTRecord, error) {
-	opts := GetOptions(page, isDescend)
-	// https://stackoverflow.com/questions/54548441/composite-literal-uses-unkeyed-fields
-	filter := bson.D{
-		{"timestamp", bson.D{
-			{"$gte", start},
-		}},
+	if f.QoS != nil && r.QoS != *f.QoS {
+		return false
 	}
-	return GetRecords(db, collection, filter, opts)
+	return true
 }
 
-func GetRecordsBetween(db *mongo.Database, collection string, start time.Time, end time.Time, page int64, isDescend bool) ([]MQTTRecord, error) {
-	opts := GetOptions(page, isDescend)
-	// https://stackoverflow.com/questions/54548441/composite-literal-uses-unkeyed-fields
-	filter := bson.D{
-		{"timestamp", bson.D{
-			{"$gte", start},
-			{"$lte", end},
-		}},
-	}
-	return GetRecords(db, collection, filter, opts)
-}
-
-func HandleMQTTtoDB(mqttToDb chan MQTTMsg, db *mongo.Database) {
+// HandleMQTTtoDB persists the messages matching a route into its collection.
+// The records are written by batches, the pending ones are written when mqttToDb is closed.
+// The records the store can't take are appended to the spool, if not nil, and replayed later.
+func HandleMQTTtoDB(mqttToDb <-chan MQTTMsg, store Store, routes *RouteTable, batch BatchConfig, spool *Spool) {
+	b := newBatcher(store, batch, spool)
+	ticker := time.NewTicker(batch.Interval)
+	defer ticker.Stop()
 	for {
-		msg := <-mqttToDb
-		switch msg.Topic {
-		case "temperature":
-			val, err := msg.ToRecord()
-			if err != nil {
-				logger.Error(err)
-				break
-				// Prevent the execution of the following code
+		select {
+		case msg, ok := <-mqttToDb:
+			if !ok {
+				b.flushAll()
+				return
+			}
+			route, ok := routes.Load().Match(msg.Topic)
+			if !ok {
+				unrouted.Inc()
+				continue
 			}
-			CreateRecord(db, "temperature", val)
-		case "humidity":
-			val, err := msg.ToRecord()
+			val, err := msg.ToRecord(route.Decoder())
 			if err != nil {
-				logger.Error(err)
-				break
+				parseFailures.WithLabelValues(route.Collection).Inc()
+				messageLogger.Errorw("can't parse the message", "topic", msg.Topic, "error", err)
+				continue
+			}
+			// the record is kept with its received time only
+			if val.MeasuredAt, err = route.MeasuredTime(&msg, val.Timestamp); err != nil {
+				measuredAtRejected.WithLabelValues(route.Collection).Inc()
+				messageLogger.Warnw("ignoring the time of the message", "topic", msg.Topic, "error", err)
 			}
-			CreateRecord(db, "humidity", val)
-		default:
-			// ignore
+			b.add(route.Collection, val)
+		case <-ticker.C:
+			b.replay()
+			b.flushAll()
 		}
 	}
 }
@@ -0,0 +1,466 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+const writeTimeout = 10 * time.Second
+
+// MongoStore stores each collection as a MongoDB collection
+type MongoStore struct {
+	db *mongo.Database
+}
+
+func GetDB(uri string, db string) (*mongo.Database, error) {
+	clientOptions := options.Client().ApplyURI(uri)
+	client, err := mongo.Connect(Ctx, clientOptions)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	err = client.Ping(Ctx, nil)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+
+	return client.Database(db), err
+}
+
+func NewMongoStore(uri string, db string) (*MongoStore, error) {
+	database, err := GetDB(uri, db)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoStore{db: database}, nil
+}
+
+func (s *MongoStore) CreateRecord(collection string, data MQTTRecord) error {
+	_, err := s.db.Collection(collection).InsertOne(Ctx, data)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	return err
+}
+
+func (s *MongoStore) CreateRecords(collection string, data []MQTTRecord) error {
+	docs := make([]interface{}, len(data))
+	for i := range data {
+		docs[i] = data[i]
+	}
+	// fail fast when the server is unreachable, so the batch can be spooled
+	ctx, cancel := context.WithTimeout(Ctx, writeTimeout)
+	defer cancel()
+	// unordered so one bad record doesn't stop the rest of the batch
+	_, err := s.db.Collection(collection).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return nil
+	}
+	logger.Error(err)
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return err
+	}
+	var failed []int
+	for _, we := range bulkErr.WriteErrors {
+		// the record is already stored
+		if mongo.IsDuplicateKeyError(we) {
+			continue
+		}
+		failed = append(failed, we.Index)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &BatchError{Failed: failed, Err: err}
+}
+
+func (s *MongoStore) find(collection string, filter interface{}, opts *options.FindOptions) ([]MQTTRecord, error) {
+	cur, err := s.db.Collection(collection).Find(Ctx, filter, opts)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	defer cur.Close(Ctx)
+
+	var results []MQTTRecord
+	for cur.Next(Ctx) {
+		var result MQTTRecord
+		err := cur.Decode(&result)
+		if err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (s *MongoStore) GetRecords(collection string, q Query) ([]MQTTRecord, error) {
+	// filter should not be nil
+	return s.find(collection, q.bson(collection), GetOptions(q))
+}
+
+func (s *MongoStore) StreamRecords(ctx context.Context, collection string, q Query,
+	each func(r *MQTTRecord) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: q.timeKey(), Value: 1}, {Key: "_id", Value: 1}})
+	cur, err := s.db.Collection(collection).Find(ctx, q.bson(collection), opts)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	defer cur.Close(Ctx)
+
+	for cur.Next(ctx) {
+		var result MQTTRecord
+		if err := cur.Decode(&result); err != nil {
+			logger.Error(err)
+			return err
+		}
+		if err := each(&result); err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+func (s *MongoStore) GetTopics(collection string) ([]TopicInfo, error) {
+	pipeline := mongo.Pipeline{
+		// records persisted before topic routing have no topic
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$topic", collection}}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "first", Value: bson.D{{Key: "$min", Value: "$timestamp"}}},
+			{Key: "last", Value: bson.D{{Key: "$max", Value: "$timestamp"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cur, err := s.db.Collection(collection).Aggregate(Ctx, pipeline)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	defer cur.Close(Ctx)
+
+	var results []TopicInfo
+	for cur.Next(Ctx) {
+		var result struct {
+			Topic string    `bson:"_id"`
+			Count int64     `bson:"count"`
+			First time.Time `bson:"first"`
+			Last  time.Time `bson:"last"`
+		}
+		if err := cur.Decode(&result); err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		results = append(results, TopicInfo{
+			Topic:      result.Topic,
+			Collection: collection,
+			Count:      result.Count,
+			First:      result.First,
+			Last:       result.Last,
+		})
+	}
+
+	return results, cur.Err()
+}
+
+// mongoAccumulators are the $group accumulators of the aggregation functions
+var mongoAccumulators = map[string]string{
+	AggMin:    "$min",
+	AggMax:    "$max",
+	AggAvg:    "$avg",
+	AggSum:    "$sum",
+	AggFirst:  "$first",
+	AggLast:   "$last",
+	AggStdDev: "$stdDevPop",
+}
+
+func (s *MongoStore) Aggregate(collection string, q AggregateQuery) ([]Bucket, error) {
+	rq := q.records()
+	match := rq.bson(collection)
+	value := "$payload"
+	if q.Field != "" {
+		value = "$fields." + q.Field
+		match = append(match, bson.E{Key: "fields." + q.Field, Value: bson.D{{Key: "$exists", Value: true}}})
+	}
+	millis := bson.D{{Key: "$toLong", Value: "$" + rq.timeKey()}}
+	group := bson.D{
+		// start of the bucket in milliseconds
+		{Key: "_id", Value: bson.D{{Key: "$subtract", Value: bson.A{
+			millis, bson.D{{Key: "$mod", Value: bson.A{millis, q.Bucket.Milliseconds()}}},
+		}}}},
+	}
+	for _, f := range q.Funcs {
+		if f == AggCount {
+			group = append(group, bson.E{Key: f, Value: bson.D{{Key: "$sum", Value: 1}}})
+			continue
+		}
+		group = append(group, bson.E{Key: f, Value: bson.D{{Key: mongoAccumulators[f], Value: value}}})
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		// $first and $last follow the order of the records
+		{{Key: "$sort", Value: bson.D{{Key: rq.timeKey(), Value: 1}}}},
+		{{Key: "$group", Value: group}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cur, err := s.db.Collection(collection).Aggregate(Ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	defer cur.Close(Ctx)
+
+	results := make([]Bucket, 0)
+	for cur.Next(Ctx) {
+		var result struct {
+			Start  int64    `bson:"_id"`
+			Min    *float64 `bson:"min"`
+			Max    *float64 `bson:"max"`
+			Avg    *float64 `bson:"avg"`
+			Sum    *float64 `bson:"sum"`
+			Count  *int64   `bson:"count"`
+			First  *float64 `bson:"first"`
+			Last   *float64 `bson:"last"`
+			StdDev *float64 `bson:"stddev"`
+		}
+		if err := cur.Decode(&result); err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		results = append(results, Bucket{
+			Start:  time.UnixMilli(result.Start).UTC(),
+			Min:    result.Min,
+			Max:    result.Max,
+			Avg:    result.Avg,
+			Sum:    result.Sum,
+			Count:  result.Count,
+			First:  result.First,
+			Last:   result.Last,
+			StdDev: result.StdDev,
+		})
+	}
+
+	return results, cur.Err()
+}
+
+func (s *MongoStore) DeleteRecords(collection string, q Query) (int64, error) {
+	q.After = nil
+	result, err := s.db.Collection(collection).DeleteMany(Ctx, q.bson(collection))
+	if err != nil {
+		logger.Error(err)
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *MongoStore) Stats(collection string) (CollectionStats, error) {
+	stats := CollectionStats{Collection: collection}
+	var result struct {
+		Count int64 `bson:"count"`
+		Size  int64 `bson:"size"`
+	}
+	err := s.db.RunCommand(Ctx, bson.D{{Key: "collStats", Value: collection}}).Decode(&result)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == errNamespaceNotFound {
+		return stats, nil
+	}
+	if err != nil {
+		logger.Error(err)
+		return stats, err
+	}
+	stats.Count, stats.Size = result.Count, result.Size
+
+	var oldest struct {
+		Timestamp time.Time `bson:"timestamp"`
+	}
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+		SetProjection(bson.D{{Key: "timestamp", Value: 1}})
+	err = s.db.Collection(collection).FindOne(Ctx, bson.D{}, opts).Decode(&oldest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return stats, nil
+	}
+	if err != nil {
+		logger.Error(err)
+		return stats, err
+	}
+	stats.Oldest = &oldest.Timestamp
+	return stats, nil
+}
+
+// mongoIndexes serve the keyset paging on both timestamps, and the queries of a topic
+var mongoIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("timestamp_id")},
+	{Keys: bson.D{{Key: "topic", Value: 1}, {Key: "timestamp", Value: 1}}, Options: options.Index().SetName("topic_timestamp")},
+	{Keys: bson.D{{Key: "measured_at", Value: 1}, {Key: "_id", Value: 1}}, Options: options.Index().SetName("measured_at_id")},
+}
+
+// EnsureIndexes creates the indexes of the queries on the collection, the existing ones are left as they are
+func (s *MongoStore) EnsureIndexes(collection string) error {
+	_, err := s.db.Collection(collection).Indexes().CreateMany(Ctx, mongoIndexes)
+	if err != nil {
+		logger.Error(err)
+	}
+	return err
+}
+
+// ttlIndex is the name of the TTL index on the received time of the records
+const ttlIndex = "timestamp_ttl"
+
+// errNamespaceNotFound is the code of the errors about a missing collection
+const errNamespaceNotFound = 26
+
+// EnsureTTL makes MongoDB delete the records of the collection received more than maxAge ago.
+// The TTL index is created, changed with collMod if maxAge changed, or dropped if maxAge is 0.
+func (s *MongoStore) EnsureTTL(collection string, maxAge time.Duration) error {
+	indexes := s.db.Collection(collection).Indexes()
+	specs, err := indexes.ListSpecifications(Ctx)
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	var current *mongo.IndexSpecification
+	for _, spec := range specs {
+		if spec.Name == ttlIndex {
+			current = spec
+		}
+	}
+	seconds := int32(maxAge / time.Second)
+	switch {
+	case maxAge <= 0 && current == nil:
+		return nil
+	case maxAge <= 0:
+		_, err = indexes.DropOne(Ctx, ttlIndex)
+	case current == nil:
+		_, err = indexes.CreateOne(Ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: "timestamp", Value: 1}},
+			Options: options.Index().SetName(ttlIndex).SetExpireAfterSeconds(seconds),
+		})
+	case current.ExpireAfterSeconds == nil || *current.ExpireAfterSeconds != seconds:
+		err = s.db.RunCommand(Ctx, bson.D{
+			{Key: "collMod", Value: collection},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: ttlIndex},
+				{Key: "expireAfterSeconds", Value: seconds},
+			}},
+		}).Err()
+	default:
+		return nil
+	}
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	logger.Infof("TTL of %s set to %v", collection, maxAge)
+	return nil
+}
+
+// TTLCollections lists the collections with a TTL index
+func (s *MongoStore) TTLCollections() ([]string, error) {
+	names, err := s.db.ListCollectionNames(Ctx, bson.D{})
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	var collections []string
+	for _, name := range names {
+		specs, err := s.db.Collection(name).Indexes().ListSpecifications(Ctx)
+		if err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		for _, spec := range specs {
+			if spec.Name == ttlIndex {
+				collections = append(collections, name)
+			}
+		}
+	}
+	return collections, nil
+}
+
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.db.Client().Ping(ctx, readpref.Primary())
+}
+
+func (s *MongoStore) Close() error {
+	return s.db.Client().Disconnect(Ctx)
+}
+
+// GetOptions returns the sort, skip and limit of the page of the query.
+// The records are sorted by (timestamp, _id), the timestamp being the one of the query,
+// so a cursor tells exactly where a page ends.
+func GetOptions(q Query) *options.FindOptions {
+	opts := options.Find()
+	opts.SetLimit(q.limit())
+	if skip := q.skip(); skip > 0 {
+		opts.SetSkip(skip)
+	}
+	order := 1
+	if q.IsDescend {
+		order = -1
+	}
+	opts.SetSort(bson.D{{Key: q.timeKey(), Value: order}, {Key: "_id", Value: order}})
+	return opts
+}
+
+// bson converts the Query on a collection to a MongoDB filter
+func (q *Query) bson(collection string) bson.D {
+	// https://stackoverflow.com/questions/54548441/composite-literal-uses-unkeyed-fields
+	filter := bson.D{}
+	key := q.timeKey()
+	timeRange := bson.D{}
+	if q.Time == TimeMeasured {
+		// the records without a measured time are left out
+		timeRange = append(timeRange, bson.E{Key: "$exists", Value: true})
+	}
+	if !q.Start.IsZero() {
+		timeRange = append(timeRange, bson.E{Key: "$gte", Value: q.Start})
+	}
+	if !q.End.IsZero() {
+		timeRange = append(timeRange, bson.E{Key: "$lte", Value: q.End})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{Key: key, Value: timeRange})
+	}
+	if q.After != nil {
+		op := "$gt"
+		if q.IsDescend {
+			op = "$lt"
+		}
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: key, Value: bson.D{{Key: op, Value: q.After.Timestamp}}}},
+			bson.D{{Key: key, Value: q.After.Timestamp}, {Key: "_id", Value: bson.D{{Key: op, Value: q.After.ID}}}},
+		}})
+	}
+	if q.Filter.Topic == collection {
+		// records persisted before topic routing have no topic
+		filter = append(filter, bson.E{Key: "topic", Value: bson.D{{Key: "$in", Value: bson.A{collection, nil}}}})
+	} else if q.Filter.Topic != "" {
+		filter = append(filter, bson.E{Key: "topic", Value: q.Filter.Topic})
+	}
+	if q.Filter.ClientID != "" {
+		filter = append(filter, bson.E{Key: "client_id", Value: q.Filter.ClientID})
+	}
+	if q.Filter.Username != "" {
+		filter = append(filter, bson.E{Key: "username", Value: q.Filter.Username})
+	}
+	if q.Filter.QoS != nil {
+		filter = append(filter, bson.E{Key: "qos", Value: *q.Filter.QoS})
+	}
+	return filter
+}
@@ -0,0 +1,375 @@
+package model
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Decoder turns an MQTT payload into the payload and the named numeric fields of a record
+type Decoder interface {
+	Decode(payload string) (value float64, fields map[string]float64, err error)
+}
+
+// Payload formats
+const (
+	FormatFloat = "float"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+	FormatKV    = "kv"
+)
+
+// PayloadConfig selects and configures the decoder of a route.
+//
+//	payload:
+//	  format: json
+//	  fields:
+//	    t: $.t
+//	    h: $.env.h
+//	  value: t
+type PayloadConfig struct {
+	// float (default), json, csv or kv
+	Format string `yaml:"format" json:"format"`
+	// json: field name -> JSON path like $.env.readings[0]
+	// kv: field name -> key
+	// All the numeric top-level values (json) or all the keys (kv) are kept when empty,
+	// the elements of a top-level JSON array are named by their index.
+	Fields map[string]string `yaml:"fields" json:"fields,omitempty"`
+	// csv: name of each column, empty names skip the column
+	Columns []string `yaml:"columns" json:"columns,omitempty"`
+	// csv: column separator, default ','
+	Separator string `yaml:"separator" json:"separator,omitempty"`
+	// Value names the field stored as the payload of the record.
+	// When empty the payload is the only decoded field, or 0 if there are several.
+	Value string `yaml:"value" json:"value,omitempty"`
+}
+
+// NewDecoder builds the decoder described by the config
+func NewDecoder(c PayloadConfig) (Decoder, error) {
+	return newDecoder(c, "")
+}
+
+// newDecoder builds the decoder described by the config, the top-level key ignored of JSON payloads is not a field
+func newDecoder(c PayloadConfig, ignored string) (Decoder, error) {
+	var d fieldDecoder
+	switch c.Format {
+	case "", FormatFloat:
+		return floatDecoder{}, nil
+	case FormatJSON:
+		jd := jsonDecoder{paths: make(map[string][]pathStep), ignored: ignored}
+		for name, path := range c.Fields {
+			steps, err := parsePath(path)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", name, err)
+			}
+			jd.paths[name] = steps
+		}
+		d = jd
+	case FormatCSV:
+		if len(c.Columns) == 0 {
+			return nil, fmt.Errorf("csv payload needs columns")
+		}
+		cd := csvDecoder{columns: c.Columns, separator: ','}
+		if c.Separator != "" {
+			if len([]rune(c.Separator)) != 1 {
+				return nil, fmt.Errorf("csv separator %q must be a single character", c.Separator)
+			}
+			cd.separator = []rune(c.Separator)[0]
+		}
+		d = cd
+	case FormatKV:
+		d = kvDecoder{keys: c.Fields}
+	default:
+		return nil, fmt.Errorf("unknown payload format %q", c.Format)
+	}
+	if c.Value != "" {
+		_, inFields := c.Fields[c.Value]
+		if (len(c.Fields) > 0 && !inFields) || (len(c.Columns) > 0 && !contains(c.Columns, c.Value)) {
+			return nil, fmt.Errorf("value %q is not a decoded field", c.Value)
+		}
+	}
+	return valueDecoder{fieldDecoder: d, value: c.Value}, nil
+}
+
+// floatDecoder accepts a bare number like "23.5"
+type floatDecoder struct{}
+
+func (floatDecoder) Decode(payload string) (float64, map[string]float64, error) {
+	val, err := parseFloat(payload, 32)
+	return val, nil, err
+}
+
+// fieldDecoder decodes structured payloads into named fields
+type fieldDecoder interface {
+	decodeFields(payload string) (map[string]float64, error)
+}
+
+// valueDecoder picks the payload of the record out of the decoded fields
+type valueDecoder struct {
+	fieldDecoder
+	value string
+}
+
+func (d valueDecoder) Decode(payload string) (float64, map[string]float64, error) {
+	fields, err := d.decodeFields(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if d.value != "" {
+		val, ok := fields[d.value]
+		if !ok {
+			return 0, nil, fmt.Errorf("field %s not found", d.value)
+		}
+		return val, fields, nil
+	}
+	if len(fields) == 1 {
+		for _, val := range fields {
+			return val, fields, nil
+		}
+	}
+	return 0, fields, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonDecoder accepts JSON objects like {"t":23.5,"h":41,"bat":3.7}
+// and numeric arrays like [23.5,41,3.7] whose fields are named by index
+type jsonDecoder struct {
+	paths map[string][]pathStep
+	// top-level key which is not kept when paths is empty, e.g. the time of the reading
+	ignored string
+}
+
+func (d jsonDecoder) decodeFields(payload string) (map[string]float64, error) {
+	var doc interface{}
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]float64)
+	if len(d.paths) == 0 {
+		switch obj := doc.(type) {
+		case map[string]interface{}:
+			for key, v := range obj {
+				if key == d.ignored {
+					continue
+				}
+				if val, err := toFloat(v); err == nil {
+					fields[key] = val
+				}
+			}
+		case []interface{}:
+			for i, v := range obj {
+				if val, err := toFloat(v); err == nil {
+					fields[strconv.Itoa(i)] = val
+				}
+			}
+		default:
+			return nil, fmt.Errorf("payload is neither a JSON object nor an array")
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no numeric field in payload")
+		}
+		return fields, nil
+	}
+	for name, steps := range d.paths {
+		v, err := walkPath(doc, steps)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", name, err)
+		}
+		if fields[name], err = toFloat(v); err != nil {
+			return nil, fmt.Errorf("field %s: %w", name, err)
+		}
+	}
+	return fields, nil
+}
+
+// csvDecoder accepts a single line of separated values like "23.5,41,3.7"
+type csvDecoder struct {
+	columns   []string
+	separator rune
+}
+
+func (d csvDecoder) decodeFields(payload string) (map[string]float64, error) {
+	r := csv.NewReader(strings.NewReader(payload))
+	r.Comma = d.separator
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	values, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < len(d.columns) {
+		return nil, fmt.Errorf("expect %d columns, got %d", len(d.columns), len(values))
+	}
+	fields := make(map[string]float64)
+	for i, name := range d.columns {
+		if name == "" {
+			continue
+		}
+		if fields[name], err = parseFloat(strings.TrimSpace(values[i]), 64); err != nil {
+			return nil, fmt.Errorf("column %s: %w", name, err)
+		}
+	}
+	return fields, nil
+}
+
+// kvDecoder accepts pairs like "t=23.5,h=41 bat=3.7".
+// Pairs are separated by commas, semicolons, ampersands or white spaces.
+type kvDecoder struct {
+	// field name -> key, every key is kept when empty
+	keys map[string]string
+}
+
+func (d kvDecoder) decodeFields(payload string) (map[string]float64, error) {
+	pairs := strings.FieldsFunc(payload, func(r rune) bool {
+		return r == ',' || r == ';' || r == '&' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	values := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed pair %q", pair)
+		}
+		values[kv[0]] = kv[1]
+	}
+	fields := make(map[string]float64)
+	var err error
+	if len(d.keys) == 0 {
+		for key, v := range values {
+			if fields[key], err = parseFloat(v, 64); err != nil {
+				return nil, fmt.Errorf("key %s: %w", key, err)
+			}
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("no key=value pair in payload")
+		}
+		return fields, nil
+	}
+	for name, key := range d.keys {
+		v, ok := values[key]
+		if !ok {
+			return nil, fmt.Errorf("key %s not found", key)
+		}
+		if fields[name], err = parseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("key %s: %w", key, err)
+		}
+	}
+	return fields, nil
+}
+
+// pathStep is either an object key or an array index
+type pathStep struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parsePath parses a subset of JSON path: $.a.b[0]['c d']
+func parsePath(path string) ([]pathStep, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var steps []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in path %q", path)
+			}
+			steps = append(steps, pathStep{key: rest[:end], isKey: true})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed '[' in path %q", path)
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1], isKey: true})
+				continue
+			}
+			index, err := strconv.Atoi(inner)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index %q in path %q", inner, path)
+			}
+			steps = append(steps, pathStep{index: index})
+		default:
+			// allow "t" as a shorthand of "$.t"
+			if len(steps) == 0 && !strings.HasPrefix(strings.TrimSpace(path), "$") {
+				rest = "." + rest
+				continue
+			}
+			return nil, fmt.Errorf("unexpected %q in path %q", rest[0], path)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return steps, nil
+}
+
+func walkPath(doc interface{}, steps []pathStep) (interface{}, error) {
+	cur := doc
+	for _, step := range steps {
+		if step.isKey {
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%q is not an object key", step.key)
+			}
+			if cur, ok = obj[step.key]; !ok {
+				return nil, fmt.Errorf("key %q not found", step.key)
+			}
+			continue
+		}
+		arr, ok := cur.([]interface{})
+		if !ok || step.index >= len(arr) {
+			return nil, fmt.Errorf("index %d out of range", step.index)
+		}
+		cur = arr[step.index]
+	}
+	return cur, nil
+}
+
+// toFloat converts JSON numbers, booleans and numeric strings
+func toFloat(v interface{}) (float64, error) {
+	switch val := v.(type) {
+	case float64:
+		return val, nil
+	case bool:
+		if val {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return parseFloat(val, 64)
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+}
+
+// parseFloat is strconv.ParseFloat rejecting NaN and the infinities, which can't be stored
+func parseFloat(s string, bitSize int) (float64, error) {
+	val, err := strconv.ParseFloat(s, bitSize)
+	if err == nil && !isFinite(val) {
+		return 0, fmt.Errorf("%q is not a finite number", s)
+	}
+	return val, err
+}
+
+func isFinite(val float64) bool {
+	return !math.IsNaN(val) && !math.IsInf(val, 0)
+}
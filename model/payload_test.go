@@ -0,0 +1,217 @@
+package model
+
+import "testing"
+
+func TestDecodeNonFinite(t *testing.T) {
+	tests := []struct {
+		config  PayloadConfig
+		payload string
+	}{
+		{PayloadConfig{}, "NaN"},
+		{PayloadConfig{}, "+Inf"},
+		{PayloadConfig{}, "-infinity"},
+		{PayloadConfig{Format: FormatJSON}, `{"t":"NaN"}`},
+		{PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.t"}}, `{"t":"Inf"}`},
+		{PayloadConfig{Format: FormatCSV, Columns: []string{"t"}}, "nan"},
+		{PayloadConfig{Format: FormatKV}, "t=inf"},
+		{PayloadConfig{Format: FormatKV, Fields: map[string]string{"t": "t"}}, "t=NaN"},
+	}
+	for _, tt := range tests {
+		d, err := NewDecoder(tt.config)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.config, err)
+		}
+		if val, fields, err := d.Decode(tt.payload); err == nil {
+			t.Errorf("%s %q: got %v %v, want an error", tt.config.Format, tt.payload, val, fields)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	jsonFields := PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.t", "bat": "$.env.bat"}, Value: "t"}
+	tests := []struct {
+		name    string
+		config  PayloadConfig
+		payload string
+		value   float64
+		fields  map[string]float64
+	}{
+		{"float", PayloadConfig{}, "23.5", 23.5, nil},
+		{"float format", PayloadConfig{Format: FormatFloat}, "-4", -4, nil},
+		{"json paths", jsonFields, `{"t":23.5,"h":41,"env":{"bat":3.7}}`, 23.5, map[string]float64{"t": 23.5, "bat": 3.7}},
+		{"json top-level values", PayloadConfig{Format: FormatJSON, Value: "h"},
+			`{"t":23.5,"h":41,"name":"x","ok":true,"env":{"bat":3.7}}`, 41, map[string]float64{"t": 23.5, "h": 41, "ok": 1}},
+		{"json numeric strings", PayloadConfig{Format: FormatJSON}, `{"t":"23.5"}`, 23.5, map[string]float64{"t": 23.5}},
+		{"json array", PayloadConfig{Format: FormatJSON, Value: "1"}, `[23.5,41,"x"]`, 41, map[string]float64{"0": 23.5, "1": 41}},
+		{"json index", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.readings[1].t"}},
+			`{"readings":[{"t":1},{"t":2}]}`, 2, map[string]float64{"t": 2}},
+		{"json bracket keys", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": `$['a b']["c.d"]`}},
+			`{"a b":{"c.d":5}}`, 5, map[string]float64{"t": 5}},
+		{"json shorthand", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "env.t"}},
+			`{"env":{"t":7}}`, 7, map[string]float64{"t": 7}},
+		// the payload is 0 when the value isn't chosen among several fields
+		{"json several fields", PayloadConfig{Format: FormatJSON}, `{"t":1,"h":2}`, 0, map[string]float64{"t": 1, "h": 2}},
+		{"csv", PayloadConfig{Format: FormatCSV, Columns: []string{"t", "", "bat"}, Value: "bat"},
+			"23.5, 41 ,3.7,9", 3.7, map[string]float64{"t": 23.5, "bat": 3.7}},
+		{"csv separator", PayloadConfig{Format: FormatCSV, Columns: []string{"t", "h"}, Separator: ";"},
+			"23.5;41", 0, map[string]float64{"t": 23.5, "h": 41}},
+		{"csv single column", PayloadConfig{Format: FormatCSV, Columns: []string{"t"}}, "23.5", 23.5,
+			map[string]float64{"t": 23.5}},
+		{"kv", PayloadConfig{Format: FormatKV, Value: "t"}, "t=23.5,h=41;bat=3.7 x=1&y=2", 23.5,
+			map[string]float64{"t": 23.5, "h": 41, "bat": 3.7, "x": 1, "y": 2}},
+		{"kv keys", PayloadConfig{Format: FormatKV, Fields: map[string]string{"temp": "t"}}, "t=23.5 h=41", 23.5,
+			map[string]float64{"temp": 23.5}},
+	}
+	for _, tt := range tests {
+		d, err := NewDecoder(tt.config)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		value, fields, err := d.Decode(tt.payload)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if value != tt.value || !equalFields(fields, tt.fields) {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, value, fields, tt.value, tt.fields)
+		}
+	}
+}
+
+func equalFields(a, b map[string]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PayloadConfig
+		payload string
+	}{
+		{"float", PayloadConfig{}, "abc"},
+		{"float empty", PayloadConfig{}, ""},
+		{"json syntax", PayloadConfig{Format: FormatJSON}, `{"t":`},
+		{"json scalar", PayloadConfig{Format: FormatJSON}, `23.5`},
+		{"json no numeric field", PayloadConfig{Format: FormatJSON}, `{"name":"x"}`},
+		{"json missing key", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.t"}}, `{"h":1}`},
+		{"json not an object", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.a.b"}}, `{"a":1}`},
+		{"json index out of range", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$[2]"}}, `[1,2]`},
+		{"json index of an object", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.a[0]"}}, `{"a":{"0":1}}`},
+		{"json not a number", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.t"}}, `{"t":{"v":1}}`},
+		{"json value missing", PayloadConfig{Format: FormatJSON, Value: "t"}, `{"h":1}`},
+		{"csv missing column", PayloadConfig{Format: FormatCSV, Columns: []string{"t", "h"}}, "23.5"},
+		{"csv not a number", PayloadConfig{Format: FormatCSV, Columns: []string{"t"}}, "abc"},
+		{"csv empty", PayloadConfig{Format: FormatCSV, Columns: []string{"t"}}, ""},
+		{"kv malformed pair", PayloadConfig{Format: FormatKV}, "t=1,h"},
+		{"kv not a number", PayloadConfig{Format: FormatKV}, "t=abc"},
+		{"kv empty", PayloadConfig{Format: FormatKV}, " , "},
+		{"kv missing key", PayloadConfig{Format: FormatKV, Fields: map[string]string{"t": "t"}}, "h=1"},
+	}
+	for _, tt := range tests {
+		d, err := NewDecoder(tt.config)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if value, fields, err := d.Decode(tt.payload); err == nil {
+			t.Errorf("%s: got %v %v, want an error", tt.name, value, fields)
+		}
+	}
+}
+
+func TestNewDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PayloadConfig
+	}{
+		{"unknown format", PayloadConfig{Format: "xml"}},
+		{"invalid path", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.a["}}},
+		{"csv without columns", PayloadConfig{Format: FormatCSV}},
+		{"csv long separator", PayloadConfig{Format: FormatCSV, Columns: []string{"t"}, Separator: ";;"}},
+		{"value not a field", PayloadConfig{Format: FormatJSON, Fields: map[string]string{"t": "$.t"}, Value: "h"}},
+		{"value not a column", PayloadConfig{Format: FormatCSV, Columns: []string{"t"}, Value: "h"}},
+		{"kv value not a field", PayloadConfig{Format: FormatKV, Fields: map[string]string{"t": "t"}, Value: "h"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewDecoder(tt.config); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	key := func(k string) pathStep { return pathStep{key: k, isKey: true} }
+	index := func(i int) pathStep { return pathStep{index: i} }
+	tests := []struct {
+		path  string
+		steps []pathStep
+	}{
+		{"$.t", []pathStep{key("t")}},
+		{"t", []pathStep{key("t")}},
+		{" $.env.t ", []pathStep{key("env"), key("t")}},
+		{"env.readings[0]", []pathStep{key("env"), key("readings"), index(0)}},
+		{"$[1][2]", []pathStep{index(1), index(2)}},
+		{`$['a b']["c.d"].e`, []pathStep{key("a b"), key("c.d"), key("e")}},
+		{"$.a[10].b", []pathStep{key("a"), index(10), key("b")}},
+	}
+	for _, tt := range tests {
+		steps, err := parsePath(tt.path)
+		if err != nil {
+			t.Errorf("%q: %v", tt.path, err)
+			continue
+		}
+		if len(steps) != len(tt.steps) {
+			t.Errorf("%q: got %+v, want %+v", tt.path, steps, tt.steps)
+			continue
+		}
+		for i := range steps {
+			if steps[i] != tt.steps[i] {
+				t.Errorf("%q: got %+v, want %+v", tt.path, steps, tt.steps)
+				break
+			}
+		}
+	}
+	for _, path := range []string{"", "$", "$.", "$.a..b", "$.a[", "$[-1]", "$[x]", "$a"} {
+		if steps, err := parsePath(path); err == nil {
+			t.Errorf("%q: got %+v, want an error", path, steps)
+		}
+	}
+}
+
+func TestWalkPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"a": map[string]interface{}{"b": []interface{}{1.0, map[string]interface{}{"c": 2.0}}},
+	}
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"$.a.b[0]", 1.0, true},
+		{"$.a.b[1].c", 2.0, true},
+		{"$.a.b[2]", nil, false},
+		{"$.a.x", nil, false},
+		{"$.a.b.c", nil, false},
+		{"$.a[0]", nil, false},
+		{"$.a.b[0].c", nil, false},
+	}
+	for _, tt := range tests {
+		steps, err := parsePath(tt.path)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.path, err)
+		}
+		got, err := walkPath(doc, steps)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("%q: got %v, %v", tt.path, got, err)
+		}
+	}
+}
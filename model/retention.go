@@ -0,0 +1,181 @@
+package model
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultPurgeInterval is how often the expired records are deleted
+const DefaultPurgeInterval = time.Hour
+
+// TTLStore is implemented by the stores which expire the records by themselves,
+// the collections with a single retention are then left to the store.
+type TTLStore interface {
+	// EnsureTTL makes the store delete the records of the collection received more than maxAge ago,
+	// 0 stops it
+	EnsureTTL(collection string, maxAge time.Duration) error
+	// TTLCollections lists the collections whose records the store expires
+	TTLCollections() ([]string, error)
+}
+
+// CollectionRetention returns the retention of the routes of the collection,
+// uniform tells all of them have the same one.
+func CollectionRetention(routes Routes, collection string) (retention time.Duration, uniform bool) {
+	uniform = true
+	found := false
+	for _, r := range routes {
+		if r.Collection != collection {
+			continue
+		}
+		if found && r.Retention != retention {
+			uniform = false
+		}
+		if !found || r.Retention > retention {
+			retention = r.Retention
+		}
+		found = true
+	}
+	return retention, uniform
+}
+
+// UsesTTL reports whether the records of the collection are expired by the store rather than purged
+func UsesTTL(store Store, routes Routes, collection string) bool {
+	if _, ok := store.(TTLStore); !ok {
+		return false
+	}
+	retention, uniform := CollectionRetention(routes, collection)
+	return uniform && retention > 0
+}
+
+// Purger deletes the records older than the retention of their route.
+// The collections of a TTLStore whose routes share a retention are expired by the store.
+type Purger struct {
+	store    Store
+	routes   *RouteTable
+	interval time.Duration
+	reload   chan struct{}
+	// collections expired by a TTLStore, listed is set once the ones of the previous runs are known
+	ttl    map[string]bool
+	listed bool
+}
+
+func NewPurger(store Store, routes *RouteTable, interval time.Duration) *Purger {
+	return &Purger{
+		store:    store,
+		routes:   routes,
+		interval: interval,
+		reload:   make(chan struct{}, 1),
+		ttl:      make(map[string]bool),
+	}
+}
+
+// Run applies the retention at once, then every interval and after every Reload, until ctx is done
+func (p *Purger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.apply(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.reload:
+		}
+	}
+}
+
+// Reload applies the retention of the current routes without waiting for the next purge
+func (p *Purger) Reload() {
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Purger) apply(now time.Time) {
+	routes := p.routes.Load()
+	ttl, isTTL := p.store.(TTLStore)
+	if isTTL {
+		p.dropTTLs(ttl, routes)
+	}
+	for _, collection := range routes.Collections() {
+		if isTTL {
+			var maxAge time.Duration
+			if UsesTTL(p.store, routes, collection) {
+				maxAge, _ = CollectionRetention(routes, collection)
+			}
+			if err := ttl.EnsureTTL(collection, maxAge); err != nil {
+				logger.Errorf("TTL of %s: %v", collection, err)
+			} else if maxAge > 0 {
+				p.ttl[collection] = true
+			} else {
+				delete(p.ttl, collection)
+			}
+			if maxAge > 0 {
+				continue
+			}
+		}
+		p.purge(routes, collection, now)
+	}
+}
+
+// dropTTLs stops the store from expiring the collections which are not routed anymore,
+// including the ones of a previous run
+func (p *Purger) dropTTLs(ttl TTLStore, routes Routes) {
+	if !p.listed {
+		if collections, err := ttl.TTLCollections(); err != nil {
+			logger.Errorf("TTL collections: %v", err)
+		} else {
+			for _, collection := range collections {
+				p.ttl[collection] = true
+			}
+			p.listed = true
+		}
+	}
+	routed := make(map[string]bool)
+	for _, collection := range routes.Collections() {
+		routed[collection] = true
+	}
+	for collection := range p.ttl {
+		if routed[collection] {
+			continue
+		}
+		if err := ttl.EnsureTTL(collection, 0); err != nil {
+			logger.Errorf("TTL of %s: %v", collection, err)
+			continue
+		}
+		delete(p.ttl, collection)
+	}
+}
+
+// purge deletes the records of each topic of the collection older than the retention of its route
+func (p *Purger) purge(routes Routes, collection string, now time.Time) {
+	topics, err := p.store.GetTopics(collection)
+	if err != nil {
+		logger.Errorf("retention of %s: %v", collection, err)
+		return
+	}
+	for _, info := range topics {
+		// the records persisted before topic routing are kept, their topic is unknown
+		if info.Topic == "" {
+			continue
+		}
+		route, ok := routes.Match(info.Topic)
+		if !ok || route.Collection != collection || route.Retention <= 0 {
+			continue
+		}
+		cutoff := now.Add(-route.Retention)
+		if !info.First.Before(cutoff) {
+			continue
+		}
+		q := Query{End: cutoff, Filter: RecordFilter{Topic: info.Topic}}
+		deleted, err := p.store.DeleteRecords(collection, q)
+		if deleted > 0 {
+			recordsPurged.WithLabelValues(collection).Add(float64(deleted))
+			logger.Infof("purged %d records of %s older than %v", deleted, info.Topic, route.Retention)
+		}
+		if err != nil {
+			logger.Errorf("retention of %s: %v", info.Topic, err)
+		}
+	}
+}
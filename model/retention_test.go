@@ -0,0 +1,70 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+// ttlStore is a MemoryStore remembering the TTL of each collection
+type ttlStore struct {
+	*MemoryStore
+	ttls map[string]time.Duration
+}
+
+func (s *ttlStore) EnsureTTL(collection string, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		delete(s.ttls, collection)
+		return nil
+	}
+	s.ttls[collection] = maxAge
+	return nil
+}
+
+func (s *ttlStore) TTLCollections() ([]string, error) {
+	var collections []string
+	for collection := range s.ttls {
+		collections = append(collections, collection)
+	}
+	return collections, nil
+}
+
+func TestPurgerTTL(t *testing.T) {
+	// the TTL left by a previous run
+	store := &ttlStore{MemoryStore: NewMemoryStore(), ttls: map[string]time.Duration{"old": time.Hour}}
+	table := NewRouteTable(Routes{
+		{Filter: "a/#", Collection: "a", Retention: time.Hour},
+		{Filter: "b/1", Collection: "b", Retention: time.Hour},
+		// the records of b have several retentions, they're purged by the bridge
+		{Filter: "b/#", Collection: "b", Retention: 2 * time.Hour},
+		{Filter: "c/#", Collection: "c"},
+	})
+	p := NewPurger(store, table, time.Hour)
+	steps := []struct {
+		name   string
+		routes Routes
+		want   map[string]time.Duration
+	}{
+		{"startup", nil, map[string]time.Duration{"a": time.Hour}},
+		{"retention changed", Routes{{Filter: "a/#", Collection: "a", Retention: 3 * time.Hour}},
+			map[string]time.Duration{"a": 3 * time.Hour}},
+		{"collection not routed", Routes{{Filter: "d/#", Collection: "d", Retention: time.Hour}},
+			map[string]time.Duration{"d": time.Hour}},
+		{"retention removed", Routes{{Filter: "d/#", Collection: "d"}}, map[string]time.Duration{}},
+	}
+	for _, step := range steps {
+		if step.routes != nil {
+			table.Store(step.routes)
+		}
+		p.apply(base)
+		if len(store.ttls) != len(step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, store.ttls, step.want)
+			continue
+		}
+		for collection, maxAge := range step.want {
+			if store.ttls[collection] != maxAge {
+				t.Errorf("%s: got %v, want %v", step.name, store.ttls, step.want)
+				break
+			}
+		}
+	}
+}
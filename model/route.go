@@ -0,0 +1,196 @@
+package model
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/crosstyan/mqtt-to-ws/topic"
+	"gopkg.in/yaml.v2"
+)
+
+// Route persists the messages whose topic matches Filter into Collection
+type Route struct {
+	// MQTT topic filter, '+' and '#' wildcards are allowed
+	Filter     string `yaml:"filter" json:"filter" example:"site1/+/temperature"`
+	Collection string `yaml:"collection" json:"collection" example:"temperature"`
+	// Payload is decoded as a bare float if not set
+	Payload *PayloadConfig `yaml:"payload" json:"payload,omitempty"`
+	// MeasuredAt tells where the devices put the time of their readings, the records have none if not set
+	MeasuredAt *TimestampConfig `yaml:"measured_at" json:"measured_at,omitempty"`
+	// Retention is how long the records of the matching topics are kept, forever if zero
+	Retention time.Duration `yaml:"retention" json:"retention,omitempty" swaggertype:"string" example:"720h"`
+
+	decoder Decoder
+}
+
+// Decoder returns the payload decoder of the route
+func (r *Route) Decoder() Decoder {
+	if r.decoder == nil {
+		return floatDecoder{}
+	}
+	return r.decoder
+}
+
+// MeasuredTime returns the time the device measured the message, nil if the route or the message has none.
+// An error tells the message has a time but it's invalid or out of the tolerated skew.
+func (r *Route) MeasuredTime(m *MQTTMsg, received time.Time) (*time.Time, error) {
+	if r.MeasuredAt == nil {
+		return nil, nil
+	}
+	return r.MeasuredAt.measuredAt(m, received)
+}
+
+// Routes is the routing table from MQTT topics to collections.
+// The first matching route wins.
+type Routes []Route
+
+// DefaultRoutes keeps the behavior of the bridge before routes were configurable
+var DefaultRoutes = Routes{
+	{Filter: "temperature", Collection: "temperature"},
+	{Filter: "humidity", Collection: "humidity"},
+}
+
+// collection names are also used as HTTP paths and table/collection names
+var collectionName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedCollections are the first segments of the HTTP paths of the bridge,
+// GET /<collection> would clash with them
+var reservedCollections = map[string]bool{
+	"ws":      true,
+	"topics":  true,
+	"metrics": true,
+	"healthz": true,
+	"readyz":  true,
+	"admin":   true,
+	"swagger": true,
+}
+
+type routesFile struct {
+	Routes Routes `yaml:"routes"`
+}
+
+// LoadRoutes reads the routing table from a YAML file like
+//
+//	routes:
+//	  - filter: site1/+/co2
+//	    collection: co2
+//	  - filter: site1/+/env
+//	    collection: env
+//	    payload:
+//	      format: json
+//	      fields:
+//	        t: $.t
+//	        h: $.h
+//	    measured_at:
+//	      field: $.ts
+//	    retention: 720h
+func LoadRoutes(path string) (Routes, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file routesFile
+	if err = yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err = file.Routes.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file.Routes, nil
+}
+
+// Validate checks every topic filter and collection name of the table
+// and builds the payload decoders
+func (rs Routes) Validate() error {
+	if len(rs) == 0 {
+		return fmt.Errorf("no routes defined")
+	}
+	for i, r := range rs {
+		if err := topic.ValidateFilter(r.Filter); err != nil {
+			return fmt.Errorf("route %d: %w", i, err)
+		}
+		if !collectionName.MatchString(r.Collection) {
+			return fmt.Errorf("route %d: invalid collection name %q", i, r.Collection)
+		}
+		if reservedCollections[r.Collection] {
+			return fmt.Errorf("route %d: collection name %q is reserved by the HTTP API", i, r.Collection)
+		}
+		if r.Retention < 0 {
+			return fmt.Errorf("route %d: retention can't be negative", i)
+		}
+		var format, ignored string
+		if r.Payload != nil {
+			format = r.Payload.Format
+		}
+		if r.MeasuredAt != nil {
+			if err := r.MeasuredAt.validate(format); err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+			ignored = r.MeasuredAt.topLevelKey()
+		}
+		if r.Payload != nil {
+			d, err := newDecoder(*r.Payload, ignored)
+			if err != nil {
+				return fmt.Errorf("route %d: %w", i, err)
+			}
+			rs[i].decoder = d
+		}
+	}
+	return nil
+}
+
+// Match returns the first route matching the topic
+func (rs Routes) Match(name string) (*Route, bool) {
+	for i := range rs {
+		if topic.Match(rs[i].Filter, name) {
+			return &rs[i], true
+		}
+	}
+	return nil, false
+}
+
+// Collection returns the collection the topic should be stored in
+func (rs Routes) Collection(name string) (string, bool) {
+	r, ok := rs.Match(name)
+	if !ok {
+		return "", false
+	}
+	return r.Collection, true
+}
+
+// Collections returns the distinct collections of the table in order
+func (rs Routes) Collections() []string {
+	seen := make(map[string]bool)
+	var collections []string
+	for _, r := range rs {
+		if !seen[r.Collection] {
+			seen[r.Collection] = true
+			collections = append(collections, r.Collection)
+		}
+	}
+	return collections
+}
+
+// RouteTable holds the routing table, which can be replaced while the messages are routed
+type RouteTable struct {
+	routes atomic.Value
+}
+
+func NewRouteTable(routes Routes) *RouteTable {
+	t := &RouteTable{}
+	t.Store(routes)
+	return t
+}
+
+// Load returns the current routes, which must not be modified
+func (t *RouteTable) Load() Routes {
+	return t.routes.Load().(Routes)
+}
+
+// Store replaces the routes, the messages already routed keep their collection
+func (t *RouteTable) Store(routes Routes) {
+	t.routes.Store(routes)
+}
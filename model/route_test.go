@@ -0,0 +1,39 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutesValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes Routes
+		err    string
+	}{
+		{"default", DefaultRoutes, ""},
+		{"wildcards", Routes{{Filter: "site1/+/env/#", Collection: "env"}}, ""},
+		{"none", Routes{}, "no routes"},
+		{"invalid filter", Routes{{Filter: "a/#/b", Collection: "c"}}, "route 0"},
+		{"invalid collection", Routes{{Filter: "a", Collection: "a/b"}}, "invalid collection name"},
+		{"empty collection", Routes{{Filter: "a", Collection: ""}}, "invalid collection name"},
+		{"negative retention", Routes{{Filter: "a", Collection: "c", Retention: -1}}, "retention"},
+		{"unknown payload", Routes{{Filter: "a", Collection: "c", Payload: &PayloadConfig{Format: "xml"}}}, "xml"},
+	}
+	for _, name := range []string{"ws", "topics", "metrics", "healthz", "readyz", "admin", "swagger"} {
+		tests = append(tests, struct {
+			name   string
+			routes Routes
+			err    string
+		}{"reserved " + name, Routes{{Filter: "a", Collection: "c"}, {Filter: "b", Collection: name}}, "route 1: collection name"})
+	}
+	for _, tt := range tests {
+		err := tt.routes.Validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error with %q", tt.name, err, tt.err)
+		}
+	}
+}
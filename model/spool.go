@@ -0,0 +1,286 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+)
+
+// Spool is an append-only log on disk of the records that couldn't be written to the store.
+// They are replayed in order once the store is reachable again.
+//
+// The offset of the first record not replayed yet is saved after each replayed chunk.
+// A crash in the middle of a chunk replays it again, which doesn't duplicate
+// anything since the records keep their ID and the stores ignore the IDs they already have.
+// The records the store rejects one by one are moved to a dead letter log, so they can't block the others.
+type Spool struct {
+	dir     string
+	maxSize int64
+	// nil until the first record is spooled
+	log *os.File
+	// size of the log and offset of the first record not replayed
+	size, offset int64
+	// records not replayed, read by Stats from other goroutines
+	depth   int64
+	dropped uint64
+	// set while the log is full, to log once per overflow
+	full bool
+}
+
+// SpoolStats tells how many records are waiting in the spool
+type SpoolStats struct {
+	Depth int64 `json:"depth"`
+	// Bytes of the records not replayed
+	Bytes   int64  `json:"bytes"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type spoolEntry struct {
+	Collection string     `json:"collection"`
+	Record     MQTTRecord `json:"record"`
+}
+
+const (
+	spoolLog    = "records.log"
+	spoolOffset = "records.offset"
+	// records the store rejected, kept for inspection and never replayed
+	spoolDead = "records.dead"
+)
+
+// OpenSpool opens the spool kept in dir, which holds up to maxSize bytes.
+// The directory is only created when the first record is spooled.
+func OpenSpool(dir string, maxSize int64) (*Spool, error) {
+	s := &Spool{dir: dir, maxSize: maxSize}
+	if _, err := os.Stat(filepath.Join(dir, spoolLog)); os.IsNotExist(err) {
+		return s, nil
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, spoolOffset)); err == nil {
+		if s.offset, err = strconv.ParseInt(string(bytes.TrimSpace(content)), 10, 64); err != nil {
+			s.log.Close()
+			return nil, fmt.Errorf("%s: %w", spoolOffset, err)
+		}
+	} else if !os.IsNotExist(err) {
+		s.log.Close()
+		return nil, err
+	}
+	if s.offset > s.size {
+		s.offset = 0
+	}
+	// count the records left by the previous run
+	r := bufio.NewReader(io.NewSectionReader(s.log, s.offset, s.size-s.offset))
+	end := s.offset
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.log.Close()
+			return nil, err
+		}
+		end += int64(len(line))
+		s.depth++
+	}
+	// drop the line cut by a crash
+	if end != s.size {
+		if err := s.log.Truncate(end); err != nil {
+			s.log.Close()
+			return nil, err
+		}
+		s.size = end
+	}
+	if s.depth > 0 {
+		logger.Infof("%d records spooled in %s are waiting to be written", s.depth, dir)
+	}
+	return s, nil
+}
+
+func (s *Spool) open() error {
+	if s.log != nil {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	// reads use ReadAt, so the appends can't move their offset
+	log, err := os.OpenFile(filepath.Join(s.dir, spoolLog), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := log.Stat()
+	if err != nil {
+		log.Close()
+		return err
+	}
+	s.log = log
+	s.size = info.Size()
+	return nil
+}
+
+// Len is the number of records waiting to be written
+func (s *Spool) Len() int64 {
+	return atomic.LoadInt64(&s.depth)
+}
+
+// Stats returns a snapshot of the spool
+func (s *Spool) Stats() SpoolStats {
+	return SpoolStats{
+		Depth:   atomic.LoadInt64(&s.depth),
+		Bytes:   atomic.LoadInt64(&s.size) - atomic.LoadInt64(&s.offset),
+		Dropped: atomic.LoadUint64(&s.dropped),
+	}
+}
+
+// Append writes the records at the end of the log.
+// The records which don't fit in the size cap or can't be encoded, e.g. with a NaN payload, are dropped.
+func (s *Spool) Append(collection string, records []MQTTRecord) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	var n int64
+	for i := range records {
+		line, err := json.Marshal(spoolEntry{Collection: collection, Record: records[i]})
+		if err != nil {
+			// the record could never be read back, it mustn't take the rest of the batch with it
+			atomic.AddUint64(&s.dropped, 1)
+			logger.Errorf("spool %s: dropping the record %s of %s: %v", s.dir, records[i].ID.Hex(), records[i].Topic, err)
+			continue
+		}
+		if s.size+int64(buf.Len()+len(line)+1) > s.maxSize {
+			atomic.AddUint64(&s.dropped, uint64(len(records)-i))
+			if !s.full {
+				logger.Errorf("spool %s is full (%d bytes), dropping records", s.dir, s.maxSize)
+				s.full = true
+			}
+			break
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	if _, err := s.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.size, int64(buf.Len()))
+	atomic.AddInt64(&s.depth, n)
+	return nil
+}
+
+// Replay writes up to max records of the head of the log to the store.
+// The offset only moves once the store took the records, except those it rejected in a *BatchError,
+// which are dead-lettered and counted as dropped.
+func (s *Spool) Replay(store Store, max int) error {
+	if s.Len() == 0 {
+		return nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(s.log, s.offset, s.size-s.offset))
+	var collections []string
+	batches := make(map[string][]MQTTRecord)
+	var read int64
+	var n int
+	for ; n < max; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		read += int64(len(line))
+		var entry spoolEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			logger.Errorf("spool %s: skipping a record at %d: %v", s.dir, s.offset+read-int64(len(line)), err)
+			continue
+		}
+		if _, ok := batches[entry.Collection]; !ok {
+			collections = append(collections, entry.Collection)
+		}
+		batches[entry.Collection] = append(batches[entry.Collection], entry.Record)
+	}
+	for _, collection := range collections {
+		err := createRecords(store, collection, batches[collection])
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			// the store took the other records, retrying the rejected ones would block the spool
+			s.deadLetter(collection, batches[collection], batchErr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&s.offset, read)
+	atomic.AddInt64(&s.depth, -int64(n))
+	if s.offset == s.size {
+		// everything is replayed, start over
+		if err := s.log.Truncate(0); err != nil {
+			return err
+		}
+		atomic.StoreInt64(&s.size, 0)
+		atomic.StoreInt64(&s.offset, 0)
+		s.full = false
+	}
+	return s.saveOffset()
+}
+
+// deadLetter appends the records of the batch which failed to the dead letter log and drops them
+func (s *Spool) deadLetter(collection string, records []MQTTRecord, batchErr *BatchError) {
+	atomic.AddUint64(&s.dropped, uint64(len(batchErr.Failed)))
+	path := filepath.Join(s.dir, spoolDead)
+	logger.Errorf("spool %s: dropping %d records of %s rejected by the store, they are kept in %s: %v",
+		s.dir, len(batchErr.Failed), collection, path, batchErr.Err)
+	var buf bytes.Buffer
+	for _, i := range batchErr.Failed {
+		line, err := json.Marshal(spoolEntry{Collection: collection, Record: records[i]})
+		if err != nil {
+			logger.Errorf("spool %s: %v", s.dir, err)
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	dead, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Errorf("spool %s: %v", s.dir, err)
+		return
+	}
+	defer dead.Close()
+	if _, err = dead.Write(buf.Bytes()); err != nil {
+		logger.Errorf("spool %s: %v", s.dir, err)
+	}
+}
+
+// saveOffset replaces the offset file atomically
+func (s *Spool) saveOffset() error {
+	path := filepath.Join(s.dir, spoolOffset)
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatInt(s.offset, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Close closes the log, the records not replayed are kept for the next run
+func (s *Spool) Close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingStore rejects the records with a negative payload one by one,
+// and every batch while down is set
+type failingStore struct {
+	*MemoryStore
+	down bool
+}
+
+func (s *failingStore) CreateRecords(collection string, data []MQTTRecord) error {
+	if s.down {
+		return errors.New("connection refused")
+	}
+	var failed []int
+	var good []MQTTRecord
+	for i := range data {
+		if data[i].Payload < 0 {
+			failed = append(failed, i)
+			continue
+		}
+		good = append(good, data[i])
+	}
+	if err := s.MemoryStore.CreateRecords(collection, good); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed, Err: errors.New("invalid payload")}
+	}
+	return nil
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	records := testRecords()
+	records[2].Payload = -1
+	if err = spool.Append("c", records); err != nil {
+		t.Fatal(err)
+	}
+	store := &failingStore{MemoryStore: NewMemoryStore(), down: true}
+
+	// the store is down, nothing moves
+	if err = spool.Replay(store, 3); err == nil {
+		t.Fatal("replay succeeded while the store is down")
+	}
+	if stats := spool.Stats(); stats.Depth != int64(len(records)) || stats.Dropped != 0 {
+		t.Fatalf("got %+v after a failed replay", stats)
+	}
+
+	// the rejected record doesn't block the next ones
+	store.down = false
+	for spool.Len() > 0 {
+		if err = spool.Replay(store, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := spool.Stats(); stats.Dropped != 1 || stats.Bytes != 0 {
+		t.Errorf("got %+v, want 1 dropped record", stats)
+	}
+	stored, err := store.GetRecords("c", Query{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := payloads(stored), []float64{0, 1, 3, 4, 5, 6, 7}; !equalFloats(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+	dead, err := ioutil.ReadFile(filepath.Join(dir, spoolDead))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(dead)), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], records[2].ID.Hex()) {
+		t.Errorf("dead letters: %q", dead)
+	}
+}
+
+func TestSpoolAppendUnencodable(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	records := testRecords()
+	records[3].Payload = math.NaN()
+	if err = spool.Append("c", records); err != nil {
+		t.Fatal(err)
+	}
+	if stats := spool.Stats(); stats.Depth != int64(len(records)-1) || stats.Dropped != 1 {
+		t.Fatalf("got %+v, want the NaN record dropped", stats)
+	}
+	store := NewMemoryStore()
+	if err = spool.Replay(store, 100); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.GetRecords("c", Query{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := payloads(stored), []float64{0, 1, 2, 4, 5, 6, 7}; !equalFloats(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
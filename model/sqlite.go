@@ -0,0 +1,463 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	// pure Go SQLite driver, no cgo needed
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore stores the records of every collection in a single SQLite table.
+// Timestamps are stored as Unix nanoseconds so they can be compared and sorted as integers,
+// they are read back in UTC like the other stores.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS records (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		collection TEXT    NOT NULL,
+		topic      TEXT    NOT NULL DEFAULT '',
+		payload    REAL    NOT NULL,
+		timestamp  INTEGER NOT NULL,
+		client_id  TEXT    NOT NULL DEFAULT '',
+		username   TEXT    NOT NULL DEFAULT '',
+		qos        INTEGER NOT NULL DEFAULT 0,
+		retain     INTEGER NOT NULL DEFAULT 0,
+		packet_id  INTEGER NOT NULL DEFAULT 0,
+		fields     TEXT    NOT NULL DEFAULT '',
+		uid        TEXT    NOT NULL DEFAULT '',
+		measured_at INTEGER
+	)`,
+}
+
+// sqliteColumns are added to databases created by older versions of the bridge
+var sqliteColumns = []struct{ name, definition string }{
+	{"topic", "TEXT NOT NULL DEFAULT ''"},
+	{"fields", "TEXT NOT NULL DEFAULT ''"},
+	{"uid", "TEXT NOT NULL DEFAULT ''"},
+	{"measured_at", "INTEGER"},
+}
+
+var sqliteIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS records_collection_timestamp ON records (collection, timestamp)`,
+	`CREATE INDEX IF NOT EXISTS records_collection_topic_timestamp ON records (collection, topic, timestamp)`,
+	`CREATE INDEX IF NOT EXISTS records_timestamp ON records (timestamp)`,
+	`CREATE INDEX IF NOT EXISTS records_collection_measured_at ON records (collection, measured_at) WHERE measured_at IS NOT NULL`,
+	// the rows inserted before uid was added have none
+	`CREATE UNIQUE INDEX IF NOT EXISTS records_uid ON records (uid) WHERE uid != ''`,
+}
+
+// NewSQLiteStore opens (or creates) the database file at path and creates the schema if needed
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	// SQLite only allows a single writer anyway
+	db.SetMaxOpenConns(1)
+	if err = migrateSQLite(db); err != nil {
+		logger.Error(err)
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// migrateSQLite creates the schema, adds the missing columns and creates the indexes
+func migrateSQLite(db *sql.DB) error {
+	for _, stmt := range sqliteSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('records')`)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	for _, col := range sqliteColumns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err = db.Exec(`ALTER TABLE records ADD COLUMN ` + col.name + ` ` + col.definition); err != nil {
+			return err
+		}
+	}
+	for _, stmt := range sqliteIndexes {
+		if _, err = db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the records already stored are ignored
+const sqliteInsert = `INSERT INTO records (collection, topic, payload, timestamp, client_id, username, qos, retain, packet_id, fields, uid, measured_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (uid) WHERE uid != '' DO NOTHING`
+
+// sqliteExecer is either the database or a transaction
+type sqliteExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertSQLite(db sqliteExecer, collection string, data *MQTTRecord) error {
+	fields, err := encodeFields(data.Fields)
+	if err != nil {
+		return err
+	}
+	var measuredAt sql.NullInt64
+	if data.MeasuredAt != nil {
+		measuredAt = sql.NullInt64{Int64: data.MeasuredAt.UnixNano(), Valid: true}
+	}
+	_, err = db.Exec(sqliteInsert,
+		collection, data.Topic, data.Payload, data.Timestamp.UnixNano(),
+		data.ClientID, data.Username, data.QoS, data.Retain, data.PacketID, fields, uid(data.ID), measuredAt)
+	return err
+}
+
+func (s *SQLiteStore) CreateRecord(collection string, data MQTTRecord) error {
+	err := insertSQLite(s.db, collection, &data)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	return err
+}
+
+// CreateRecords inserts the batch in a single transaction, which is much faster than one insert per record.
+// Each record is inserted under a savepoint, so the ones failing don't roll back the rest of the batch.
+func (s *SQLiteStore) CreateRecords(collection string, data []MQTTRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		logger.Error(err)
+		return err
+	}
+	var failed []int
+	var insertErr error
+	for i := range data {
+		if _, err = tx.Exec(`SAVEPOINT record`); err != nil {
+			logger.Error(err)
+			tx.Rollback()
+			return err
+		}
+		if err = insertSQLite(tx, collection, &data[i]); err != nil {
+			logger.Error(err)
+			failed = append(failed, i)
+			insertErr = err
+			_, err = tx.Exec(`ROLLBACK TO record`)
+		}
+		if err == nil {
+			_, err = tx.Exec(`RELEASE record`)
+		}
+		if err != nil {
+			logger.Error(err)
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		logger.Error(err)
+		return err
+	}
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed, Err: insertErr}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetRecords(collection string, q Query) ([]MQTTRecord, error) {
+	where, args := q.sql(collection)
+	order := "ASC"
+	if q.IsDescend {
+		order = "DESC"
+	}
+	column := q.timeKey()
+	stmt := `SELECT uid, topic, payload, timestamp, client_id, username, qos, retain, packet_id, fields, measured_at FROM records
+		WHERE ` + where + ` ORDER BY ` + column + ` ` + order + `, uid ` + order + `, id ` + order + ` LIMIT ? OFFSET ?`
+	args = append(args, q.limit(), q.skip())
+	rows, err := s.db.Query(stmt, args...)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []MQTTRecord
+	for rows.Next() {
+		var result MQTTRecord
+		var ts int64
+		var measuredAt sql.NullInt64
+		var id, fields string
+		err := rows.Scan(&id, &result.Topic, &result.Payload, &ts, &result.ClientID, &result.Username,
+			&result.QoS, &result.Retain, &result.PacketID, &fields, &measuredAt)
+		if err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		result.Timestamp = time.Unix(0, ts).UTC()
+		if measuredAt.Valid {
+			t := time.Unix(0, measuredAt.Int64).UTC()
+			result.MeasuredAt = &t
+		}
+		if id != "" {
+			if result.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+				logger.Error(err)
+				return nil, err
+			}
+		}
+		if result.Fields, err = decodeFields(fields); err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, rows.Err()
+}
+
+// sqliteStreamBatch is the number of records read by each query of StreamRecords
+const sqliteStreamBatch = 1000
+
+// StreamRecords reads the records by batches following each other by their cursor,
+// so the only connection isn't held and the writes go on during a long export
+func (s *SQLiteStore) StreamRecords(ctx context.Context, collection string, q Query,
+	each func(r *MQTTRecord) error) error {
+	q.IsDescend, q.Page, q.Limit = false, 0, sqliteStreamBatch
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		records, err := s.GetRecords(collection, q)
+		if err != nil {
+			return err
+		}
+		for i := range records {
+			if err := each(&records[i]); err != nil {
+				return err
+			}
+		}
+		if len(records) < sqliteStreamBatch {
+			return nil
+		}
+		after := q.cursor(&records[len(records)-1])
+		q.After = &after
+	}
+}
+
+func (s *SQLiteStore) GetTopics(collection string) ([]TopicInfo, error) {
+	rows, err := s.db.Query(
+		`SELECT topic, COUNT(*), MIN(timestamp), MAX(timestamp) FROM records
+		WHERE collection = ? GROUP BY topic ORDER BY topic`, collection)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []TopicInfo
+	for rows.Next() {
+		info := TopicInfo{Collection: collection}
+		var first, last int64
+		if err := rows.Scan(&info.Topic, &info.Count, &first, &last); err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		info.First = time.Unix(0, first).UTC()
+		info.Last = time.Unix(0, last).UTC()
+		results = append(results, info)
+	}
+
+	return results, rows.Err()
+}
+
+func (s *SQLiteStore) Aggregate(collection string, q AggregateQuery) ([]Bucket, error) {
+	rq := q.records()
+	where, args := rq.sql(collection)
+	value := "payload"
+	if q.Field != "" {
+		value = "json_extract(NULLIF(fields, ''), ?)"
+		args = append([]interface{}{`$."` + q.Field + `"`}, args...)
+	}
+	bucket := q.Bucket.Nanoseconds()
+	// the window functions are only computed when first or last is requested
+	first, last := "NULL", "NULL"
+	if q.has(AggFirst) || q.has(AggLast) {
+		first = "FIRST_VALUE(v) OVER (PARTITION BY bucket ORDER BY t, id)"
+		last = "FIRST_VALUE(v) OVER (PARTITION BY bucket ORDER BY t DESC, id DESC)"
+	}
+	column := rq.timeKey()
+	stmt := `SELECT bucket, COUNT(*), MIN(v), MAX(v), SUM(v), SUM(v * v), MAX(first), MAX(last) FROM (
+			SELECT bucket, v, ` + first + ` AS first, ` + last + ` AS last FROM (
+				SELECT id, ` + column + ` AS t, ` + column + ` - ` + column + ` % ? AS bucket, ` + value + ` AS v FROM records
+				WHERE ` + where + `
+			) WHERE v IS NOT NULL
+		) GROUP BY bucket ORDER BY bucket`
+	args = append([]interface{}{bucket}, args...)
+	rows, err := s.db.Query(stmt, args...)
+	if err != nil {
+		logger.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]Bucket, 0)
+	for rows.Next() {
+		var stats bucketStats
+		var start int64
+		var first, last sql.NullFloat64
+		err := rows.Scan(&start, &stats.count, &stats.min, &stats.max, &stats.sum, &stats.sumSquares, &first, &last)
+		if err != nil {
+			logger.Error(err)
+			return nil, err
+		}
+		stats.start = time.Unix(0, start).UTC()
+		stats.first, stats.last = first.Float64, last.Float64
+		results = append(results, stats.bucket(&q))
+	}
+
+	return results, rows.Err()
+}
+
+// sqliteDeleteBatch bounds the rows deleted by a statement, so the writes of the bridge aren't blocked for long
+const sqliteDeleteBatch = 10000
+
+func (s *SQLiteStore) DeleteRecords(collection string, q Query) (int64, error) {
+	q.After = nil
+	where, args := q.sql(collection)
+	stmt := `DELETE FROM records WHERE id IN (SELECT id FROM records WHERE ` + where + ` LIMIT ?)`
+	args = append(args, sqliteDeleteBatch)
+	var deleted int64
+	for {
+		result, err := s.db.Exec(stmt, args...)
+		if err != nil {
+			logger.Error(err)
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			logger.Error(err)
+			return deleted, err
+		}
+		deleted += n
+		if n < sqliteDeleteBatch {
+			return deleted, nil
+		}
+	}
+}
+
+func (s *SQLiteStore) Stats(collection string) (CollectionStats, error) {
+	stats := CollectionStats{Collection: collection}
+	var oldest, size sql.NullInt64
+	// the size is estimated from the length of the columns, the fixed ones taking 56 bytes
+	err := s.db.QueryRow(
+		`SELECT COUNT(*), MIN(timestamp), SUM(56 + LENGTH(topic) + LENGTH(client_id) + LENGTH(username)
+			+ LENGTH(fields) + LENGTH(uid)) FROM records WHERE collection = ?`, collection).
+		Scan(&stats.Count, &oldest, &size)
+	if err != nil {
+		logger.Error(err)
+		return stats, err
+	}
+	stats.Size = size.Int64
+	if oldest.Valid {
+		t := time.Unix(0, oldest.Int64).UTC()
+		stats.Oldest = &t
+	}
+	return stats, nil
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// uid stores the ID of a record as hex, or an empty string if it has none
+func uid(id primitive.ObjectID) string {
+	if id.IsZero() {
+		return ""
+	}
+	return id.Hex()
+}
+
+// encodeFields stores the fields of a record as a JSON object, or '' if there is none
+func encodeFields(fields map[string]float64) (string, error) {
+	if len(fields) == 0 {
+		return "", nil
+	}
+	content, err := json.Marshal(fields)
+	return string(content), err
+}
+
+func decodeFields(content string) (map[string]float64, error) {
+	if content == "" {
+		return nil, nil
+	}
+	var fields map[string]float64
+	err := json.Unmarshal([]byte(content), &fields)
+	return fields, err
+}
+
+// sql converts the Query to a WHERE clause and its arguments
+func (q *Query) sql(collection string) (string, []interface{}) {
+	conds := []string{"collection = ?"}
+	args := []interface{}{collection}
+	column := q.timeKey()
+	if q.Time == TimeMeasured {
+		// the records without a measured time are left out
+		conds = append(conds, "measured_at IS NOT NULL")
+	}
+	if !q.Start.IsZero() {
+		conds = append(conds, column+" >= ?")
+		args = append(args, q.Start.UnixNano())
+	}
+	if !q.End.IsZero() {
+		conds = append(conds, column+" <= ?")
+		args = append(args, q.End.UnixNano())
+	}
+	if q.After != nil {
+		// the uid is the hex ID, which sorts like the ID
+		op := ">"
+		if q.IsDescend {
+			op = "<"
+		}
+		conds = append(conds, "("+column+" "+op+" ? OR ("+column+" = ? AND uid "+op+" ?))")
+		ts := q.After.Timestamp.UnixNano()
+		args = append(args, ts, ts, uid(q.After.ID))
+	}
+	if q.Filter.Topic != "" {
+		conds = append(conds, "topic = ?")
+		args = append(args, q.Filter.Topic)
+	}
+	if q.Filter.ClientID != "" {
+		conds = append(conds, "client_id = ?")
+		args = append(args, q.Filter.ClientID)
+	}
+	if q.Filter.Username != "" {
+		conds = append(conds, "username = ?")
+		args = append(args, q.Filter.Username)
+	}
+	if q.Filter.QoS != nil {
+		conds = append(conds, "qos = ?")
+		args = append(args, *q.Filter.QoS)
+	}
+	return strings.Join(conds, " AND "), args
+}
@@ -0,0 +1,170 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Store is the storage backend of MQTT records.
+// A collection holds the records of the topics routed to it.
+type Store interface {
+	CreateRecord(collection string, data MQTTRecord) error
+	// CreateRecords inserts a batch of records. The records that failed are not
+	// inserted in order, a *BatchError tells which of them failed.
+	CreateRecords(collection string, data []MQTTRecord) error
+	GetRecords(collection string, q Query) ([]MQTTRecord, error)
+	// StreamRecords calls each on every record of the query by ascending (timestamp, id) of the query,
+	// without holding all of them in memory. Page, Limit and IsDescend are ignored.
+	// It stops at the first error of each or when ctx is done.
+	StreamRecords(ctx context.Context, collection string, q Query, each func(r *MQTTRecord) error) error
+	// GetTopics summarizes the topics stored in the collection, sorted by topic
+	GetTopics(collection string) ([]TopicInfo, error)
+	// Aggregate returns the buckets of a validated query holding records, sorted by start
+	Aggregate(collection string, q AggregateQuery) ([]Bucket, error)
+	// DeleteRecords deletes the records of the query and returns their number.
+	// Page, Limit, After and IsDescend are ignored.
+	DeleteRecords(collection string, q Query) (int64, error)
+	// Stats returns the number of records of the collection, their size and the oldest one
+	Stats(collection string) (CollectionStats, error)
+	// Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// IndexedStore is implemented by the stores whose indexes are created for each collection
+type IndexedStore interface {
+	// EnsureIndexes creates the indexes of the queries on the collection, if they don't exist yet
+	EnsureIndexes(collection string) error
+}
+
+// BatchError is returned by CreateRecords when only some records of the batch were inserted
+type BatchError struct {
+	// Failed holds the indexes of the records which were not inserted
+	Failed []int
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d records of the batch failed: %v", len(e.Failed), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// TopicInfo summarizes the records of a topic
+type TopicInfo struct {
+	Topic      string `json:"topic" example:"site1/room3/temperature"`
+	Collection string `json:"collection" example:"temperature"`
+	Count      int64  `json:"count" example:"42"`
+	// Timestamp of the oldest record. Time RFC3339
+	First time.Time `json:"first" example:"2020-01-01T00:00:00Z"`
+	// Timestamp of the latest record. Time RFC3339
+	Last time.Time `json:"last" example:"2022-01-01T00:00:00Z"`
+}
+
+// CollectionStats tells how much a collection holds
+type CollectionStats struct {
+	Collection string `json:"collection" example:"temperature"`
+	Count      int64  `json:"count" example:"86400"`
+	// Size of the records in bytes, estimated by the SQLite and memory stores
+	Size int64 `json:"size" example:"10368000"`
+	// Timestamp of the oldest record, omitted if there is none. Time RFC3339
+	Oldest *time.Time `json:"oldest,omitempty" example:"2020-01-01T00:00:00Z"`
+}
+
+// Query describes which records of a collection should be returned
+type Query struct {
+	// Start is ignored if zero
+	Start time.Time
+	// End is ignored if zero
+	End time.Time
+	// Page is from 1 to infinity, ignored if After is set
+	Page int64
+	// Limit is the number of records of a page, 10 if zero
+	Limit int64
+	// After returns the records following this cursor in the order of the query
+	After     *Cursor
+	IsDescend bool
+	// Time is the timestamp the records are filtered and sorted on, TimeReceived if empty.
+	// Only the records with a measured time are returned when it's TimeMeasured.
+	Time   string
+	Filter RecordFilter
+}
+
+// PageQuery returns the Query of the latest records on a page
+func PageQuery(page int64, f RecordFilter) Query {
+	return Query{Page: page, IsDescend: true, Filter: f}
+}
+
+// limit returns the number of records of a page
+func (q *Query) limit() int64 {
+	if q.Limit <= 0 {
+		return recordPerPage
+	}
+	return q.Limit
+}
+
+// skip returns the number of records before the page
+func (q *Query) skip() int64 {
+	if q.Page <= 0 || q.After != nil {
+		return 0
+	}
+	return q.limit() * (q.Page - 1)
+}
+
+// timeOf returns the timestamp of the record the query is on, false if the record has none
+func (q *Query) timeOf(r *MQTTRecord) (time.Time, bool) {
+	if q.Time != TimeMeasured {
+		return r.Timestamp, true
+	}
+	if r.MeasuredAt == nil {
+		return time.Time{}, false
+	}
+	return *r.MeasuredAt, true
+}
+
+// timeKey returns the name of the timestamp the query is on in the stores
+func (q *Query) timeKey() string {
+	if q.Time == TimeMeasured {
+		return "measured_at"
+	}
+	return "timestamp"
+}
+
+// Match reports whether the record is in the time range, follows the cursor and satisfies the filter
+func (q *Query) Match(r *MQTTRecord) bool {
+	t, ok := q.timeOf(r)
+	if !ok || !q.follows(r) {
+		return false
+	}
+	if !q.Start.IsZero() && t.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && t.After(q.End) {
+		return false
+	}
+	return q.Filter.Match(r)
+}
+
+// OpenStore opens the storage backend described by spec.
+// spec is "mongo", "memory" or "sqlite:/path/to/file.db".
+// mongoURL and database are only used by the MongoDB backend.
+func OpenStore(spec string, mongoURL string, database string) (Store, error) {
+	kinds := strings.SplitN(spec, ":", 2)
+	switch kinds[0] {
+	case "mongo", "mongodb":
+		return NewMongoStore(mongoURL, database)
+	case "memory":
+		return NewMemoryStore(), nil
+	case "sqlite":
+		if len(kinds) < 2 || kinds[1] == "" {
+			return nil, fmt.Errorf("sqlite store needs a path, e.g. sqlite:/var/lib/mqtt.db")
+		}
+		return NewSQLiteStore(kinds[1])
+	default:
+		return nil, fmt.Errorf("unknown store %q", spec)
+	}
+}
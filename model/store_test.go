@@ -0,0 +1,429 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// base is the timestamp of the first test record
+var base = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testStores returns an empty store of each backend which doesn't need a server
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	sqlite, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"sqlite": sqlite,
+	}
+}
+
+// testRecord returns a record of the topic published by the client, i minutes after base
+func testRecord(topic, clientID string, i int) MQTTRecord {
+	return MQTTRecord{
+		ID:        primitive.NewObjectID(),
+		Topic:     topic,
+		Payload:   float64(i),
+		Timestamp: base.Add(time.Duration(i) * time.Minute),
+		ClientID:  clientID,
+		Username:  "user-" + clientID,
+		QoS:       uint8(i % 2),
+	}
+}
+
+// testRecords are 6 records of a/1 by s1 and s2, then 2 records of a/2 by s1
+func testRecords() []MQTTRecord {
+	var records []MQTTRecord
+	for i := 0; i < 6; i++ {
+		records = append(records, testRecord("a/1", []string{"s1", "s2"}[i%2], i))
+	}
+	for i := 6; i < 8; i++ {
+		records = append(records, testRecord("a/2", "s1", i))
+	}
+	return records
+}
+
+// payloads returns the payloads of the records in order
+func payloads(records []MQTTRecord) []float64 {
+	values := make([]float64, len(records))
+	for i := range records {
+		values[i] = records[i].Payload
+	}
+	return values
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGetRecords(t *testing.T) {
+	qos1 := uint8(1)
+	tests := []struct {
+		name string
+		q    Query
+		want []float64
+	}{
+		{"ascending", Query{Limit: 100}, []float64{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"descending", Query{Limit: 100, IsDescend: true}, []float64{7, 6, 5, 4, 3, 2, 1, 0}},
+		{"default limit", Query{}, []float64{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"first page", Query{Page: 1, Limit: 3}, []float64{0, 1, 2}},
+		{"third page", Query{Page: 3, Limit: 3}, []float64{6, 7}},
+		{"page past the end", Query{Page: 4, Limit: 3}, []float64{}},
+		{"latest page", PageQuery(1, RecordFilter{}), []float64{7, 6, 5, 4, 3, 2, 1, 0}},
+		{"start", Query{Start: base.Add(5 * time.Minute)}, []float64{5, 6, 7}},
+		{"end", Query{End: base.Add(2 * time.Minute)}, []float64{0, 1, 2}},
+		{"range", Query{Start: base.Add(2 * time.Minute), End: base.Add(4 * time.Minute)}, []float64{2, 3, 4}},
+		{"topic", Query{Filter: RecordFilter{Topic: "a/2"}}, []float64{6, 7}},
+		{"client", Query{Filter: RecordFilter{ClientID: "s2"}}, []float64{1, 3, 5}},
+		{"username", Query{Filter: RecordFilter{Username: "user-s1"}}, []float64{0, 2, 4, 6, 7}},
+		{"qos", Query{Filter: RecordFilter{QoS: &qos1}}, []float64{1, 3, 5, 7}},
+		{"topic and client", Query{Filter: RecordFilter{Topic: "a/1", ClientID: "s1"}}, []float64{0, 2, 4}},
+		{"no match", Query{Filter: RecordFilter{Topic: "b"}}, []float64{}},
+	}
+	for name, store := range testStores(t) {
+		if err := store.CreateRecords("c", testRecords()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tt := range tests {
+			records, err := store.GetRecords("c", tt.q)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, tt.name, err)
+				continue
+			}
+			if got := payloads(records); !equalFloats(got, tt.want) {
+				t.Errorf("%s %s: got %v, want %v", name, tt.name, got, tt.want)
+			}
+		}
+		records, err := store.GetRecords("other", Query{})
+		if err != nil || len(records) != 0 {
+			t.Errorf("%s: other collection: got %d records, %v", name, len(records), err)
+		}
+	}
+}
+
+func TestCreateRecordsDedupe(t *testing.T) {
+	for name, store := range testStores(t) {
+		records := testRecords()
+		if err := store.CreateRecords("c", records); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// the records already stored are skipped
+		if err := store.CreateRecords("c", records[:3]); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := store.GetRecords("c", Query{Limit: 100})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(got) != len(records) {
+			t.Errorf("%s: got %d records, want %d", name, len(got), len(records))
+		}
+	}
+}
+
+func TestSQLiteBatchError(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records := testRecords()
+	// NaN is stored as NULL, which the payload column refuses
+	records[1].Payload = math.NaN()
+	records[4].Payload = math.NaN()
+	err = store.CreateRecords("c", records)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 2 || batchErr.Failed[0] != 1 || batchErr.Failed[1] != 4 {
+		t.Fatalf("got %v, want the records 1 and 4 failed", err)
+	}
+	stored, err := store.GetRecords("c", Query{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := payloads(stored), []float64{0, 2, 3, 5, 6, 7}; !equalFloats(got, want) {
+		t.Errorf("stored %v, want %v", got, want)
+	}
+}
+
+func TestRecordFilter(t *testing.T) {
+	qos0, qos1 := uint8(0), uint8(1)
+	r := &MQTTRecord{Topic: "a/1", ClientID: "s1", Username: "u", QoS: 1}
+	tests := []struct {
+		filter RecordFilter
+		want   bool
+	}{
+		{RecordFilter{}, true},
+		{RecordFilter{Topic: "a/1"}, true},
+		{RecordFilter{Topic: "a/2"}, false},
+		{RecordFilter{ClientID: "s1", Username: "u"}, true},
+		{RecordFilter{ClientID: "s2"}, false},
+		{RecordFilter{Username: "v"}, false},
+		{RecordFilter{QoS: &qos1}, true},
+		{RecordFilter{QoS: &qos0}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Match(r); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestGetTopics(t *testing.T) {
+	for name, store := range testStores(t) {
+		if err := store.CreateRecords("c", testRecords()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		topics, err := store.GetTopics("c")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := []TopicInfo{
+			{Topic: "a/1", Collection: "c", Count: 6, First: base, Last: base.Add(5 * time.Minute)},
+			{Topic: "a/2", Collection: "c", Count: 2, First: base.Add(6 * time.Minute), Last: base.Add(7 * time.Minute)},
+		}
+		if len(topics) != len(want) {
+			t.Fatalf("%s: got %+v, want %+v", name, topics, want)
+		}
+		for i := range want {
+			got := topics[i]
+			if got.Topic != want[i].Topic || got.Collection != want[i].Collection || got.Count != want[i].Count ||
+				!got.First.Equal(want[i].First) || !got.Last.Equal(want[i].Last) {
+				t.Errorf("%s: got %+v, want %+v", name, got, want[i])
+			}
+		}
+		if topics, err = store.GetTopics("other"); err != nil || len(topics) != 0 {
+			t.Errorf("%s: other collection: got %+v, %v", name, topics, err)
+		}
+	}
+}
+
+func TestDeleteRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       Query
+		deleted int64
+		left    []float64
+	}{
+		{"nothing", Query{Filter: RecordFilter{Topic: "b"}}, 0, []float64{0, 1, 2, 3, 4, 5, 6, 7}},
+		{"older", Query{End: base.Add(2 * time.Minute)}, 3, []float64{3, 4, 5, 6, 7}},
+		{"older of a topic", Query{End: base.Add(6 * time.Minute), Filter: RecordFilter{Topic: "a/2"}}, 1,
+			[]float64{0, 1, 2, 3, 4, 5, 7}},
+		{"client", Query{Filter: RecordFilter{ClientID: "s2"}}, 3, []float64{0, 2, 4, 6, 7}},
+		// the page and the limit are ignored
+		{"everything", Query{Page: 2, Limit: 1}, 8, []float64{}},
+	}
+	for _, tt := range tests {
+		for name, store := range testStores(t) {
+			if err := store.CreateRecords("c", testRecords()); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if err := store.CreateRecords("other", testRecords()[:1]); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			deleted, err := store.DeleteRecords("c", tt.q)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, tt.name, err)
+				continue
+			}
+			if deleted != tt.deleted {
+				t.Errorf("%s %s: deleted %d, want %d", name, tt.name, deleted, tt.deleted)
+			}
+			records, err := store.GetRecords("c", Query{Limit: 100})
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if got := payloads(records); !equalFloats(got, tt.left) {
+				t.Errorf("%s %s: left %v, want %v", name, tt.name, got, tt.left)
+			}
+			if other, _ := store.GetRecords("other", Query{}); len(other) != 1 {
+				t.Errorf("%s %s: the other collection has %d records left", name, tt.name, len(other))
+			}
+		}
+	}
+}
+
+func TestTimestampsUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+1", 3600)
+	defer func() { time.Local = local }()
+	for name, store := range testStores(t) {
+		r := testRecord("a/1", "s1", 0)
+		measuredAt := base.Add(-time.Second)
+		r.MeasuredAt = &measuredAt
+		if err := store.CreateRecord("c", r); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		records, err := store.GetRecords("c", Query{})
+		if err != nil || len(records) != 1 {
+			t.Fatalf("%s: got %d records, %v", name, len(records), err)
+		}
+		if loc := records[0].Timestamp.Location(); loc != time.UTC {
+			t.Errorf("%s: timestamp in %v", name, loc)
+		}
+		if records[0].MeasuredAt == nil || records[0].MeasuredAt.Location() != time.UTC {
+			t.Errorf("%s: measured_at %v not in UTC", name, records[0].MeasuredAt)
+		}
+		topics, err := store.GetTopics("c")
+		if err != nil || len(topics) != 1 {
+			t.Fatalf("%s: got %+v, %v", name, topics, err)
+		}
+		if topics[0].First.Location() != time.UTC || topics[0].Last.Location() != time.UTC {
+			t.Errorf("%s: topic times not in UTC: %+v", name, topics[0])
+		}
+		stats, err := store.Stats("c")
+		if err != nil || stats.Oldest == nil || stats.Oldest.Location() != time.UTC {
+			t.Errorf("%s: oldest %v not in UTC, %v", name, stats.Oldest, err)
+		}
+	}
+}
+
+// testBucket is the expected content of a Bucket, all the functions being requested
+type testBucket struct {
+	start                               time.Duration
+	min, max, avg, sum, first, last, sd float64
+	count                               int64
+}
+
+func (want testBucket) equal(b Bucket) bool {
+	near := func(got *float64, want float64) bool {
+		return got != nil && math.Abs(*got-want) < 1e-9
+	}
+	return b.Start.Equal(base.Add(want.start)) && b.Count != nil && *b.Count == want.count &&
+		near(b.Min, want.min) && near(b.Max, want.max) && near(b.Avg, want.avg) && near(b.Sum, want.sum) &&
+		near(b.First, want.first) && near(b.Last, want.last) && near(b.StdDev, want.sd)
+}
+
+func TestAggregate(t *testing.T) {
+	sd := math.Sqrt(2.0 / 3)
+	tests := []struct {
+		name string
+		q    AggregateQuery
+		want []testBucket
+	}{
+		// the last bucket ends with the range
+		{"buckets", AggregateQuery{Start: base, End: base.Add(7 * time.Minute), Bucket: 3 * time.Minute},
+			[]testBucket{
+				{0, 0, 2, 1, 3, 0, 2, sd, 3},
+				{3 * time.Minute, 3, 5, 4, 12, 3, 5, sd, 3},
+				{6 * time.Minute, 6, 7, 6.5, 13, 6, 7, 0.5, 2},
+			}},
+		{"partial last bucket", AggregateQuery{Start: base, End: base.Add(6*time.Minute + 30*time.Second),
+			Bucket: 3 * time.Minute},
+			[]testBucket{
+				{0, 0, 2, 1, 3, 0, 2, sd, 3},
+				{3 * time.Minute, 3, 5, 4, 12, 3, 5, sd, 3},
+				{6 * time.Minute, 6, 6, 6, 6, 6, 6, 0, 1},
+			}},
+		// the buckets are aligned on the epoch, not on the start
+		{"unaligned start", AggregateQuery{Start: base.Add(time.Minute), End: base.Add(4 * time.Minute),
+			Bucket: 3 * time.Minute},
+			[]testBucket{
+				{0, 1, 2, 1.5, 3, 1, 2, 0.5, 2},
+				{3 * time.Minute, 3, 4, 3.5, 7, 3, 4, 0.5, 2},
+			}},
+		// the empty buckets are left out
+		{"empty buckets", AggregateQuery{Start: base.Add(-time.Hour), End: base.Add(time.Hour), Bucket: time.Minute,
+			Filter: RecordFilter{ClientID: "s2"}},
+			[]testBucket{
+				{time.Minute, 1, 1, 1, 1, 1, 1, 0, 1},
+				{3 * time.Minute, 3, 3, 3, 3, 3, 3, 0, 1},
+				{5 * time.Minute, 5, 5, 5, 5, 5, 5, 0, 1},
+			}},
+		{"topic", AggregateQuery{Start: base, End: base.Add(time.Hour), Bucket: time.Hour, Filter: RecordFilter{Topic: "a/2"}},
+			[]testBucket{{0, 6, 7, 6.5, 13, 6, 7, 0.5, 2}}},
+		// only the records with the field are aggregated
+		{"field", AggregateQuery{Start: base, End: base.Add(time.Hour), Bucket: 3 * time.Minute, Field: "h"},
+			[]testBucket{
+				{0, 0, 20, 10, 20, 0, 20, 10, 2},
+				{3 * time.Minute, 40, 40, 40, 40, 40, 40, 0, 1},
+				{6 * time.Minute, 60, 60, 60, 60, 60, 60, 0, 1},
+			}},
+		{"no record", AggregateQuery{Start: base.Add(time.Hour), End: base.Add(2 * time.Hour), Bucket: time.Minute},
+			[]testBucket{}},
+	}
+	for name, store := range testStores(t) {
+		records := testRecords()
+		for i := range records {
+			if i%2 == 0 {
+				records[i].Fields = map[string]float64{"h": float64(i * 10)}
+			}
+		}
+		if err := store.CreateRecords("c", records); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tt := range tests {
+			tt.q.Funcs = AggregateFuncs
+			if err := tt.q.Validate(); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			buckets, err := store.Aggregate("c", tt.q)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, tt.name, err)
+				continue
+			}
+			if len(buckets) != len(tt.want) {
+				t.Errorf("%s %s: got %d buckets, want %d", name, tt.name, len(buckets), len(tt.want))
+				continue
+			}
+			for i := range buckets {
+				if !tt.want[i].equal(buckets[i]) {
+					t.Errorf("%s %s: bucket %d: got %s, want %+v", name, tt.name, i, formatBucket(buckets[i]), tt.want[i])
+				}
+			}
+		}
+	}
+}
+
+// TestAggregateFuncs checks only the requested functions are set
+func TestAggregateFuncs(t *testing.T) {
+	for name, store := range testStores(t) {
+		if err := store.CreateRecords("c", testRecords()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		q := AggregateQuery{Start: base, End: base.Add(time.Hour), Bucket: time.Hour, Funcs: []string{AggCount, AggLast}}
+		buckets, err := store.Aggregate("c", q)
+		if err != nil || len(buckets) != 1 {
+			t.Fatalf("%s: got %d buckets, %v", name, len(buckets), err)
+		}
+		b := buckets[0]
+		if b.Count == nil || *b.Count != 8 || b.Last == nil || *b.Last != 7 ||
+			b.Min != nil || b.Max != nil || b.Avg != nil || b.Sum != nil || b.First != nil || b.StdDev != nil {
+			t.Errorf("%s: got %s", name, formatBucket(b))
+		}
+	}
+}
+
+func formatBucket(b Bucket) string {
+	s := b.Start.Format(time.RFC3339)
+	values := []struct {
+		name string
+		v    *float64
+	}{{"min", b.Min}, {"max", b.Max}, {"avg", b.Avg}, {"sum", b.Sum}, {"first", b.First}, {"last", b.Last}, {"stddev", b.StdDev}}
+	for _, v := range values {
+		if v.v != nil {
+			s += fmt.Sprintf(" %s=%v", v.name, *v.v)
+		}
+	}
+	if b.Count != nil {
+		s += fmt.Sprintf(" count=%d", *b.Count)
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamps of a record, a query filters and sorts the records on one of them
+const (
+	// TimeReceived is the time the bridge received the message, the timestamp of the record
+	TimeReceived = "received_at"
+	// TimeMeasured is the time the device measured the reading, only some records have one
+	TimeMeasured = "measured_at"
+)
+
+// DefaultMaxSkew is how far ahead of the bridge the clock of a device may be by default
+const DefaultMaxSkew = time.Minute
+
+// ParseTimeField checks the name of a timestamp, empty meaning TimeReceived
+func ParseTimeField(name string) (string, error) {
+	switch name {
+	case "", TimeReceived:
+		return TimeReceived, nil
+	case TimeMeasured:
+		return TimeMeasured, nil
+	}
+	return "", fmt.Errorf("unknown time %q, expect %s or %s", name, TimeReceived, TimeMeasured)
+}
+
+// ParseTimestamp parses an RFC3339 time, or Unix seconds or milliseconds.
+// Numbers from 1e11 on are milliseconds, 1e11 seconds being in the year 5138.
+func ParseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, fmt.Errorf("missing")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return time.Time{}, fmt.Errorf("invalid time %q, expect RFC3339, Unix seconds or milliseconds", s)
+	}
+	if math.Abs(n) >= 1e11 {
+		n /= 1000
+	}
+	sec, frac := math.Modf(n)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e9))), nil
+}
+
+// TimestampConfig tells a route where the devices put the time they measured their readings.
+//
+//	measured_at:
+//	  property: ts
+//	  field: $.ts
+//	  max_skew: 30s
+//	  max_age: 720h
+type TimestampConfig struct {
+	// MQTT v5 user property holding the time, it's used first if both are set
+	Property string `yaml:"property" json:"property,omitempty"`
+	// JSON path of the time in JSON payloads, like $.ts.
+	// A top-level key is not kept as a field when the fields are not listed.
+	Field string `yaml:"field" json:"field,omitempty"`
+	// How far ahead of the bridge the device clock may be, default 1m
+	MaxSkew time.Duration `yaml:"max_skew" json:"max_skew,omitempty" swaggertype:"string" example:"30s"`
+	// How old a reading may be when the bridge receives it, no limit if zero
+	MaxAge time.Duration `yaml:"max_age" json:"max_age,omitempty" swaggertype:"string" example:"720h"`
+
+	path []pathStep
+}
+
+// validate checks the config of a route whose payload is decoded as format
+func (c *TimestampConfig) validate(format string) error {
+	if c.Property == "" && c.Field == "" {
+		return fmt.Errorf("measured_at needs a property or a field")
+	}
+	if c.Field != "" {
+		if format != FormatJSON {
+			return fmt.Errorf("measured_at.field needs a json payload")
+		}
+		steps, err := parsePath(c.Field)
+		if err != nil {
+			return fmt.Errorf("measured_at.field: %w", err)
+		}
+		c.path = steps
+	}
+	if c.MaxSkew < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("measured_at.max_skew and measured_at.max_age can't be negative")
+	}
+	return nil
+}
+
+// topLevelKey returns the key of the field if it's a top-level key of the payload
+func (c *TimestampConfig) topLevelKey() string {
+	if len(c.path) == 1 && c.path[0].isKey {
+		return c.path[0].key
+	}
+	return ""
+}
+
+// measuredAt returns the time the device measured the message, nil if the message has none.
+// The time is rejected if the device clock is more than MaxSkew ahead of received or the reading is older than MaxAge.
+func (c *TimestampConfig) measuredAt(m *MQTTMsg, received time.Time) (*time.Time, error) {
+	text, ok := m.Properties[c.Property]
+	if c.Property == "" || !ok {
+		if c.path == nil {
+			return nil, nil
+		}
+		var doc interface{}
+		if err := json.Unmarshal([]byte(m.Payload), &doc); err != nil {
+			return nil, err
+		}
+		v, err := walkPath(doc, c.path)
+		if err != nil {
+			// the message has no time
+			return nil, nil
+		}
+		switch val := v.(type) {
+		case float64:
+			text = strconv.FormatFloat(val, 'f', -1, 64)
+		case string:
+			text = val
+		default:
+			return nil, fmt.Errorf("%v is not a time", v)
+		}
+	}
+	t, err := ParseTimestamp(text)
+	if err != nil {
+		return nil, err
+	}
+	maxSkew := c.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	if ahead := t.Sub(received); ahead > maxSkew {
+		return nil, fmt.Errorf("%s is %s ahead of the bridge", t.Format(time.RFC3339Nano), ahead)
+	}
+	if age := received.Sub(t); c.MaxAge > 0 && age > c.MaxAge {
+		return nil, fmt.Errorf("%s is %s old", t.Format(time.RFC3339Nano), age)
+	}
+	return &t, nil
+}
@@ -0,0 +1,168 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"1640995200", base},
+		{" 1640995200 ", base},
+		{"1640995200.5", base.Add(500 * time.Millisecond)},
+		// from 1e11 on, the numbers are milliseconds
+		{"1640995200000", base},
+		{"1640995200500", base.Add(500 * time.Millisecond)},
+		{"99999999999", time.Unix(99999999999, 0)},
+		{"100000000000", time.Unix(100000000, 0)},
+		{"0", time.Unix(0, 0)},
+		{"-86400", time.Unix(-86400, 0)},
+		{"2022-01-01T00:00:00Z", base},
+		{"2022-01-01T01:00:00+01:00", base},
+		{"2021-12-31T19:00:00-05:00", base},
+		{"2022-01-01T00:00:00.123456789Z", base.Add(123456789 * time.Nanosecond)},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.s)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", " ", "abc", "NaN", "Inf", "-Inf", "2022-01-01", "2022-01-01 00:00:00", "12:00"} {
+		if got, err := ParseTimestamp(s); err == nil {
+			t.Errorf("%q: got %v, want an error", s, got)
+		}
+	}
+}
+
+func TestMeasuredTime(t *testing.T) {
+	routes := Routes{
+		{Filter: "json", Collection: "c", Payload: &PayloadConfig{Format: FormatJSON},
+			MeasuredAt: &TimestampConfig{Property: "ts", Field: "$.ts", MaxSkew: 30 * time.Second, MaxAge: time.Hour}},
+		{Filter: "nested", Collection: "c", Payload: &PayloadConfig{Format: FormatJSON},
+			MeasuredAt: &TimestampConfig{Field: "$.meta.time"}},
+		{Filter: "property", Collection: "c", MeasuredAt: &TimestampConfig{Property: "ts"}},
+		{Filter: "none", Collection: "c"},
+	}
+	if err := routes.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	received := base
+	tests := []struct {
+		name       string
+		topic      string
+		payload    string
+		properties map[string]string
+		// zero when the message has no time
+		want time.Time
+		ok   bool
+	}{
+		{"field seconds", "json", `{"t":1,"ts":1640995190}`, nil, base.Add(-10 * time.Second), true},
+		{"field milliseconds", "json", `{"t":1,"ts":1640995190000}`, nil, base.Add(-10 * time.Second), true},
+		{"field RFC3339", "json", `{"t":1,"ts":"2022-01-01T00:59:50+01:00"}`, nil, base.Add(-10 * time.Second), true},
+		{"property first", "json", `{"t":1,"ts":1640995190}`, map[string]string{"ts": "1640995180"},
+			base.Add(-20 * time.Second), true},
+		{"other property", "json", `{"t":1,"ts":1640995190}`, map[string]string{"other": "1640995180"},
+			base.Add(-10 * time.Second), true},
+		{"no time", "json", `{"t":1}`, nil, time.Time{}, true},
+		{"nested field", "nested", `{"t":1,"meta":{"time":"2022-01-01T00:00:00Z"}}`, nil, base, true},
+		{"property", "property", "1", map[string]string{"ts": "2022-01-01T00:00:00Z"}, base, true},
+		{"no property", "property", "1", nil, time.Time{}, true},
+		{"route without time", "none", "1", map[string]string{"ts": "1640995190"}, time.Time{}, true},
+		{"ahead within the skew", "json", `{"ts":1640995230}`, nil, base.Add(30 * time.Second), true},
+		{"ahead beyond the skew", "json", `{"ts":1640995231}`, nil, time.Time{}, false},
+		{"ahead within the default skew", "property", "1", map[string]string{"ts": "1640995260"},
+			base.Add(time.Minute), true},
+		{"ahead beyond the default skew", "property", "1", map[string]string{"ts": "1640995261"}, time.Time{}, false},
+		{"within the max age", "json", `{"ts":1640991600}`, nil, base.Add(-time.Hour), true},
+		{"older than the max age", "json", `{"ts":1640991599}`, nil, time.Time{}, false},
+		{"no max age", "property", "1", map[string]string{"ts": "0"}, time.Unix(0, 0), true},
+		{"invalid time", "json", `{"ts":"yesterday"}`, nil, time.Time{}, false},
+		{"not a time", "json", `{"ts":{"s":1}}`, nil, time.Time{}, false},
+		{"invalid property", "property", "1", map[string]string{"ts": "x"}, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		route, ok := routes.Match(tt.topic)
+		if !ok {
+			t.Fatalf("%s: no route", tt.topic)
+		}
+		msg := &MQTTMsg{Topic: tt.topic, Payload: tt.payload, Properties: tt.properties}
+		got, err := route.MeasuredTime(msg, received)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, %v", tt.name, got, err)
+			continue
+		}
+		// a rejected time leaves the record with its received time only
+		if !tt.ok || tt.want.IsZero() {
+			if got != nil {
+				t.Errorf("%s: got %v, want none", tt.name, got)
+			}
+			continue
+		}
+		if got == nil || !got.Equal(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the time isn't a field of the record
+	route, _ := routes.Match("json")
+	_, fields, err := route.Decoder().Decode(`{"t":1,"h":2,"ts":1640995190}`)
+	if err != nil || len(fields) != 2 {
+		t.Errorf("got the fields %v, %v", fields, err)
+	}
+}
+
+// measuredRecords are 5 records received in order, measured in another order, one of them without a measured time
+func measuredRecords() []MQTTRecord {
+	// minutes before base the reading of each record was measured
+	measured := []int{30, 10, -1, 40, 20}
+	var records []MQTTRecord
+	for i, m := range measured {
+		r := testRecord("a/1", "s1", i)
+		if m >= 0 {
+			t := base.Add(-time.Duration(m) * time.Minute)
+			r.MeasuredAt = &t
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestMeasuredAtQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		q    Query
+		want []float64
+	}{
+		{"received", Query{}, []float64{0, 1, 2, 3, 4}},
+		{"measured", Query{Time: TimeMeasured}, []float64{3, 0, 4, 1}},
+		{"measured descending", Query{Time: TimeMeasured, IsDescend: true}, []float64{1, 4, 0, 3}},
+		{"measured range", Query{Time: TimeMeasured, Start: base.Add(-30 * time.Minute), End: base.Add(-20 * time.Minute)},
+			[]float64{0, 4}},
+		{"measured page", Query{Time: TimeMeasured, Page: 2, Limit: 2}, []float64{4, 1}},
+		// the received time of every record is after the measured range
+		{"received range", Query{Start: base.Add(-30 * time.Minute), End: base.Add(-20 * time.Minute)}, []float64{}},
+	}
+	for name, store := range testStores(t) {
+		if err := store.CreateRecords("c", measuredRecords()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, tt := range tests {
+			records, err := store.GetRecords("c", tt.q)
+			if err != nil {
+				t.Errorf("%s %s: %v", name, tt.name, err)
+				continue
+			}
+			if got := payloads(records); !equalFloats(got, tt.want) {
+				t.Errorf("%s %s: got %v, want %v", name, tt.name, got, tt.want)
+			}
+		}
+	}
+}
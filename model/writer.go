@@ -0,0 +1,129 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+// BatchConfig tells when the records are written to the store
+type BatchConfig struct {
+	// Size is the number of pending records of a collection that triggers a write
+	Size int `yaml:"size"`
+	// Interval is the longest time a record stays pending
+	Interval time.Duration `yaml:"interval"`
+	// Retries of a failed batch before its records are given up
+	Retries int `yaml:"retries"`
+}
+
+var DefaultBatchConfig = BatchConfig{
+	Size:     500,
+	Interval: time.Second,
+	Retries:  3,
+}
+
+// first retry delay, doubled after each retry
+const retryDelay = 100 * time.Millisecond
+
+// batcher accumulates the records of each collection
+type batcher struct {
+	store   Store
+	config  BatchConfig
+	pending map[string][]MQTTRecord
+	// keeps the records the store couldn't take, nil if disabled
+	spool *Spool
+	// set while the replay of the spool fails, to log once per outage
+	replayFailing bool
+}
+
+func newBatcher(store Store, config BatchConfig, spool *Spool) *batcher {
+	if config.Size < 1 {
+		config.Size = 1
+	}
+	return &batcher{
+		store:   store,
+		config:  config,
+		pending: make(map[string][]MQTTRecord),
+		spool:   spool,
+	}
+}
+
+func (b *batcher) add(collection string, record MQTTRecord) {
+	b.pending[collection] = append(b.pending[collection], record)
+	if len(b.pending[collection]) >= b.config.Size {
+		b.flush(collection)
+	}
+}
+
+func (b *batcher) flushAll() {
+	for collection := range b.pending {
+		b.flush(collection)
+	}
+}
+
+// flush writes the pending records of a collection, retrying the failed ones
+func (b *batcher) flush(collection string) {
+	records := b.pending[collection]
+	delete(b.pending, collection)
+	// the store is known to be unavailable and the spooled records must be written first
+	if b.spool != nil && b.spool.Len() > 0 {
+		b.toSpool(collection, records)
+		return
+	}
+	delay := retryDelay
+	for attempt := 0; len(records) > 0; attempt++ {
+		err := createRecords(b.store, collection, records)
+		if err == nil {
+			return
+		}
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			failed := make([]MQTTRecord, 0, len(batchErr.Failed))
+			for _, i := range batchErr.Failed {
+				failed = append(failed, records[i])
+			}
+			records = failed
+		}
+		if attempt == b.config.Retries {
+			if b.spool != nil {
+				logger.Errorf("collection %s: spooling %d records after %d retries: %v",
+					collection, len(records), attempt, err)
+				b.toSpool(collection, records)
+				return
+			}
+			logger.Errorf("collection %s: giving up %d records after %d retries: %v",
+				collection, len(records), attempt, err)
+			return
+		}
+		logger.Warnf("collection %s: retrying %d records in %v: %v", collection, len(records), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (b *batcher) toSpool(collection string, records []MQTTRecord) {
+	if err := b.spool.Append(collection, records); err != nil {
+		logger.Errorf("collection %s: giving up %d records: %v", collection, len(records), err)
+	}
+}
+
+// replay writes the spooled records to the store for at most an interval
+func (b *batcher) replay() {
+	if b.spool == nil {
+		return
+	}
+	start := time.Now()
+	for b.spool.Len() > 0 && time.Since(start) < b.config.Interval {
+		if err := b.spool.Replay(b.store, b.config.Size); err != nil {
+			if !b.replayFailing {
+				logger.Warnf("replay of %d spooled records failed, retrying every %v: %v",
+					b.spool.Len(), b.config.Interval, err)
+				b.replayFailing = true
+			}
+			return
+		}
+		if b.replayFailing {
+			logger.Infof("replaying the spooled records, %d left", b.spool.Len())
+			b.replayFailing = false
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/crosstyan/mqtt-to-ws/broker"
+	"github.com/crosstyan/mqtt-to-ws/config"
+	l "github.com/crosstyan/mqtt-to-ws/logger"
+	"github.com/crosstyan/mqtt-to-ws/model"
+	"github.com/crosstyan/mqtt-to-ws/utils"
+)
+
+// reloader applies the settings which can change while the bridge runs,
+// on SIGHUP and on POST /admin/reload
+type reloader struct {
+	mu     sync.Mutex
+	source *config.Source
+	// the configuration at startup, the changes of the other settings need a restart
+	startup *config.Config
+	// the configuration applied by the last reload
+	current *config.Config
+	// collections with a query route
+	collections map[string]bool
+	store       model.Store
+	routes      *model.RouteTable
+	auth        *broker.Auth
+	hub         *utils.Hub
+	purger      *model.Purger
+}
+
+func newReloader(source *config.Source, startup *config.Config, store model.Store, routes *model.RouteTable,
+	auth *broker.Auth, hub *utils.Hub, purger *model.Purger) *reloader {
+	collections := make(map[string]bool)
+	for _, collection := range routes.Load().Collections() {
+		collections[collection] = true
+	}
+	return &reloader{
+		source:      source,
+		startup:     startup,
+		current:     startup,
+		collections: collections,
+		store:       store,
+		routes:      routes,
+		auth:        auth,
+		hub:         hub,
+		purger:      purger,
+	}
+}
+
+// reload loads the whole configuration before applying anything,
+// so an invalid configuration leaves the running one untouched
+func (r *reloader) reload() (*config.ReloadReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := r.source.Load()
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	routes, err := cfg.LoadRoutes()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := cfg.LoadAuth()
+	if err != nil {
+		return nil, err
+	}
+	acl, err := cfg.LoadWsACL()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := config.Changes(r.startup, cfg)
+	if err != nil {
+		return nil, err
+	}
+	report := &config.ReloadReport{Reloaded: []string{}, RestartRequired: []string{}}
+	for _, key := range changes {
+		if !config.IsReloadable(key) {
+			report.RestartRequired = append(report.RestartRequired, key)
+		}
+	}
+	applied, err := config.Changes(r.current, cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range applied {
+		if config.IsReloadable(key) {
+			report.Reloaded = append(report.Reloaded, key)
+		}
+	}
+	// the files are read again, their content may have changed
+	acl = normalizeACL(acl)
+	reloaded(report, !reflect.DeepEqual(routes, r.routes.Load()), cfg.RoutesFile != "", "routes")
+	reloaded(report, !r.auth.Same(auth), cfg.MQTT.AuthFile != "", "mqtt.auth")
+	reloaded(report, !reflect.DeepEqual(acl, normalizeACL(r.hub.ACL())), cfg.Websocket.ACLFile != "", "websocket.acl")
+	sort.Strings(report.Reloaded)
+	// the new collections are stored and served by /topics, but GET /<collection> is only added on startup
+	for _, collection := range routes.Collections() {
+		if !r.collections[collection] {
+			report.RestartRequired = append(report.RestartRequired, "routes: GET /"+collection)
+		}
+	}
+
+	ensureIndexes(r.store, routes.Collections())
+	r.current = cfg
+	r.routes.Store(routes)
+	// the retention of the routes may have changed
+	r.purger.Reload()
+	r.auth.Replace(auth)
+	r.hub.SetACL(acl)
+	l.SetLevels(cfg.Log)
+	if len(report.RestartRequired) > 0 {
+		logger.Warnf("configuration reloaded, a restart is required to apply %v", report.RestartRequired)
+	} else {
+		logger.Info("configuration reloaded")
+	}
+	return report, nil
+}
+
+// reloaded adds the setting at key to the reloaded ones if its value changed and it isn't listed yet,
+// or key+"_file" if fromFile tells the value is read from a file
+func reloaded(report *config.ReloadReport, changed, fromFile bool, key string) {
+	if !changed {
+		return
+	}
+	if fromFile {
+		key += "_file"
+	}
+	for _, k := range report.Reloaded {
+		if k == key || strings.HasPrefix(k, key+".") {
+			return
+		}
+	}
+	report.Reloaded = append(report.Reloaded, key)
+}
+
+// normalizeACL returns the ACL the hub uses for acl, an empty one when there is none
+func normalizeACL(acl *utils.WsACL) *utils.WsACL {
+	if acl == nil {
+		return &utils.WsACL{}
+	}
+	return acl
+}
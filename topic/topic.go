@@ -0,0 +1,189 @@
+// Package topic implements MQTT topic filter matching.
+// See https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html#_Toc398718106
+package topic
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SingleLevel matches exactly one topic level
+	SingleLevel = "+"
+	// MultiLevel matches any number of levels, including the parent level.
+	// It must be the last level of a filter.
+	MultiLevel = "#"
+	separator  = "/"
+)
+
+// Split splits a topic or topic filter into its levels
+func Split(topic string) []string {
+	return strings.Split(topic, separator)
+}
+
+// Join is the inverse of Split
+func Join(levels []string) string {
+	return strings.Join(levels, separator)
+}
+
+// ValidateFilter checks if the topic filter is well formed
+func ValidateFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty topic filter")
+	}
+	levels := Split(filter)
+	for i, level := range levels {
+		if strings.Contains(level, MultiLevel) && (level != MultiLevel || i != len(levels)-1) {
+			return fmt.Errorf("topic filter %q: '#' must occupy an entire level and be the last one", filter)
+		}
+		if strings.Contains(level, SingleLevel) && level != SingleLevel {
+			return fmt.Errorf("topic filter %q: '+' must occupy an entire level", filter)
+		}
+	}
+	return nil
+}
+
+// ValidateName checks if the topic name can be published to, i.e. it has no wildcards
+func ValidateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty topic name")
+	}
+	if strings.ContainsAny(name, SingleLevel+MultiLevel) {
+		return fmt.Errorf("topic name %q must not contain wildcards", name)
+	}
+	return nil
+}
+
+// Match reports whether the topic name matches the topic filter.
+// Topics beginning with '$' are not matched by filters starting with a wildcard.
+func Match(filter string, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, SingleLevel) || strings.HasPrefix(filter, MultiLevel)) {
+		return false
+	}
+	f := Split(filter)
+	n := Split(name)
+	for i, level := range f {
+		if level == MultiLevel {
+			return true
+		}
+		if i >= len(n) {
+			return false
+		}
+		if level != SingleLevel && level != n[i] {
+			return false
+		}
+	}
+	return len(f) == len(n)
+}
+
+// Trie indexes subscribers by their topic filters,
+// so the subscribers of a topic can be found without scanning every filter.
+// It's not safe for concurrent use.
+type Trie struct {
+	root *node
+}
+
+type node struct {
+	children    map[string]*node
+	subscribers map[interface{}]struct{}
+}
+
+func newNode() *node {
+	return &node{
+		children:    make(map[string]*node),
+		subscribers: make(map[interface{}]struct{}),
+	}
+}
+
+func NewTrie() *Trie {
+	return &Trie{root: newNode()}
+}
+
+// Subscribe adds the subscriber to the filter. The filter should be validated by ValidateFilter.
+func (t *Trie) Subscribe(filter string, subscriber interface{}) {
+	n := t.root
+	for _, level := range Split(filter) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+	n.subscribers[subscriber] = struct{}{}
+}
+
+// Unsubscribe removes the subscriber from the filter and prunes the empty branches
+func (t *Trie) Unsubscribe(filter string, subscriber interface{}) {
+	levels := Split(filter)
+	path := []*node{t.root}
+	n := t.root
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			return
+		}
+		n = child
+		path = append(path, n)
+	}
+	delete(n.subscribers, subscriber)
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.subscribers) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+}
+
+// Match returns every subscriber with a filter matching the topic name
+func (t *Trie) Match(name string) map[interface{}]struct{} {
+	matched := make(map[interface{}]struct{})
+	levels := Split(name)
+	// Topics beginning with '$' are not matched by filters starting with a wildcard
+	t.root.match(levels, strings.HasPrefix(name, "$"), matched)
+	return matched
+}
+
+func (n *node) match(levels []string, isSys bool, matched map[interface{}]struct{}) {
+	if !isSys {
+		if multi, ok := n.children[MultiLevel]; ok {
+			// '#' also matches the parent level
+			for s := range multi.subscribers {
+				matched[s] = struct{}{}
+			}
+		}
+	}
+	if len(levels) == 0 {
+		for s := range n.subscribers {
+			matched[s] = struct{}{}
+		}
+		return
+	}
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], false, matched)
+	}
+	if !isSys {
+		if single, ok := n.children[SingleLevel]; ok {
+			single.match(levels[1:], false, matched)
+		}
+	}
+}
+
+// Covers reports whether every topic matched by filter is also matched by allowed
+func Covers(allowed string, filter string) bool {
+	a := Split(allowed)
+	f := Split(filter)
+	for i, level := range a {
+		if level == MultiLevel {
+			return true
+		}
+		if i >= len(f) || f[i] == MultiLevel {
+			return false
+		}
+		if level != SingleLevel && level != f[i] {
+			return false
+		}
+	}
+	return len(a) == len(f)
+}
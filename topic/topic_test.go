@@ -0,0 +1,185 @@
+package topic
+
+import (
+	"testing"
+)
+
+var matchTests = []struct {
+	filter string
+	name   string
+	want   bool
+}{
+	{"a/b", "a/b", true},
+	{"a/b", "a/c", false},
+	{"a/b", "a", false},
+	{"a/b", "a/b/c", false},
+	{"a", "A", false},
+	{"+", "a", true},
+	{"+", "a/b", false},
+	{"+", "", true},
+	{"a/+", "a/b", true},
+	{"a/+", "a", false},
+	{"a/+", "a/", true},
+	{"a/+/c", "a/b/c", true},
+	{"a/+/c", "a/b/d", false},
+	{"+/+", "/a", true},
+	{"+/b/+", "a/b/c", true},
+	{"#", "a", true},
+	{"#", "a/b/c", true},
+	{"#", "/", true},
+	{"a/#", "a", true},
+	{"a/#", "a/b/c", true},
+	{"a/#", "b/a", false},
+	{"a/+/#", "a/b", true},
+	{"a/+/#", "a", false},
+	// '$' topics are only matched by filters which don't start with a wildcard
+	{"#", "$SYS/broker", false},
+	{"+/broker", "$SYS/broker", false},
+	{"$SYS/#", "$SYS/broker", true},
+	{"$SYS/+", "$SYS/broker", true},
+	{"a/#", "a/$b", true},
+	{"a/+", "a/$b", true},
+}
+
+func TestMatch(t *testing.T) {
+	for _, tt := range matchTests {
+		if got := Match(tt.filter, tt.name); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.filter, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrieMatch(t *testing.T) {
+	// the trie must agree with Match
+	for _, tt := range matchTests {
+		trie := NewTrie()
+		trie.Subscribe(tt.filter, "s")
+		_, got := trie.Match(tt.name)["s"]
+		if got != tt.want {
+			t.Errorf("trie with %q matching %q = %v, want %v", tt.filter, tt.name, got, tt.want)
+		}
+	}
+
+	trie := NewTrie()
+	for _, filter := range []string{"a/b", "a/+", "a/#", "#", "+/b", "$SYS/#", "c"} {
+		trie.Subscribe(filter, filter)
+	}
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"a/b", []string{"a/b", "a/+", "a/#", "#", "+/b"}},
+		{"a", []string{"a/#", "#"}},
+		{"a/c/d", []string{"a/#", "#"}},
+		{"c", []string{"c", "#"}},
+		{"$SYS/uptime", []string{"$SYS/#"}},
+	}
+	for _, tt := range tests {
+		matched := trie.Match(tt.name)
+		if len(matched) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.name, matched, tt.want)
+			continue
+		}
+		for _, filter := range tt.want {
+			if _, ok := matched[filter]; !ok {
+				t.Errorf("%q: got %v, want %v", tt.name, matched, tt.want)
+			}
+		}
+	}
+}
+
+func TestTrieUnsubscribe(t *testing.T) {
+	trie := NewTrie()
+	trie.Subscribe("a/+/c", 1)
+	trie.Subscribe("a/+/c", 2)
+	trie.Subscribe("a/#", 3)
+
+	trie.Unsubscribe("a/+/c", 1)
+	if matched := trie.Match("a/b/c"); len(matched) != 2 {
+		t.Errorf("got %v, want 2 and 3", matched)
+	}
+	// unknown filters and subscribers are ignored
+	trie.Unsubscribe("x/y", 1)
+	trie.Unsubscribe("a/+/c", 4)
+
+	trie.Unsubscribe("a/+/c", 2)
+	trie.Unsubscribe("a/#", 3)
+	if matched := trie.Match("a/b/c"); len(matched) != 0 {
+		t.Errorf("got %v, want nothing", matched)
+	}
+	// the empty branches are pruned
+	if len(trie.root.children) != 0 {
+		t.Errorf("%d branches left", len(trie.root.children))
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"a/b", true},
+		{"+", true},
+		{"#", true},
+		{"a/+/c", true},
+		{"a/#", true},
+		{"+/+/#", true},
+		{"/", true},
+		{"$SYS/#", true},
+		{"", false},
+		{"a/#/c", false},
+		{"a#", false},
+		{"a/b#", false},
+		{"#/a", false},
+		{"a+", false},
+		{"a/+b/c", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateFilter(tt.filter); (err == nil) != tt.valid {
+			t.Errorf("ValidateFilter(%q) = %v, want valid %v", tt.filter, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"a/b", true},
+		{"$SYS/broker", true},
+		{"/", true},
+		{"", false},
+		{"a/+", false},
+		{"a/#", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateName(tt.name); (err == nil) != tt.valid {
+			t.Errorf("ValidateName(%q) = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		allowed string
+		filter  string
+		want    bool
+	}{
+		{"#", "a/#", true},
+		{"a/#", "a/b/+", true},
+		{"a/#", "a", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/b", "a/+", false},
+		{"a/+", "a/b/c", false},
+		{"a/b", "a/b", true},
+		{"a/b", "a", false},
+	}
+	for _, tt := range tests {
+		if got := Covers(tt.allowed, tt.filter); got != tt.want {
+			t.Errorf("Covers(%q, %q) = %v, want %v", tt.allowed, tt.filter, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/crosstyan/mqtt-to-ws/topic"
+	"gopkg.in/yaml.v2"
+)
+
+// WsPermission lists the topic filters a websocket client may publish to
+type WsPermission struct {
+	Publish []string `yaml:"publish"`
+}
+
+// WsToken grants its permission to the clients connecting with it
+type WsToken struct {
+	// Name identifies the client in the logs and in the published messages
+	Name         string `yaml:"name"`
+	Token        string `yaml:"token"`
+	WsPermission `yaml:",inline"`
+}
+
+// WsACL controls what the websocket clients may publish.
+// Clients connecting without a token get the Anonymous permission,
+// clients with an unknown token are rejected, unless there is no token at all.
+//
+//	anonymous:
+//	  publish: []
+//	tokens:
+//	  - name: control-panel
+//	    token: s3cr3t
+//	    publish: ["devices/+/cmd"]
+type WsACL struct {
+	Anonymous WsPermission `yaml:"anonymous"`
+	Tokens    []WsToken    `yaml:"tokens"`
+}
+
+// LoadWsACL reads the ACL from a YAML file
+func LoadWsACL(path string) (*WsACL, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var acl WsACL
+	if err = yaml.UnmarshalStrict(content, &acl); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err = acl.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &acl, nil
+}
+
+// Validate checks the topic filters and makes sure tokens are unique
+func (a *WsACL) Validate() error {
+	for _, filter := range a.Anonymous.Publish {
+		if err := topic.ValidateFilter(filter); err != nil {
+			return fmt.Errorf("anonymous: %w", err)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, t := range a.Tokens {
+		if t.Token == "" {
+			return fmt.Errorf("token %d: empty token", i)
+		}
+		if seen[t.Token] {
+			return fmt.Errorf("token %d: duplicated token", i)
+		}
+		seen[t.Token] = true
+		for _, filter := range t.Publish {
+			if err := topic.ValidateFilter(filter); err != nil {
+				return fmt.Errorf("token %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Authorize returns the name and the permission of a token.
+// An empty token is anonymous, and so is any token when the ACL has none.
+func (a *WsACL) Authorize(token string) (string, WsPermission, bool) {
+	if t := a.find(token); t != nil {
+		return t.Name, t.WsPermission, true
+	}
+	if token == "" || len(a.Tokens) == 0 {
+		return "", a.Anonymous, true
+	}
+	return "", WsPermission{}, false
+}
+
+// find returns the entry of the token, nil if it's unknown.
+// Every token is compared in constant time so the timing doesn't tell how close a guess is.
+func (a *WsACL) find(token string) *WsToken {
+	if token == "" {
+		return nil
+	}
+	var found *WsToken
+	for i := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(a.Tokens[i].Token), []byte(token)) == 1 {
+			found = &a.Tokens[i]
+		}
+	}
+	return found
+}
+
+// CanPublish reports whether the topic matches one of the allowed filters
+func (p *WsPermission) CanPublish(name string) bool {
+	for _, filter := range p.Publish {
+		if topic.Match(filter, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken reads the token from the "token" query parameter, since browsers can't set headers
+// on websocket requests, or from the "Authorization: Bearer" header. The other schemes are ignored.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return BearerToken(r.Header.Get("Authorization"))
+}
+
+// BearerToken returns the token of an Authorization header with the Bearer scheme, in any case.
+// It's empty for the other schemes.
+func BearerToken(header string) string {
+	const scheme = "bearer "
+	if len(header) > len(scheme) && strings.EqualFold(header[:len(scheme)], scheme) {
+		return strings.TrimSpace(header[len(scheme):])
+	}
+	return ""
+}
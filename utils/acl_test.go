@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWsACLAuthorize(t *testing.T) {
+	acl := &WsACL{
+		Anonymous: WsPermission{Publish: []string{"public/#"}},
+		Tokens: []WsToken{
+			{Name: "panel", Token: "s3cr3t", WsPermission: WsPermission{Publish: []string{"devices/+/cmd"}}},
+		},
+	}
+	tests := []struct {
+		name    string
+		acl     *WsACL
+		token   string
+		ok      bool
+		client  string
+		publish string
+	}{
+		{"anonymous", acl, "", true, "", "public/a"},
+		{"known token", acl, "s3cr3t", true, "panel", "devices/1/cmd"},
+		{"unknown token", acl, "guess", false, "", ""},
+		{"prefix of a token", acl, "s3cr", false, "", ""},
+		{"no ACL, no token", &WsACL{}, "", true, "", ""},
+		// the clients sending a token stay anonymous when no token is configured
+		{"no ACL, any token", &WsACL{}, "anything", true, "", ""},
+		{"no tokens, any token", &WsACL{Anonymous: acl.Anonymous}, "anything", true, "", "public/a"},
+	}
+	for _, tt := range tests {
+		client, permission, ok := tt.acl.Authorize(tt.token)
+		if ok != tt.ok || client != tt.client {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tt.name, client, ok, tt.client, tt.ok)
+		}
+		if tt.publish != "" && !permission.CanPublish(tt.publish) {
+			t.Errorf("%s: can't publish to %s", tt.name, tt.publish)
+		}
+		if tt.publish == "" && len(permission.Publish) > 0 {
+			t.Errorf("%s: got permission %v", tt.name, permission)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		url    string
+		header string
+		want   string
+	}{
+		{"/ws", "", ""},
+		{"/ws?token=abc", "", "abc"},
+		{"/ws?token=abc", "Bearer def", "abc"},
+		{"/ws", "Bearer def", "def"},
+		{"/ws", "bearer def", "def"},
+		{"/ws", "Basic dXNlcjpwYXNz", ""},
+		{"/ws", "Bearer ", ""},
+		{"/ws", "def", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := requestToken(r); got != tt.want {
+			t.Errorf("%s with %q: got %q, want %q", tt.url, tt.header, got, tt.want)
+		}
+	}
+}
@@ -23,7 +23,7 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	maxMessageSize = 8192
 )
 
 var (
@@ -51,6 +51,24 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// Topic filters subscribed by the client. Only accessed by the hub.
+	filters map[string]bool
+
+	// Whether the client is still on the default subscription to every topic
+	implicit bool
+
+	// Name of the token used by the client, or its remote address if it's anonymous
+	name string
+
+	// Token the client connected with, checked again when the ACL is replaced
+	token string
+
+	// Topics the client may publish to
+	permission WsPermission
+
+	// Payload of the close frame sent when the hub closes send, empty by default
+	closeMessage []byte
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -60,7 +78,10 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
@@ -75,7 +96,11 @@ func (c *Client) readPump() {
 			break
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.hub.broadcast <- message
+		select {
+		case c.hub.inbound <- inbound{client: c, message: message}:
+		case <-c.hub.done:
+			return
+		}
 	}
 }
 
@@ -89,6 +114,7 @@ func (c *Client) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
 	for {
 		select {
@@ -96,7 +122,7 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.conn.WriteMessage(websocket.CloseMessage, c.closeMessage)
 				return
 			}
 
@@ -127,16 +153,46 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+	acl := hub.ACL()
+	name, permission, ok := acl.Authorize(token)
+	if !ok {
+		logger.Warnf("websocket client %s rejected: unknown token", r.RemoteAddr)
+		http.Error(w, "unknown token", http.StatusUnauthorized)
+		return
+	}
+	// the clients let through with an unknown token are anonymous, also after a reload
+	if acl.find(token) == nil {
+		token = ""
+	}
+	if name == "" {
+		name = r.RemoteAddr
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Error(err)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
-	totalClients := len(hub.clients)
-	logger.Infof("new client connected, total: %d", totalClients+1)
-
+	client := &Client{
+		hub:        hub,
+		conn:       conn,
+		send:       make(chan []byte, 256),
+		filters:    make(map[string]bool),
+		name:       name,
+		token:      token,
+		permission: permission,
+	}
+	// added before registering, so Hub.Wait can't miss the pump
+	hub.pumps.Add(1)
+	select {
+	case client.hub.register <- client:
+	case <-hub.done:
+		hub.pumps.Done()
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+		conn.Close()
+		return
+	}
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
 	go client.writePump()
@@ -5,23 +5,34 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
 	l "github.com/crosstyan/mqtt-to-ws/logger"
 	"github.com/crosstyan/mqtt-to-ws/model"
-	"github.com/davecgh/go-spew/spew"
+	"github.com/crosstyan/mqtt-to-ws/topic"
+	"github.com/gorilla/websocket"
 )
 
-var logger = l.Lsugar
+var logger = l.For(l.Hub)
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+// messageLogger logs every message, it's sampled
+var messageLogger = l.Sampled(l.Hub)
+
+// Hub maintains the set of active clients and forwards the MQTT messages to the
+// clients subscribed to their topic.
 type Hub struct {
 	// Registered clients.
 	clients map[*Client]bool
 
+	// Topic filters of the clients
+	subscriptions *topic.Trie
+
 	// Inbound messages from the clients.
-	broadcast chan []byte
+	inbound chan inbound
 
 	// Register requests from the clients.
 	register chan *Client
@@ -29,54 +40,311 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	mqttToWs chan model.MQTTMsg
+	mqttToWs <-chan model.MQTTMsg
+
+	// Injects the messages published by the clients into the MQTT broker
+	publish PublishFunc
+
+	// Pending publish requests, handled one by one to keep their order
+	publishJobs chan publishJob
+
+	// Replies of the publish worker
+	replies chan reply
+
+	// *WsACL, replaced by the ACL updates
+	acl atomic.Value
+
+	// ACL updates, applied by the hub to the connected clients
+	aclUpdates chan *WsACL
+
+	// Answered by Run, to check that it's not stuck
+	pings chan struct{}
+
+	// Closed when Run returns
+	done chan struct{}
+
+	// Write pumps of the clients, waited for on shutdown so they can send their close frame
+	pumps sync.WaitGroup
 }
 
-func NewWsHub(mqttToWs chan model.MQTTMsg) *Hub {
-	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		mqttToWs:   mqttToWs,
+// PublishFunc injects a message published by a websocket client into the MQTT broker
+type PublishFunc func(msg model.MQTTMsg) error
+
+const maxPendingPublish = 256
+
+// NewWsHub creates a hub. Clients can't publish if publish or acl is nil.
+func NewWsHub(mqttToWs <-chan model.MQTTMsg, publish PublishFunc, acl *WsACL) *Hub {
+	if acl == nil {
+		acl = &WsACL{}
+	}
+	h := &Hub{
+		inbound:       make(chan inbound),
+		register:      make(chan *Client),
+		unregister:    make(chan *Client),
+		clients:       make(map[*Client]bool),
+		subscriptions: topic.NewTrie(),
+		mqttToWs:      mqttToWs,
+		publish:       publish,
+		publishJobs:   make(chan publishJob, maxPendingPublish),
+		replies:       make(chan reply),
+		aclUpdates:    make(chan *WsACL),
+		pings:         make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	h.acl.Store(acl)
+	return h
+}
+
+// ACL returns the current ACL
+func (h *Hub) ACL() *WsACL {
+	return h.acl.Load().(*WsACL)
+}
+
+// SetACL replaces the ACL. The connected clients get the permission of their token
+// in the new ACL, those whose token is gone are disconnected.
+func (h *Hub) SetACL(acl *WsACL) {
+	if acl == nil {
+		acl = &WsACL{}
+	}
+	select {
+	case h.aclUpdates <- acl:
+	case <-h.done:
 	}
 }
 
+// Run forwards the MQTT messages until mqttToWs is closed,
+// then the clients are disconnected with a going away close frame
 func (h *Hub) Run() {
+	defer close(h.done)
+	go h.publishWorker()
 	for {
 		select {
 		case client := <-h.register:
+			// the ACL may have changed since the client was authorized
+			if !h.authorize(client) {
+				continue
+			}
 			h.clients[client] = true
+			wsClients.Inc()
+			logger.Infof("websocket client %s connected, total: %d", client.name, len(h.clients))
+			// Clients receive every message until they subscribe to something
+			h.subscribe(client, topic.MultiLevel)
+			client.implicit = true
+		case acl := <-h.aclUpdates:
+			h.acl.Store(acl)
+			for client := range h.clients {
+				h.authorize(client)
+			}
+			logger.Infof("websocket ACL replaced, %d clients kept", len(h.clients))
+		case <-h.pings:
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
+			}
+		case in := <-h.inbound:
+			if _, ok := h.clients[in.client]; ok {
+				h.handleRequest(in.client, in.message)
+			}
+		case r := <-h.replies:
+			if _, ok := h.clients[r.client]; ok {
+				h.send(r.client, r.message)
 			}
-		// Just do nothing when there is a broadcast message
-		// case message := <-h.broadcast:
-		//  lsugar.Infof("Message from other clients: %s", message)
-		// 	for client := range h.clients {
-		// 		select {
-		// 		case client.send <- message:
-		// 		default:
-		// 			close(client.send)
-		// 			delete(h.clients, client)
-		// 		}
-		// 	}
-		case message := <-h.mqttToWs:
-			logger.Infof("Message from MQTT:\n%s", spew.Sdump(message))
+		case message, ok := <-h.mqttToWs:
+			if !ok {
+				// the broker is stopping
+				h.shutdown()
+				return
+			}
+			messageLogger.Debugw("message from MQTT", "topic", message.Topic,
+				"client_id", message.ClientID, "qos", message.QoS, "bytes", len(message.Payload))
 			marshaled, err := json.Marshal(message)
 			if err != nil {
 				logger.Errorf("Error marshaling message: %v", err)
 			}
-			for client := range h.clients {
-				select {
-				case client.send <- marshaled:
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+			for s := range h.subscriptions.Match(message.Topic) {
+				h.send(s.(*Client), marshaled)
+				wsForwarded.Inc()
 			}
 		}
 	}
 }
+
+// authorize updates the permission of the client from the current ACL,
+// or disconnects it if its token is unknown
+func (h *Hub) authorize(client *Client) bool {
+	_, permission, ok := h.ACL().Authorize(client.token)
+	if !ok {
+		logger.Warnf("websocket client %s disconnected: token revoked", client.name)
+		client.closeMessage = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked")
+		if _, registered := h.clients[client]; registered {
+			h.remove(client)
+		} else {
+			close(client.send)
+		}
+		return false
+	}
+	client.permission = permission
+	return true
+}
+
+// send drops the client if its buffer is full
+func (h *Hub) send(client *Client, message []byte) {
+	select {
+	case client.send <- message:
+	default:
+		logger.Warnf("websocket client %s disconnected: too slow", client.name)
+		wsSlowClients.Inc()
+		h.remove(client)
+	}
+}
+
+// shutdown disconnects every client
+func (h *Hub) shutdown() {
+	logger.Infof("closing %d websocket clients", len(h.clients))
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for client := range h.clients {
+		client.closeMessage = closeMessage
+		h.remove(client)
+	}
+	// only the hub sends publish jobs
+	close(h.publishJobs)
+}
+
+// Ping checks that Run is handling the events of the hub
+func (h *Hub) Ping(ctx context.Context) error {
+	select {
+	case h.pings <- struct{}{}:
+		return nil
+	case <-h.done:
+		return fmt.Errorf("hub stopped")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait waits for Run to return and for the clients to receive their close frame
+func (h *Hub) Wait(ctx context.Context) error {
+	pumps := make(chan struct{})
+	go func() {
+		<-h.done
+		h.pumps.Wait()
+		close(pumps)
+	}()
+	select {
+	case <-pumps:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *Hub) remove(client *Client) {
+	for filter := range client.filters {
+		h.subscriptions.Unsubscribe(filter, client)
+	}
+	close(client.send)
+	delete(h.clients, client)
+	wsClients.Dec()
+}
+
+func (h *Hub) subscribe(client *Client, filter string) {
+	client.filters[filter] = true
+	h.subscriptions.Subscribe(filter, client)
+}
+
+func (h *Hub) unsubscribe(client *Client, filter string) {
+	delete(client.filters, filter)
+	h.subscriptions.Unsubscribe(filter, client)
+}
+
+func (h *Hub) handleRequest(client *Client, message []byte) {
+	var req Request
+	if err := json.Unmarshal(message, &req); err != nil {
+		h.send(client, nack(&req, err))
+		return
+	}
+	switch req.Op {
+	case OpSubscribe, OpUnsubscribe:
+		if len(req.Topics) == 0 {
+			h.send(client, nack(&req, fmt.Errorf("no topics")))
+			return
+		}
+		for _, filter := range req.Topics {
+			if err := topic.ValidateFilter(filter); err != nil {
+				h.send(client, nack(&req, err))
+				return
+			}
+		}
+		if client.implicit {
+			h.unsubscribe(client, topic.MultiLevel)
+			client.implicit = false
+		}
+		for _, filter := range req.Topics {
+			if req.Op == OpSubscribe {
+				h.subscribe(client, filter)
+			} else {
+				h.unsubscribe(client, filter)
+			}
+		}
+		h.send(client, ack(&req))
+	case OpPublish:
+		if err := h.checkPublish(client, &req); err != nil {
+			wsPublishes.WithLabelValues("rejected").Inc()
+			h.send(client, nack(&req, err))
+			return
+		}
+		select {
+		case h.publishJobs <- publishJob{client: client, req: req}:
+		default:
+			wsPublishes.WithLabelValues("rejected").Inc()
+			h.send(client, nack(&req, fmt.Errorf("too many pending publish requests")))
+		}
+	default:
+		h.send(client, nack(&req, fmt.Errorf("unknown op %q", req.Op)))
+	}
+}
+
+func (h *Hub) checkPublish(client *Client, req *Request) error {
+	if h.publish == nil {
+		return fmt.Errorf("publishing is disabled")
+	}
+	if err := topic.ValidateName(req.Topic); err != nil {
+		return err
+	}
+	if req.QoS > 2 {
+		return fmt.Errorf("invalid qos %d", req.QoS)
+	}
+	if !client.permission.CanPublish(req.Topic) {
+		logger.Warnf("websocket client %s is not allowed to publish to %s", client.name, req.Topic)
+		return fmt.Errorf("not allowed to publish to %s", req.Topic)
+	}
+	return nil
+}
+
+// publishWorker publishes the requests of the clients without blocking the hub
+func (h *Hub) publishWorker() {
+	for job := range h.publishJobs {
+		msg := model.MQTTMsg{
+			Topic:    job.req.Topic,
+			Payload:  job.req.Payload,
+			ClientID: "ws:" + job.client.name,
+			Username: job.client.name,
+			QoS:      job.req.QoS,
+			Retain:   job.req.Retain,
+		}
+		var message []byte
+		if err := h.publish(msg); err != nil {
+			logger.Error(err)
+			wsPublishes.WithLabelValues("failed").Inc()
+			message = nack(&job.req, err)
+		} else {
+			wsPublishes.WithLabelValues("ok").Inc()
+			message = ack(&job.req)
+		}
+		select {
+		case h.replies <- reply{client: job.client, message: message}:
+		case <-h.done:
+			return
+		}
+	}
+}
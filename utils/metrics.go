@@ -0,0 +1,34 @@
+package utils
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	wsClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mqttws",
+		Subsystem: "websocket",
+		Name:      "clients",
+		Help:      "Connected websocket clients",
+	})
+	wsForwarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "websocket",
+		Name:      "messages_forwarded_total",
+		Help:      "MQTT messages sent to the subscribed websocket clients",
+	})
+	wsSlowClients = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "websocket",
+		Name:      "slow_clients_dropped_total",
+		Help:      "Websocket clients disconnected because their send buffer was full",
+	})
+	wsPublishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mqttws",
+		Subsystem: "websocket",
+		Name:      "publishes_total",
+		Help:      "Publish requests of the websocket clients, by result: ok, rejected or failed",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(wsClients, wsForwarded, wsSlowClients, wsPublishes)
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"encoding/json"
+)
+
+// Operations of the requests sent by the websocket clients
+const (
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+	OpPublish     = "publish"
+)
+
+// Operations of the frames sent to the websocket clients besides the MQTT messages
+const (
+	OpAck   = "ack"
+	OpError = "error"
+)
+
+// Request is sent by a websocket client, e.g.
+//
+//	{"op":"subscribe","topics":["site1/+/temp"]}
+//	{"op":"publish","topic":"devices/fan1/cmd","payload":"on","qos":1,"retain":false}
+type Request struct {
+	Op string `json:"op"`
+	// Optional, echoed back in the response so the client can match them
+	ID string `json:"id,omitempty"`
+	// Topic filters of subscribe and unsubscribe
+	Topics []string `json:"topics,omitempty"`
+	// Topic name, payload, QoS and retain flag of publish
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	QoS     uint8  `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// Response acknowledges a Request or reports why it failed
+type Response struct {
+	// ack or error
+	Op string `json:"op"`
+	ID string `json:"id,omitempty"`
+	// The op of the request
+	Request string   `json:"request,omitempty"`
+	Topics  []string `json:"topics,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	Err     string   `json:"error,omitempty"`
+}
+
+// inbound is a message read from a client
+type inbound struct {
+	client  *Client
+	message []byte
+}
+
+// publishJob is a publish request waiting for the publish worker of the hub
+type publishJob struct {
+	client *Client
+	req    Request
+}
+
+// reply is sent to a client by the hub if the client is still registered
+type reply struct {
+	client  *Client
+	message []byte
+}
+
+func ack(req *Request) []byte {
+	return marshalResponse(Response{Op: OpAck, ID: req.ID, Request: req.Op, Topics: req.Topics, Topic: req.Topic})
+}
+
+func nack(req *Request, err error) []byte {
+	return marshalResponse(Response{Op: OpError, ID: req.ID, Request: req.Op, Topic: req.Topic, Err: err.Error()})
+}
+
+func marshalResponse(resp Response) []byte {
+	// a Response can always be marshaled
+	marshaled, _ := json.Marshal(resp)
+	return marshaled
+}